@@ -10,6 +10,10 @@ import (
 type Config struct {
 	ADDR string `env:"ADDR" env-default:":8080"`
 
+	// comma separated IPs and CIDR prefixes of the reverse proxies whose
+	// X-Forwarded-For header is trusted, empty trusts none
+	TRUSTED_PROXIES string `env:"TRUSTED_PROXIES" env-default:""`
+
 	HOST              string `env:"HOST"`
 	HOST_DESTINATION  string `env:"HOST_DESTINATION" env-default:"https://www.google.com"`
 	IGNORE_SSL_VERIFY bool   `env:"IGNORE_SSL_VERIFY" env-default:"false"`
@@ -21,11 +25,93 @@ type Config struct {
 	USE_RATELIMIT    bool `env:"USE_RATELIMIT" env-default:"false"`
 	RATELIMIT_SECOND int  `env:"RATELIMIT_SECOND" env-default:"1"`
 	RATELIMIT_MAX    uint `env:"RATELIMIT_MAX" env-default:"5"`
-
-	USE_WAF            bool   `env:"USE_WAF" env-default:"true"`
-	WAF_CONFIG         string `env:"WAF_CONFIG" env-default:"config/keywords.yml"`
-	WAF_PROTECT_HEADER bool   `env:"WAF_PROTECT_HEADER" env-default:"true"`
-	WAF_PROTECT_BODY   bool   `env:"WAF_PROTECT_BODY" env-default:"false"`
+	// serve the challenge instead of 429, the clients who solved it are not limited
+	RATELIMIT_CHALLENGE bool `env:"RATELIMIT_CHALLENGE" env-default:"false"`
+	// what the requests are counted by: ip, country and asn, comma separated
+	RATELIMIT_KEY string `env:"RATELIMIT_KEY" env-default:"ip"`
+
+	USE_WAF             bool   `env:"USE_WAF" env-default:"true"`
+	WAF_ENGINE          string `env:"WAF_ENGINE" env-default:"keywords"` // keywords or secrule
+	WAF_MODE            string `env:"WAF_MODE" env-default:"block"`      // block or detect
+	WAF_CONFIG          string `env:"WAF_CONFIG" env-default:"config/keywords.yml"`
+	WAF_SECRULE_FILES   string `env:"WAF_SECRULE_FILES" env-default:"config/rules/*.conf"` // comma separated glob patterns
+	WAF_EXCLUSIONS      string `env:"WAF_EXCLUSIONS" env-default:""`                       // empty disables exclusions
+	WAF_VIRTUAL_PATCHES string `env:"WAF_VIRTUAL_PATCHES" env-default:""`                  // empty disables virtual patching
+	WAF_OPENAPI_SPECS   string `env:"WAF_OPENAPI_SPECS" env-default:""`                    // e.g. api.example.com/v1=config/openapi.yml
+
+	// rules are also reloaded on SIGHUP, 0 disables polling the rule files
+	WAF_RELOAD_INTERVAL  int    `env:"WAF_RELOAD_INTERVAL" env-default:"5"`
+	WAF_ADMIN_PATH       string `env:"WAF_ADMIN_PATH" env-default:"/_waf/rules"` // empty disables the endpoint
+	WAF_ADMIN_ALLOW_IP   string `env:"WAF_ADMIN_ALLOW_IP" env-default:"127.0.0.1,::1"`
+	WAF_PROTECT_HEADER   bool   `env:"WAF_PROTECT_HEADER" env-default:"true"`
+	WAF_PROTECT_BODY     bool   `env:"WAF_PROTECT_BODY" env-default:"false"`
+	WAF_PROTECT_RESPONSE bool   `env:"WAF_PROTECT_RESPONSE" env-default:"false"`
+	WAF_PROTECT_SSRF     bool   `env:"WAF_PROTECT_SSRF" env-default:"true"`
+	WAF_RESPONSE_CONFIG  string `env:"WAF_RESPONSE_CONFIG" env-default:"config/response.yml"`
+	WAF_DEBUG_HEADER     bool   `env:"WAF_DEBUG_HEADER" env-default:"false"`
+
+	// JSON lines audit log of the flagged requests, empty disables it
+	WAF_AUDIT_LOG             string `env:"WAF_AUDIT_LOG" env-default:""`
+	WAF_AUDIT_LOG_MAX_SIZE    int    `env:"WAF_AUDIT_LOG_MAX_SIZE" env-default:"100"` // in MB, 0 disables rotation
+	WAF_AUDIT_LOG_MAX_BACKUPS int    `env:"WAF_AUDIT_LOG_MAX_BACKUPS" env-default:"5"`
+
+	// protocol enforcement, 0 and empty lists disable a check
+	WAF_ALLOWED_METHODS         string `env:"WAF_ALLOWED_METHODS" env-default:"GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS"`
+	WAF_ALLOWED_HTTP_VERSIONS   string `env:"WAF_ALLOWED_HTTP_VERSIONS" env-default:"HTTP/1.0,HTTP/1.1,HTTP/2.0"`
+	WAF_MAX_URI_LENGTH          int    `env:"WAF_MAX_URI_LENGTH" env-default:"4096"`
+	WAF_MAX_HEADERS             int    `env:"WAF_MAX_HEADERS" env-default:"100"`
+	WAF_MAX_HEADER_NAME_LENGTH  int    `env:"WAF_MAX_HEADER_NAME_LENGTH" env-default:"256"`
+	WAF_MAX_HEADER_VALUE_LENGTH int    `env:"WAF_MAX_HEADER_VALUE_LENGTH" env-default:"8192"`
+	WAF_MAX_ARGS                int    `env:"WAF_MAX_ARGS" env-default:"255"`
+	WAF_MAX_BODY_SIZE           int64  `env:"WAF_MAX_BODY_SIZE" env-default:"10485760"` // in bytes, larger bodies are not read
+
+	// learning mode, records the traffic and proposes an OpenAPI spec and
+	// exclusions at the end of the window
+	WAF_LEARNING        bool   `env:"WAF_LEARNING" env-default:"false"`
+	WAF_LEARNING_WINDOW int    `env:"WAF_LEARNING_WINDOW" env-default:"86400"` // in seconds
+	WAF_LEARNING_DIR    string `env:"WAF_LEARNING_DIR" env-default:"cache/learning"`
+
+	// maximum nesting of XML bodies, 0 disables the check
+	WAF_XML_MAX_DEPTH int `env:"WAF_XML_MAX_DEPTH" env-default:"64"`
+
+	// GraphQL endpoints, e.g. /graphql,/admin/graphql:depth=20:introspection=allow
+	// where an endpoint may override the limits, 0 disables a limit
+	WAF_GRAPHQL_PATHS         string `env:"WAF_GRAPHQL_PATHS" env-default:""`
+	WAF_GRAPHQL_MAX_DEPTH     int    `env:"WAF_GRAPHQL_MAX_DEPTH" env-default:"10"`
+	WAF_GRAPHQL_MAX_ALIASES   int    `env:"WAF_GRAPHQL_MAX_ALIASES" env-default:"10"`
+	WAF_GRAPHQL_MAX_FIELDS    int    `env:"WAF_GRAPHQL_MAX_FIELDS" env-default:"500"`
+	WAF_GRAPHQL_INTROSPECTION bool   `env:"WAF_GRAPHQL_INTROSPECTION" env-default:"false"` // allow __schema and __type
+
+	// multipart file uploads, 0 and empty lists disable a check
+	WAF_UPLOAD_ALLOWED_EXTENSIONS string `env:"WAF_UPLOAD_ALLOWED_EXTENSIONS" env-default:""` // e.g. jpg,png,pdf
+	WAF_UPLOAD_ALLOWED_TYPES      string `env:"WAF_UPLOAD_ALLOWED_TYPES" env-default:""`      // e.g. image/jpeg,image/png
+	WAF_UPLOAD_MAX_FILE_SIZE      int64  `env:"WAF_UPLOAD_MAX_FILE_SIZE" env-default:"5242880"`
+	WAF_UPLOAD_MAX_TOTAL_SIZE     int64  `env:"WAF_UPLOAD_MAX_TOTAL_SIZE" env-default:"10485760"`
+	WAF_CLAMAV_SOCKET             string `env:"WAF_CLAMAV_SOCKET" env-default:""`           // clamd Unix socket, empty disables the malware scan
+	WAF_CLAMAV_TIMEOUT            int    `env:"WAF_CLAMAV_TIMEOUT" env-default:"10"`        // in seconds
+	WAF_CLAMAV_FAIL_CLOSED        bool   `env:"WAF_CLAMAV_FAIL_CLOSED" env-default:"false"` // block the upload when clamd is unavailable
+
+	// resolution of the host names of the URLs checked by the SSRF rules
+	WAF_SSRF_RESOLVE         bool `env:"WAF_SSRF_RESOLVE" env-default:"false"`
+	WAF_SSRF_RESOLVE_TIMEOUT int  `env:"WAF_SSRF_RESOLVE_TIMEOUT" env-default:"500"` // in milliseconds
+	WAF_SSRF_RESOLVE_CACHE   int  `env:"WAF_SSRF_RESOLVE_CACHE" env-default:"300"`   // in seconds
+
+	// maximum number of url_decode passes of the normalization pipeline
+	WAF_DECODE_MAX_DEPTH int `env:"WAF_DECODE_MAX_DEPTH" env-default:"3"`
+
+	// anomaly scoring, a request is blocked when the total score reaches the threshold
+	WAF_INBOUND_THRESHOLD       int `env:"WAF_INBOUND_THRESHOLD" env-default:"5"`
+	WAF_SCORE_SQLI              int `env:"WAF_SCORE_SQLI" env-default:"5"`
+	WAF_SCORE_XSS               int `env:"WAF_SCORE_XSS" env-default:"5"`
+	WAF_SCORE_COMMAND_INJECTION int `env:"WAF_SCORE_COMMAND_INJECTION" env-default:"3"`
+	WAF_SCORE_PATH_TRAVERSAL    int `env:"WAF_SCORE_PATH_TRAVERSAL" env-default:"4"`
+	WAF_CHALLENGE_SCORE         int `env:"WAF_CHALLENGE_SCORE" env-default:"0"` // challenge from this score up to the threshold, 0 disables it
+
+	// proof-of-work challenge of the suspicious clients
+	CHALLENGE_SECRET     string `env:"CHALLENGE_SECRET" env-default:""`       // HMAC key of the clearance cookies, empty uses a random key
+	CHALLENGE_DIFFICULTY int    `env:"CHALLENGE_DIFFICULTY" env-default:"16"` // leading zero bits of the SHA-256 hash
+	CHALLENGE_TTL        int    `env:"CHALLENGE_TTL" env-default:"3600"`      // lifetime of the clearance cookie in seconds
+	CHALLENGE_PATH       string `env:"CHALLENGE_PATH" env-default:"/_waf/challenge"`
 
 	USE_CACHE             bool   `env:"USE_CACHE" env-default:"false"`
 	CACHE_TTL             int    `env:"CACHE_TTL" env-default:"1209600"` // default 2 week
@@ -36,6 +122,38 @@ type Config struct {
 	DETECT_DEVICE         bool `env:"DETECT_DEVICE" env-default:"true"`
 	SPLIT_CACHE_BY_DEVICE bool `env:"SPLIT_CACHE_BY_DEVICE" env-default:"true"`
 
+	// bot classification, the actions are allow, ratelimit or block
+	DETECT_BOT            bool   `env:"DETECT_BOT" env-default:"false"`
+	BOT_HUMAN_ACTION      string `env:"BOT_HUMAN_ACTION" env-default:"allow"`
+	BOT_GOOD_ACTION       string `env:"BOT_GOOD_ACTION" env-default:"allow"`
+	BOT_BAD_ACTION        string `env:"BOT_BAD_ACTION" env-default:"block"`
+	BOT_AUTOMATION_ACTION string `env:"BOT_AUTOMATION_ACTION" env-default:"allow"`
+	BOT_BAD_AGENTS        string `env:"BOT_BAD_AGENTS" env-default:"sqlmap,nikto,nuclei,masscan,nmap,zgrab,wpscan,acunetix,nessus,openvas,netsparker,arachni,w3af,dirbuster,gobuster,feroxbuster,ffuf,wfuzz,whatweb,commix,havij,zmeu,jorgee"`
+	BOT_RATELIMIT_SECOND  int    `env:"BOT_RATELIMIT_SECOND" env-default:"60"`
+	BOT_RATELIMIT_MAX     uint   `env:"BOT_RATELIMIT_MAX" env-default:"60"`
+
+	// crawlers verified by reverse and forward DNS, e.g. Googlebot=googlebot.com|google.com,
+	// empty disables the verification
+	BOT_VERIFY_DOMAINS   string `env:"BOT_VERIFY_DOMAINS" env-default:"Googlebot=googlebot.com|google.com|googleusercontent.com,BingBot=search.msn.com,Applebot=applebot.apple.com,Yandex Bot=yandex.ru|yandex.net|yandex.com,Baidu Spider=baidu.com|baidu.jp,Yahoo! Slurp=crawl.yahoo.net"`
+	BOT_DNS_SERVER       string `env:"BOT_DNS_SERVER" env-default:""`            // host:port, empty uses the system resolver
+	BOT_DNS_TIMEOUT      int    `env:"BOT_DNS_TIMEOUT" env-default:"2"`          // in seconds
+	BOT_VERIFY_CACHE_TTL int    `env:"BOT_VERIFY_CACHE_TTL" env-default:"86400"` // in seconds
+
+	// IP reputation, comma separated list files with their options, e.g.
+	// config/ip-blocklist.txt,cache/tor-exits.txt:name=tor:action=score:score=3
+	USE_IP_REPUTATION             bool   `env:"USE_IP_REPUTATION" env-default:"false"`
+	IP_REPUTATION_LISTS           string `env:"IP_REPUTATION_LISTS" env-default:"config/ip-blocklist.txt"`
+	IP_REPUTATION_SCORE           int    `env:"IP_REPUTATION_SCORE" env-default:"3"`            // default score of the score action
+	IP_REPUTATION_RELOAD_INTERVAL int    `env:"IP_REPUTATION_RELOAD_INTERVAL" env-default:"60"` // in seconds, 0 disables polling the list files
+
+	// GeoIP, MaxMind DB files of the GeoLite2 Country and ASN databases, an
+	// empty file disables its lookup
+	USE_GEOIP             bool   `env:"USE_GEOIP" env-default:"false"`
+	GEOIP_COUNTRY_DB      string `env:"GEOIP_COUNTRY_DB" env-default:"cache/GeoLite2-Country.mmdb"`
+	GEOIP_ASN_DB          string `env:"GEOIP_ASN_DB" env-default:"cache/GeoLite2-ASN.mmdb"`
+	GEOIP_RULES           string `env:"GEOIP_RULES" env-default:""`             // empty allows every country
+	GEOIP_RELOAD_INTERVAL int    `env:"GEOIP_RELOAD_INTERVAL" env-default:"60"` // in seconds, 0 disables polling the files
+
 	REDIS_ADDR string `env:"REDIS_ADDR" env-default:"localhost:6379"`
 	REDIS_SSL  bool   `env:"REDIS_SSL" env-default:"false"`
 	REDIS_USER string `env:"REDIS_USER"`
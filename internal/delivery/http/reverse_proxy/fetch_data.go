@@ -13,7 +13,10 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/internal/middleware/waf"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/urlpath"
 )
 
 // FetchData fetches data from the remote server and caches the response.
@@ -36,12 +39,15 @@ func (h *Handler) FetchData(c *gin.Context) {
 		req.Host = host
 		req.URL.Scheme = remote.Scheme
 		req.URL.Host = remote.Host
-		req.URL.Path = c.Param("path")
+		// the path inspected by the WAF
+		req.URL.Path = urlpath.Clean(c.Param("path"))
 		req.Header.Del("Accept-Encoding")
 	}
 
 	proxy.ModifyResponse = func(r *http.Response) error {
-		if r.StatusCode != http.StatusOK {
+		// error pages are inspected too, they are where stack traces leak
+		inspect := h.wafService != nil && h.config.WAF_PROTECT_RESPONSE
+		if r.StatusCode != http.StatusOK && !inspect {
 			return nil // No need to cache non-200 responses
 		}
 
@@ -59,12 +65,22 @@ func (h *Handler) FetchData(c *gin.Context) {
 			scheme = "http"
 		}
 
-		body = bytes.ReplaceAll(body, []byte(h.config.HOST_DESTINATION), []byte(fmt.Sprintf("%s://%s", scheme, c.Request.Host)))
+		if r.StatusCode == http.StatusOK {
+			body = bytes.ReplaceAll(body, []byte(h.config.HOST_DESTINATION), []byte(fmt.Sprintf("%s://%s", scheme, c.Request.Host)))
+		}
+
+		if inspect {
+			body = h.inspectResponse(c, r, body)
+		}
 
 		r.Body = io.NopCloser(bytes.NewReader(body))
 		r.ContentLength = int64(len(body))
 		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
 
+		if r.StatusCode != http.StatusOK {
+			return nil // No need to cache non-200 responses
+		}
+
 		if h.config.ENABLE_GZIP {
 			r.Header.Del("Accept-Encoding")
 			r.Header.Del("Vary")
@@ -92,3 +108,42 @@ func (h *Handler) FetchData(c *gin.Context) {
 		logger.Logger("Backend too slow: ", duration.String(), c.Request.RequestURI).Warn()
 	}
 }
+
+// inspectResponse runs the WAF response phase, it returns the body to send
+// and updates the status and the headers of blocked responses.
+func (h *Handler) inspectResponse(c *gin.Context, r *http.Response, body []byte) []byte {
+	// the exclusions of the response rules match the request parsed by the WAF
+	request, ok := waf.Request(c)
+	if !ok {
+		request = &service.Request{
+			IP:        c.ClientIP(),
+			Method:    c.Request.Method,
+			Host:      c.Request.Host,
+			Path:      c.Request.RequestURI,
+			CleanPath: urlpath.Clean(c.Request.URL.Path),
+		}
+	}
+	upstream := &service.UpstreamResponse{
+		StatusCode: r.StatusCode,
+		Headers:    make(map[string]string),
+		Body:       body,
+	}
+	for key, value := range r.Header {
+		upstream.Headers[key] = value[0]
+	}
+
+	response, err := h.wafService.HandleResponse(request, upstream)
+	if err != nil || response == nil {
+		return body
+	}
+
+	for key, value := range response.Headers {
+		r.Header.Set(key, value)
+	}
+	if response.StatusCode != r.StatusCode {
+		r.StatusCode = response.StatusCode
+		r.Status = fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode))
+	}
+
+	return response.Body
+}
@@ -12,6 +12,7 @@ import (
 type Handler struct {
 	config      *config.Config
 	cacheDriver service.CacheInterface
+	wafService  service.WAFInterface // nil when the WAF is disabled
 	mu          sync.Mutex
 }
 
@@ -21,11 +22,12 @@ type CacheHandler struct {
 	CacheData    []byte              `json:"data"`
 }
 
-// NewHttpHandler initializes a new HTTP handler with the given configuration and cache driver.
-func NewHttpHandler(config *config.Config, handler *gin.Engine, cacheDriver service.CacheInterface) *Handler {
+// NewHttpHandler initializes a new HTTP handler with the given configuration, cache driver and WAF.
+func NewHttpHandler(config *config.Config, handler *gin.Engine, cacheDriver service.CacheInterface, wafService service.WAFInterface) *Handler {
 	return &Handler{
 		config:      config,
 		cacheDriver: cacheDriver,
+		wafService:  wafService,
 	}
 }
 
@@ -6,10 +6,16 @@ import (
 	"github.com/jahrulnr/go-waf/config"
 	http_clearcache_handler "github.com/jahrulnr/go-waf/internal/delivery/http/clear_cache"
 	http_reverseproxy_handler "github.com/jahrulnr/go-waf/internal/delivery/http/reverse_proxy"
+	http_wafadmin_handler "github.com/jahrulnr/go-waf/internal/delivery/http/waf_admin"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
 	"github.com/jahrulnr/go-waf/internal/middleware/device"
+	"github.com/jahrulnr/go-waf/internal/middleware/geoip"
 	"github.com/jahrulnr/go-waf/internal/middleware/ratelimit"
+	"github.com/jahrulnr/go-waf/internal/middleware/reputation"
 	"github.com/jahrulnr/go-waf/internal/middleware/waf"
+	service_geoip "github.com/jahrulnr/go-waf/internal/service/geoip"
+	service_ip_reputation "github.com/jahrulnr/go-waf/internal/service/ip_reputation"
 	service_waf "github.com/jahrulnr/go-waf/internal/service/waf"
 	"github.com/jahrulnr/go-waf/pkg/logger"
 	"github.com/nanmu42/gzip"
@@ -23,6 +29,8 @@ type Router struct {
 
 	rateLimiter  *ratelimit.RateLimit
 	cacheHandler service.CacheInterface
+	wafService   service.WAFInterface
+	ipReputation service.IPReputationInterface
 }
 
 func NewHttpRouter(config *config.Config, cacheHandler service.CacheInterface) *Router {
@@ -38,9 +46,69 @@ func NewHttpRouter(config *config.Config, cacheHandler service.CacheInterface) *
 func (h *Router) setRouter() {
 	var middlewareList []gin.HandlerFunc
 
+	// any client can send X-Forwarded-For, the client IP is the peer address
+	// unless it is a trusted proxy
+	var proxies []string
+	for _, proxy := range strings.Split(h.config.TRUSTED_PROXIES, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := h.handler.SetTrustedProxies(proxies); err != nil {
+		logger.Logger("[fatal] Invalid TRUSTED_PROXIES", err.Error()).Fatal()
+	}
+
+	if h.config.USE_IP_REPUTATION {
+		h.ipReputation = service_ip_reputation.NewIPReputation(h.config)
+	}
+
+	// the solutions of the challenge are handled before they could be challenged again
+	var challenger *challenge.Challenge
+	if h.useChallenge() {
+		challenger = challenge.NewChallenge(h.config)
+		middlewareList = append(middlewareList, challenger.Verify())
+	}
+
+	// known bad IPs are turned away before the User-Agent is even parsed
+	if h.ipReputation != nil {
+		for _, list := range h.ipReputation.Lists() {
+			if list.Action == service_ip_reputation.ActionScore && !h.config.USE_WAF {
+				logger.Logger("[warn] The IP list is scored by the WAF, USE_WAF is disabled", list.Name).Warn()
+			}
+		}
+		middlewareList = append(middlewareList, reputation.NewIPReputationMiddleware(h.ipReputation, challenger))
+	}
+
+	// the location is looked up once for the rules, the rate limiter and the WAF
+	if h.config.USE_GEOIP {
+		middlewareList = append(middlewareList, geoip.NewGeoIPMiddleware(service_geoip.NewGeoIP(h.config)))
+	} else if h.config.USE_RATELIMIT && !strings.EqualFold(strings.TrimSpace(h.config.RATELIMIT_KEY), ratelimit.KeyIP) {
+		logger.Logger("[warn] RATELIMIT_KEY uses the location, USE_GEOIP is disabled").Warn()
+	}
+
+	// the device rules are loaded once for the device and the bot handlers
+	var deviceHandler *device.Device
+	if h.config.DETECT_DEVICE || h.config.DETECT_BOT {
+		deviceHandler = device.NewCheckDevice(h.config)
+	}
+
+	// bad bots are turned away before any other work
+	if h.config.DETECT_BOT {
+		var verifier *device.Verifier
+		if h.config.BOT_VERIFY_DOMAINS != "" {
+			verifier = device.NewVerifier(h.config)
+		}
+		middlewareList = append(middlewareList, deviceHandler.DetectBot(verifier, challenger))
+	}
+
 	if h.config.USE_WAF {
-		wafService := service_waf.NewWAFService(h.config, h.config.WAF_CONFIG)
-		middlewareList = append(middlewareList, waf.NewWAFMiddleware(wafService))
+		h.wafService = service_waf.NewWAFService(h.config, h.config.WAF_CONFIG)
+		middlewareList = append(middlewareList, waf.NewWAFMiddleware(h.config, h.wafService, challenger))
+
+		// positive security model, the requests must conform to their OpenAPI spec
+		if h.config.WAF_OPENAPI_SPECS != "" {
+			middlewareList = append(middlewareList, waf.NewOpenAPIMiddleware(h.config, h.wafService))
+		}
 	}
 
 	// this will used for clear cache
@@ -53,6 +121,9 @@ func (h *Router) setRouter() {
 		} else {
 			h.rateLimiter.Driver("memory")
 		}
+		if h.config.RATELIMIT_CHALLENGE {
+			h.rateLimiter.Challenge(challenger)
+		}
 		middlewareList = append(middlewareList, h.rateLimiter.RateLimit())
 	}
 
@@ -80,7 +151,6 @@ func (h *Router) setRouter() {
 	}
 
 	if h.config.DETECT_DEVICE {
-		deviceHandler := device.NewCheckDevice(h.config)
 		middlewareList = append(middlewareList, deviceHandler.SendHeader())
 	}
 
@@ -89,13 +159,19 @@ func (h *Router) setRouter() {
 	}
 
 	// initial handler
-	proxyHandler := http_reverseproxy_handler.NewHttpHandler(h.config, h.handler, h.cacheHandler)
+	proxyHandler := http_reverseproxy_handler.NewHttpHandler(h.config, h.handler, h.cacheHandler, h.wafService)
 	clearCacheHandler := http_clearcache_handler.NewHttpHandler(h.config, h.handler, h.cacheHandler)
+	var wafAdminHandler *http_wafadmin_handler.Handler
+	if h.wafService != nil && h.config.WAF_ADMIN_PATH != "" {
+		wafAdminHandler = http_wafadmin_handler.NewHttpHandler(h.config, h.handler, h.wafService)
+	}
 
 	// set handler
 	h.handler.Any("/*path", func(ctx *gin.Context) {
 		if ctx.Param("path") == "/ping" {
 			ctx.String(200, "PONG")
+		} else if wafAdminHandler != nil && ctx.Param("path") == h.config.WAF_ADMIN_PATH {
+			wafAdminHandler.Rules(ctx)
 		} else if h.config.USE_CACHE &&
 			strings.EqualFold(ctx.Request.Method, h.config.CACHE_REMOVE_METHOD) {
 			logger.Logger("[info] clear cache: ", ctx.Param("path")).Info()
@@ -116,6 +192,31 @@ func (h *Router) setRouter() {
 	})
 }
 
+// useChallenge reports whether a feature serves the proof-of-work challenge.
+func (h *Router) useChallenge() bool {
+	if h.config.USE_WAF && h.config.WAF_CHALLENGE_SCORE > 0 {
+		return true
+	}
+	if h.config.USE_RATELIMIT && h.config.RATELIMIT_CHALLENGE {
+		return true
+	}
+	if h.ipReputation != nil {
+		for _, list := range h.ipReputation.Lists() {
+			if list.Action == service_ip_reputation.ActionChallenge {
+				return true
+			}
+		}
+	}
+	if h.config.DETECT_BOT {
+		for _, action := range []string{h.config.BOT_HUMAN_ACTION, h.config.BOT_GOOD_ACTION, h.config.BOT_BAD_ACTION, h.config.BOT_AUTOMATION_ACTION} {
+			if strings.EqualFold(action, device.ActionChallenge) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (h *Router) GetHandler() *gin.Engine {
 	h.setRouter()
 
@@ -0,0 +1,759 @@
+package delivery_http
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
+	service_cache "github.com/jahrulnr/go-waf/internal/service/cache"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	// the configuration files and the views are relative to the repository root
+	if err := os.Chdir("../../.."); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	gin.SetMode(gin.TestMode)
+	logger.SetLevel(logger.FATAL)
+
+	os.Exit(m.Run())
+}
+
+// newTestRouter returns the handler of a router configured with the defaults
+// and env, proxying to a backend answering "backend".
+func newTestRouter(t *testing.T, env map[string]string) http.Handler {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	t.Cleanup(backend.Close)
+
+	t.Setenv("HOST_DESTINATION", backend.URL)
+	t.Setenv("DETECT_DEVICE", "false")
+	t.Setenv("WAF_RELOAD_INTERVAL", "0")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	conf := &config.Config{}
+	if err := cleanenv.ReadEnv(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewHttpRouter(conf, service_cache.NewCacheService(conf)).GetHandler()
+}
+
+// recorder adds the CloseNotify the reverse proxy expects of gin writers.
+type recorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r recorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// serve sends a request from the remote address, the headers are name: value lines.
+func serve(handler http.Handler, method, target, remoteAddr, body string, headers ...string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.RemoteAddr = remoteAddr
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		request.Header.Add(name, strings.TrimSpace(value))
+	}
+
+	response := recorder{httptest.NewRecorder()}
+	handler.ServeHTTP(response, request)
+	return response.ResponseRecorder
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		remote  string
+		headers []string
+		status  int
+	}{
+		{"allowed peer", "", "127.0.0.1:4000", nil, http.StatusOK},
+		{"denied peer", "", "10.0.0.1:4000", nil, http.StatusForbidden},
+		{"forwarded for by an untrusted peer", "", "10.0.0.1:4000", []string{"X-Forwarded-For: 127.0.0.1"}, http.StatusForbidden},
+		{"real ip by an untrusted peer", "", "10.0.0.1:4000", []string{"X-Real-IP: 127.0.0.1"}, http.StatusForbidden},
+		{"forwarded for by a trusted proxy", "10.0.0.0/8", "10.0.0.1:4000", []string{"X-Forwarded-For: 127.0.0.1"}, http.StatusOK},
+		{"spoofed by a client of a trusted proxy", "10.0.0.0/8", "10.0.0.1:4000", []string{"X-Forwarded-For: 127.0.0.1, 192.0.2.1"}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the admin endpoint is restricted to WAF_ADMIN_ALLOW_IP, 127.0.0.1 by default
+			router := newTestRouter(t, map[string]string{"TRUSTED_PROXIES": test.proxies})
+
+			response := serve(router, http.MethodGet, "/_waf/rules", test.remote, "", test.headers...)
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestExclusionsMatchCleanPath(t *testing.T) {
+	// config/exclusions.yml skips the XSS rules of the content argument on POST /admin/posts
+	router := newTestRouter(t, map[string]string{
+		"WAF_EXCLUSIONS":      "config/exclusions.yml",
+		"WAF_PROTECT_BODY":    "true",
+		"WAF_RELOAD_INTERVAL": "0",
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"excluded path", "/admin/posts", http.StatusOK},
+		{"excluded sub path", "/admin/posts/12", http.StatusOK},
+		{"dot segments leaving the excluded path", "/admin/posts/../../api/comments", http.StatusForbidden},
+		{"encoded dot segments", "/admin/posts/%2e%2e/%2e%2e/api/comments", http.StatusForbidden},
+		{"other path", "/api/comments", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodPost, test.target, "127.0.0.1:4000",
+				"content=<script>alert(1)</script>", "Content-Type: application/x-www-form-urlencoded")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestVirtualPatchesMatchCleanPath(t *testing.T) {
+	// config/virtual-patches.yml only allows the csv, pdf and xlsx formats on /reports/export
+	router := newTestRouter(t, map[string]string{"WAF_VIRTUAL_PATCHES": "config/virtual-patches.yml"})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"allowed value", "/reports/export?format=csv", http.StatusOK},
+		{"patched value", "/reports/export?format=html", http.StatusForbidden},
+		{"exploit", "/reports/export?format=;id", http.StatusForbidden},
+		{"encoded path", "/reports/%65xport?format=;id", http.StatusForbidden},
+		{"encoded path and value", "/reports/%65xport?format=html", http.StatusForbidden},
+		{"repeated slashes", "//reports///export?format=html", http.StatusForbidden},
+		{"dot segments", "/static/../reports/./export?format=html", http.StatusForbidden},
+		{"other path", "/reports/list?format=html", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, test.target, "127.0.0.1:4000", "")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestOpenAPIMatchesCleanPath(t *testing.T) {
+	// config/openapi.yml declares GET /api/users?page&sort and /api/users/{id}
+	router := newTestRouter(t, map[string]string{"WAF_OPENAPI_SPECS": "/api=config/openapi.yml"})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"declared path", "/api/users?page=2&sort=name", http.StatusOK},
+		{"path parameter", "/api/users/12", http.StatusOK},
+		{"undeclared path", "/api/admin", http.StatusForbidden},
+		{"encoded prefix", "/%61pi/admin", http.StatusForbidden},
+		{"repeated slashes", "//api//admin", http.StatusForbidden},
+		{"dot segments", "/static/../api/admin", http.StatusForbidden},
+		{"invalid encoded parameter", "/%61pi/users/abc", http.StatusForbidden},
+		{"undeclared query parameter", "/api/users?debug=1", http.StatusForbidden},
+		{"query parameter url.ParseQuery rejects", "/api/users?sort=;id", http.StatusForbidden},
+		{"repeated query parameter", "/api/users?page=1&page=0", http.StatusForbidden},
+		{"other path", "/static/app.js", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, test.target, "127.0.0.1:4000", "")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestIPReputationIgnoresSpoofedHeaders(t *testing.T) {
+	// config/ip-blocklist.txt blocks the documentation ranges, 192.0.2.0/24 among them
+	router := newTestRouter(t, map[string]string{
+		"USE_IP_REPUTATION":             "true",
+		"IP_REPUTATION_RELOAD_INTERVAL": "0",
+	})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers []string
+		status  int
+	}{
+		{"clean peer", "127.0.0.1:4000", nil, http.StatusOK},
+		{"listed peer", "192.0.2.1:4000", nil, http.StatusForbidden},
+		{"listed peer forwarding for a clean IP", "192.0.2.1:4000", []string{"X-Forwarded-For: 127.0.0.1"}, http.StatusForbidden},
+		{"listed peer with a clean real IP", "192.0.2.1:4000", []string{"X-Real-IP: 127.0.0.1"}, http.StatusForbidden},
+		{"clean peer forwarding for a listed IP", "127.0.0.1:4000", []string{"X-Forwarded-For: 192.0.2.1"}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, "/", test.remote, "", test.headers...)
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestGeoIPIgnoresSpoofedHeaders(t *testing.T) {
+	// config/geoip.yml allows /admin from AS64512 and /login from ID, SG and MY,
+	// the test databases locate 127.0.0.0/8 in ID and AS64512 and 192.0.2.0/24
+	// in US and AS14061
+	router := newTestRouter(t, map[string]string{
+		"USE_GEOIP":             "true",
+		"GEOIP_COUNTRY_DB":      "pkg/mmdb/testdata/GeoLite2-Country-Test.mmdb",
+		"GEOIP_ASN_DB":          "pkg/mmdb/testdata/GeoLite2-ASN-Test.mmdb",
+		"GEOIP_RULES":           "config/geoip.yml",
+		"GEOIP_RELOAD_INTERVAL": "0",
+	})
+
+	tests := []struct {
+		name    string
+		target  string
+		remote  string
+		headers []string
+		status  int
+	}{
+		{"allowed ASN", "/admin", "127.0.0.1:4000", nil, http.StatusOK},
+		{"denied ASN", "/admin", "192.0.2.1:4000", nil, http.StatusForbidden},
+		{"forwarded for an allowed ASN", "/admin", "192.0.2.1:4000", []string{"X-Forwarded-For: 127.0.0.1"}, http.StatusForbidden},
+		{"real IP of an allowed ASN", "/admin", "192.0.2.1:4000", []string{"X-Real-IP: 127.0.0.1"}, http.StatusForbidden},
+		{"encoded path", "/%61dmin", "192.0.2.1:4000", nil, http.StatusForbidden},
+		{"dot segments", "/static/../admin", "192.0.2.1:4000", nil, http.StatusForbidden},
+		{"allowed country", "/login", "127.0.0.1:4000", nil, http.StatusOK},
+		{"denied country", "/login", "192.0.2.1:4000", nil, http.StatusForbidden},
+		{"other path", "/", "192.0.2.1:4000", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, test.target, test.remote, "", test.headers...)
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestRateLimitKeyIgnoresSpoofedHeaders(t *testing.T) {
+	router := newTestRouter(t, map[string]string{
+		"USE_RATELIMIT":         "true",
+		"RATELIMIT_SECOND":      "60",
+		"RATELIMIT_MAX":         "2",
+		"RATELIMIT_KEY":         "country",
+		"USE_GEOIP":             "true",
+		"GEOIP_COUNTRY_DB":      "pkg/mmdb/testdata/GeoLite2-Country-Test.mmdb",
+		"GEOIP_ASN_DB":          "",
+		"GEOIP_RELOAD_INTERVAL": "0",
+	})
+
+	// a client forwarding for addresses of other countries stays in its bucket
+	forwarded := []string{"127.0.0.1", "198.51.100.1", "203.0.113.1"}
+	for i, ip := range forwarded {
+		response := serve(router, http.MethodGet, "/", "192.0.2.1:4000", "", "X-Forwarded-For: "+ip)
+		want := http.StatusOK
+		if i == len(forwarded)-1 {
+			want = http.StatusTooManyRequests
+		}
+		if response.Code != want {
+			t.Errorf("request %d forwarded for %s: status = %d, want %d", i+1, ip, response.Code, want)
+		}
+	}
+}
+
+// solveChallenge solves the challenge page of a response for the client and
+// returns the clearance cookie.
+func solveChallenge(t *testing.T, handler http.Handler, page *httptest.ResponseRecorder, remoteAddr string, headers ...string) string {
+	t.Helper()
+
+	found := regexp.MustCompile(`name="challenge" value="([^"]+)"`).FindStringSubmatch(page.Body.String())
+	if found == nil {
+		t.Fatalf("no challenge in the page, status %d", page.Code)
+	}
+	solution := 0
+	for hash := sha256.Sum256([]byte(found[1] + ":0")); hash[0]&0x80 != 0; {
+		solution++
+		hash = sha256.Sum256([]byte(found[1] + ":" + strconv.Itoa(solution)))
+	}
+
+	form := url.Values{"challenge": {found[1]}, "solution": {strconv.Itoa(solution)}, "redirect": {"/"}}
+	headers = append(headers, "Content-Type: application/x-www-form-urlencoded")
+	response := serve(handler, http.MethodPost, "/_waf/challenge", remoteAddr, form.Encode(), headers...)
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == challenge.CookieName {
+			return cookie.Name + "=" + cookie.Value
+		}
+	}
+	t.Fatalf("no clearance cookie, status %d", response.Code)
+	return ""
+}
+
+func TestChallengeClearanceBoundToClientIP(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "challenged.txt")
+	if err := os.WriteFile(list, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(t, map[string]string{
+		"TRUSTED_PROXIES":               "10.0.0.0/8",
+		"USE_IP_REPUTATION":             "true",
+		"IP_REPUTATION_LISTS":           list + ":action=challenge",
+		"IP_REPUTATION_RELOAD_INTERVAL": "0",
+		"CHALLENGE_SECRET":              "test",
+		"CHALLENGE_DIFFICULTY":          "1",
+	})
+
+	page := serve(router, http.MethodGet, "/", "192.0.2.1:4000", "")
+	if page.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want the challenge", page.Code)
+	}
+	cookie := solveChallenge(t, router, page, "192.0.2.1:4000")
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers []string
+		status  int
+	}{
+		{"solving client", "192.0.2.1:4000", nil, http.StatusOK},
+		{"other client", "192.0.2.2:4000", nil, http.StatusForbidden},
+		{"other client forwarding for the solving client", "192.0.2.2:4000", []string{"X-Forwarded-For: 192.0.2.1"}, http.StatusForbidden},
+		{"other client with the real IP of the solving client", "192.0.2.2:4000", []string{"X-Real-IP: 192.0.2.1"}, http.StatusForbidden},
+		{"trusted proxy forwarding for the solving client", "10.0.0.1:4000", []string{"X-Forwarded-For: 192.0.2.1"}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, "/", test.remote, "", append(test.headers, "Cookie: "+cookie)...)
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestSecRuleEngine(t *testing.T) {
+	tests := []struct {
+		name        string
+		protectBody string
+		method      string
+		target      string
+		body        string
+		status      int
+	}{
+		{"clean request", "false", http.MethodGet, "/search?q=shoes", "", http.StatusOK},
+		{"query argument without the body phase", "false", http.MethodGet, "/search?q=<script>alert(1)</script>", "", http.StatusForbidden},
+		{"body argument without the body phase", "false", http.MethodPost, "/comments", "comment=<script>alert(1)</script>", http.StatusOK},
+		{"query argument with the body phase", "true", http.MethodGet, "/search?q=<script>alert(1)</script>", "", http.StatusForbidden},
+		{"body argument with the body phase", "true", http.MethodPost, "/comments", "comment=<script>alert(1)</script>", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// config/rules/go-waf.conf runs libinjection on the arguments in phase 2
+			router := newTestRouter(t, map[string]string{"WAF_ENGINE": "secrule", "WAF_PROTECT_BODY": test.protectBody})
+
+			response := serve(router, test.method, test.target, "127.0.0.1:4000", test.body, "Content-Type: application/x-www-form-urlencoded")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestNestedBodyPastDepthLimit(t *testing.T) {
+	router := newTestRouter(t, map[string]string{"WAF_PROTECT_BODY": "true"})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"shallow JSON", "application/json", `{"a":{"b":"<script>alert(1)</script>"}}`, http.StatusForbidden},
+		{"JSON nested past the limit", "application/json",
+			strings.Repeat(`{"a":`, 100) + `"<script>alert(1)</script>"` + strings.Repeat(`}`, 100), http.StatusForbidden},
+		{"clean JSON nested past the limit", "application/json",
+			strings.Repeat(`[`, 100) + `"shoes"` + strings.Repeat(`]`, 100), http.StatusOK},
+		{"XML nested past the limit", "application/xml",
+			strings.Repeat(`<a>`, 100) + `&lt;script&gt;alert(1)&lt;/script&gt;` + strings.Repeat(`</a>`, 100), http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodPost, "/api/comments", "127.0.0.1:4000", test.body, "Content-Type: "+test.contentType)
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestGraphQLEndpoint(t *testing.T) {
+	router := newTestRouter(t, map[string]string{"WAF_GRAPHQL_PATHS": "/graphql", "WAF_PROTECT_BODY": "true"})
+
+	deep := url.QueryEscape(strings.Repeat("{a", 20) + strings.Repeat("}", 20))
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"valid query", http.MethodGet, "/graphql?query=" + url.QueryEscape("{user{name}}"), "", http.StatusOK},
+		{"query deeper than the limit", http.MethodGet, "/graphql?query=" + deep, "", http.StatusForbidden},
+		{"encoded path", http.MethodGet, "/%67raphql?query=" + deep, "", http.StatusForbidden},
+		{"dot segments", http.MethodGet, "/api/../graphql?query=" + deep, "", http.StatusForbidden},
+		{"trailing slash", http.MethodGet, "/graphql/?query=" + deep, "", http.StatusForbidden},
+		{"deep query hidden behind a repeated parameter", http.MethodGet, "/graphql?query=" + url.QueryEscape("{a}") + "&query=" + deep, "", http.StatusForbidden},
+		{"repeated parameter", http.MethodGet, "/graphql?query=" + url.QueryEscape("{a}") + "&query=" + url.QueryEscape("{b}"), "", http.StatusForbidden},
+		{"invalid query", http.MethodGet, "/graphql?query=" + url.QueryEscape("{a("), "", http.StatusForbidden},
+		{"query nested past the parser limit", http.MethodPost, "/graphql",
+			`{"query":"` + strings.Repeat("{a", 600) + strings.Repeat("}", 600) + `"}`, http.StatusForbidden},
+		{"invalid JSON body", http.MethodPost, "/graphql", `{"query":`, http.StatusForbidden},
+		{"other path", http.MethodGet, "/api?query=" + deep, "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, test.method, test.target, "127.0.0.1:4000", test.body, "Content-Type: application/json")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+// TestRequestSmuggling sends raw requests with ambiguous framing to the
+// server, they are rejected or re-framed before reaching the WAF and the backend.
+func TestRequestSmuggling(t *testing.T) {
+	var received atomic.Int32
+	var framing atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		framing.Store(fmt.Sprintf("%s %q %q %q", r.URL.Path, r.Header.Get("Content-Length"), r.TransferEncoding, body))
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	server := httptest.NewServer(newTestRouter(t, map[string]string{"HOST_DESTINATION": backend.URL}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		request  string
+		status   int
+		received int32
+		framing  string
+	}{
+		{"conflicting Content-Length", "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 5\r\n\r\nhello", http.StatusBadRequest, 0, ""},
+		{"duplicate Host", "GET /a HTTP/1.1\r\nHost: x\r\nHost: y\r\n\r\n", http.StatusBadRequest, 0, ""},
+		{"invalid header name", "GET /a HTTP/1.1\r\nHost: x\r\nContent-Length : 5\r\n\r\n", http.StatusBadRequest, 0, ""},
+		{"obfuscated Transfer-Encoding", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", http.StatusNotImplemented, 0, ""},
+		{"stacked Transfer-Encoding", "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", http.StatusNotImplemented, 0, ""},
+		// CL.TE: the chunked framing wins, the smuggled G starts an invalid second request
+		{"Content-Length and Transfer-Encoding", "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG",
+			http.StatusOK, 1, `/a "" ["chunked"] ""`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received.Store(0)
+			framing.Store("")
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, test.request); err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.status)
+			}
+			if received.Load() != test.received || framing.Load() != test.framing {
+				t.Errorf("backend received %d requests framed as %v, want %d framed as %s", received.Load(), framing.Load(), test.received, test.framing)
+			}
+		})
+	}
+}
+
+func TestCachePurgeMethod(t *testing.T) {
+	// the default WAF_ALLOWED_METHODS does not list BAN, the default CACHE_REMOVE_METHOD
+	router := newTestRouter(t, map[string]string{"USE_CACHE": "true", "CACHE_DRIVER": "memory"})
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+		body   string
+	}{
+		{"purge", "BAN", http.StatusOK, `{"status":"OK"}`},
+		{"lowercase purge", "ban", http.StatusOK, `{"status":"OK"}`},
+		{"other method", "PROPFIND", http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, test.method, "/x", "127.0.0.1:4000", "")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+			if test.body != "" && response.Body.String() != test.body {
+				t.Errorf("body = %q, want %q", response.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestResponseExclusionsMatchCleanPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "You have an error in your SQL syntax near '1'")
+	}))
+	defer backend.Close()
+
+	exclusions := filepath.Join(t.TempDir(), "exclusions.yml")
+	if err := os.WriteFile(exclusions, []byte("exclusions:\n  - path_prefix: /debug\n    rules: [sql_error]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(t, map[string]string{
+		"HOST_DESTINATION":     backend.URL,
+		"WAF_PROTECT_RESPONSE": "true",
+		"WAF_EXCLUSIONS":       exclusions,
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"excluded path", "/debug/x", http.StatusOK},
+		{"encoded excluded path", "/%64ebug/x", http.StatusOK},
+		{"dot segments leaving the excluded path", "/debug/../api/x", http.StatusInternalServerError},
+		{"other path", "/api/x", http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodGet, test.target, "127.0.0.1:4000", "")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestAmbiguousJSONBody(t *testing.T) {
+	router := newTestRouter(t, map[string]string{"WAF_PROTECT_BODY": "true"})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"clean", `{"q":"shoes"}`, http.StatusOK},
+		{"first duplicate key", `{"q":"<script>alert(1)</script>","q":"shoes"}`, http.StatusForbidden},
+		{"trailing data", `{"q":"shoes"} <script>alert(1)</script>`, http.StatusForbidden},
+		{"trailing document", `{"q":"shoes"}{"q":"<script>alert(1)</script>"}`, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(router, http.MethodPost, "/api/search", "127.0.0.1:4000", test.body, "Content-Type: application/json")
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestRateLimitChallengeCountsClearedClients(t *testing.T) {
+	router := newTestRouter(t, map[string]string{
+		"USE_RATELIMIT":        "true",
+		"RATELIMIT_SECOND":     "60",
+		"RATELIMIT_MAX":        "2",
+		"RATELIMIT_CHALLENGE":  "true",
+		"CHALLENGE_SECRET":     "test",
+		"CHALLENGE_DIFFICULTY": "1",
+	})
+
+	remote := "192.0.2.1:4000"
+	var page *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		page = serve(router, http.MethodGet, "/", remote, "")
+	}
+	if page.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want the challenge", page.Code)
+	}
+
+	// a solved challenge starts a new count, spending it brings the challenge back
+	cookie := solveChallenge(t, router, page, remote)
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusForbidden} {
+		response := serve(router, http.MethodGet, "/", remote, "", "Cookie: "+cookie)
+		if response.Code != want {
+			t.Errorf("cleared request %d: status = %d, want %d", i+1, response.Code, want)
+		}
+	}
+
+	cookie = solveChallenge(t, router, serve(router, http.MethodGet, "/", remote, "", "Cookie: "+cookie), remote)
+	if response := serve(router, http.MethodGet, "/", remote, "", "Cookie: "+cookie); response.Code != http.StatusOK {
+		t.Errorf("request after the second challenge: status = %d, want %d", response.Code, http.StatusOK)
+	}
+}
+
+func TestDetectBot(t *testing.T) {
+	// the backend answers the categories it received
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header.Values("X-Bot-Category"), ","))
+	}))
+	t.Cleanup(backend.Close)
+
+	const (
+		chrome    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+		googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+		sqlmap    = "sqlmap/1.7.2#stable (https://sqlmap.org)"
+		curl      = "curl/8.4.0"
+	)
+
+	t.Run("classification", func(t *testing.T) {
+		router := newTestRouter(t, map[string]string{
+			"HOST_DESTINATION":      backend.URL,
+			"USE_WAF":               "false",
+			"DETECT_BOT":            "true",
+			"BOT_BAD_ACTION":        "allow",
+			"BOT_VERIFY_DOMAINS":    "",
+			"BOT_AUTOMATION_ACTION": "allow",
+		})
+
+		tests := []struct {
+			name      string
+			userAgent string
+			category  string
+		}{
+			{"browser", chrome, "human"},
+			{"mobile browser", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", "human"},
+			{"search engine", googlebot, "good"},
+			{"monitoring", "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", "good"},
+			{"scanner", sqlmap, "bad"},
+			{"scanner in another case", "Mozilla/5.0 Nikto/2.5.0", "bad"},
+			{"HTTP library", curl, "automation"},
+			{"script", "python-requests/2.31.0", "automation"},
+			{"headless browser", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", "automation"},
+			{"generic bot", "MyCustomBot/1.0 (+https://example.com/bot)", "automation"},
+			{"no letter", "1234", "automation"},
+			{"empty User-Agent", "", "automation"},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				// the category sent by the client is replaced
+				response := serve(router, http.MethodGet, "/", "192.0.2.1:4000", "",
+					"User-Agent: "+test.userAgent, "X-Bot-Category: human", "X-Bot-Category: good")
+				if response.Code != http.StatusOK || response.Body.String() != test.category {
+					t.Errorf("response = %d %q, want %d %q", response.Code, response.Body.String(), http.StatusOK, test.category)
+				}
+			})
+		}
+	})
+
+	t.Run("actions", func(t *testing.T) {
+		router := newTestRouter(t, map[string]string{
+			"HOST_DESTINATION":      backend.URL,
+			"USE_WAF":               "false",
+			"DETECT_BOT":            "true",
+			"BOT_VERIFY_DOMAINS":    "",
+			"BOT_HUMAN_ACTION":      "allow",
+			"BOT_GOOD_ACTION":       "challenge",
+			"BOT_BAD_ACTION":        "block",
+			"BOT_AUTOMATION_ACTION": "ratelimit",
+			"BOT_RATELIMIT_SECOND":  "60",
+			"BOT_RATELIMIT_MAX":     "2",
+			"CHALLENGE_SECRET":      "test",
+			"CHALLENGE_DIFFICULTY":  "1",
+		})
+
+		tests := []struct {
+			name      string
+			userAgent string
+			remote    string
+			status    int
+			body      string
+		}{
+			{"human allowed", chrome, "192.0.2.1:4000", http.StatusOK, "human"},
+			{"human not limited", chrome, "192.0.2.1:4000", http.StatusOK, "human"},
+			{"human still not limited", chrome, "192.0.2.1:4000", http.StatusOK, "human"},
+			{"bad bot blocked", sqlmap, "192.0.2.2:4000", http.StatusForbidden, "403 | Forbidden."},
+			{"automation under the limit", curl, "192.0.2.3:4000", http.StatusOK, "automation"},
+			{"automation at the limit", curl, "192.0.2.3:4000", http.StatusOK, "automation"},
+			{"automation over the limit", curl, "192.0.2.3:4000", http.StatusTooManyRequests, ""},
+			{"automation of another client", curl, "192.0.2.4:4000", http.StatusOK, "automation"},
+		}
+
+		for _, test := range tests {
+			response := serve(router, http.MethodGet, "/", test.remote, "", "User-Agent: "+test.userAgent)
+			if response.Code != test.status || (test.body != "" && response.Body.String() != test.body) {
+				t.Errorf("%s: response = %d %q, want %d %q", test.name, response.Code, response.Body.String(), test.status, test.body)
+			}
+		}
+
+		// the good bots solving the challenge go through
+		page := serve(router, http.MethodGet, "/", "192.0.2.5:4000", "", "User-Agent: "+googlebot)
+		if page.Code != http.StatusForbidden || !strings.Contains(page.Body.String(), `name="challenge"`) {
+			t.Fatalf("good bot: status = %d, want the challenge", page.Code)
+		}
+		cookie := solveChallenge(t, router, page, "192.0.2.5:4000", "User-Agent: "+googlebot)
+		response := serve(router, http.MethodGet, "/", "192.0.2.5:4000", "", "User-Agent: "+googlebot, "Cookie: "+cookie)
+		if response.Code != http.StatusOK || response.Body.String() != "good" {
+			t.Errorf("cleared good bot: response = %d %q, want %d %q", response.Code, response.Body.String(), http.StatusOK, "good")
+		}
+	})
+}
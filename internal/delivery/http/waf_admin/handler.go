@@ -0,0 +1,58 @@
+package http_wafadmin_handler
+
+import (
+	"net/http"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	service_allow_ip "github.com/jahrulnr/go-waf/internal/service/allow_ip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	config *config.Config
+
+	wafService service.WAFInterface
+	ipService  service.AllowIPInterface
+}
+
+func NewHttpHandler(config *config.Config, handler *gin.Engine, wafService service.WAFInterface) *Handler {
+	return &Handler{
+		config:     config,
+		wafService: wafService,
+		ipService:  service_allow_ip.NewAllowIPList("WAF_ADMIN_ALLOW_IP", config.WAF_ADMIN_ALLOW_IP),
+	}
+}
+
+// Rules reports the active rule set on GET and reloads the rule files on POST.
+func (h *Handler) Rules(c *gin.Context) {
+	if !h.ipService.Check(c.ClientIP()) {
+		logger.Logger("[warn] IP ", c.ClientIP(), " trying to access the WAF admin endpoint").Warn()
+		c.JSON(http.StatusForbidden, map[string]interface{}{
+			"status": "Forbidden",
+		})
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		c.JSON(http.StatusOK, h.wafService.RuleSet())
+	case http.MethodPost:
+		if err := h.wafService.ReloadRules(); err != nil {
+			logger.Logger("[error] WAF rules rejected, previous rules stay active", err.Error()).Error()
+			c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"status":   "Rejected",
+				"error":    err.Error(),
+				"rule_set": h.wafService.RuleSet(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, h.wafService.RuleSet())
+	default:
+		c.JSON(http.StatusMethodNotAllowed, map[string]interface{}{
+			"status": "Method Not Allowed",
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+type GeoIPInterface interface {
+	Lookup(ip string) GeoInfo
+	// Allowed applies the rule of the longest path prefix, it returns the
+	// reason of a denial
+	Allowed(path string, info GeoInfo) (bool, string)
+	Reload()
+}
+
+// GeoInfo is the location of an IP, empty when the databases do not hold it.
+type GeoInfo struct {
+	Country      string // ISO 3166-1 alpha-2 code
+	ASN          uint
+	Organization string // of the autonomous system
+}
+
+type GeoRules struct {
+	Rules []GeoRule `yaml:"rules"`
+}
+
+// GeoRule restricts the countries and the autonomous systems of a path
+// prefix. The deny lists are checked first, then a client must be in one of
+// the allow lists unless they are both empty.
+type GeoRule struct {
+	Description    string   `yaml:"description"`
+	PathPrefix     string   `yaml:"path_prefix"`
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+	AllowASNs      []uint   `yaml:"allow_asns"`
+	DenyASNs       []uint   `yaml:"deny_asns"`
+}
@@ -0,0 +1,17 @@
+package service
+
+type IPReputationInterface interface {
+	// Lookup returns the lists holding the IP
+	Lookup(ip string) []IPList
+	Lists() []IPList
+	Reload()
+}
+
+// IPList is a blocklist file of IP addresses and CIDR prefixes.
+type IPList struct {
+	Name     string
+	File     string
+	Action   string // block, challenge or score
+	Score    int    // anomaly score of the score action
+	Prefixes int
+}
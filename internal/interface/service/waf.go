@@ -1,25 +1,267 @@
 package service
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+)
+
 type Request struct {
-	IP      string
-	Path    string
-	Headers map[string]string
-	Body    []byte
+	IP     string
+	Method string
+	Host   string
+	Path   string // raw request URI
+	// decoded and cleaned path the backend receives, without the query string
+	CleanPath string
+	Headers   map[string][]string // every value of repeated headers
+	Cookies   map[string][]string // parsed from every Cookie header
+	Body      []byte
+
+	// arguments parsed from the query string and the body
+	Args          []Argument
+	BodyProcessor string
+	// files uploaded in a multipart body
+	Files []File
+	// operations of a GraphQL endpoint request, a batch holds several documents
+	GraphQL []*graphql.Document
+	// GraphQL queries failing to parse and malformed GraphQL requests
+	GraphQLErrors []string
+
+	// checked by the protocol enforcement rules
+	Protocol    string // e.g. HTTP/1.1
+	HeaderCount int    // repeated headers included
+	BodySize    int64  // the body is not read when it exceeds the size limit
+
+	// score lists of the IP reputation holding the client IP
+	IPLists []IPList
+	// location of the client IP, empty unless GeoIP is enabled
+	Geo GeoInfo
+}
+
+// Argument sources, named after the SecRule collections.
+const (
+	ArgsGet  = "ARGS_GET"
+	ArgsPost = "ARGS_POST"
+	Files    = "FILES"
+)
+
+// Body processors, set when the body was parsed into arguments.
+const (
+	BodyURLEncoded = "URLENCODED"
+	BodyJSON       = "JSON"
+	BodyMultipart  = "MULTIPART"
+	BodyXML        = "XML"
+	BodyGraphQL    = "GRAPHQL"
+)
+
+// Argument is a named value of the query string or the body, nested JSON keys
+// and XML elements are joined with dots and multipart file parts hold the file name.
+type Argument struct {
+	Source string
+	Name   string
+	Value  string
+}
+
+// File is a file part of a multipart body.
+type File struct {
+	Field       string
+	FileName    string
+	ContentType string // as declared by the client
+	Content     []byte
 }
 
 type Response struct {
 	StatusCode int
 	Headers    map[string]string
 	Body       []byte
+
+	// anomaly scoring result
+	TransactionID string
+	Blocked       bool
+	Challenge     bool // a proof-of-work challenge is required
+	Score         int
+	Scores        Scores
+	Matches       []Match
+}
+
+// UpstreamResponse is a backend response inspected by the response phase.
+type UpstreamResponse struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       []byte
+}
+
+// Match describes a rule or detector that matched a request value.
+type Match struct {
+	Rule     string // detector name or rule id
+	Message  string
+	Variable string // where the value was found, e.g. REQUEST_HEADERS:User-Agent
+	Value    string
+	Score    int
+	NoLog    bool
+	Tags     []string // rule categories, e.g. attack-xss
+}
+
+// Scores holds the anomaly score contributed by each detector.
+type Scores map[string]int
+
+// Add sets the score of a detector, a detector only contributes once.
+func (s Scores) Add(detector string, score int) {
+	if score > s[detector] {
+		s[detector] = score
+	}
+}
+
+// Merge adds all detector scores from other into s.
+func (s Scores) Merge(other Scores) {
+	for detector, score := range other {
+		s.Add(detector, score)
+	}
+}
+
+// Total returns the sum of all detector scores.
+func (s Scores) Total() int {
+	total := 0
+	for _, score := range s {
+		total += score
+	}
+	return total
+}
+
+// String formats the breakdown as "detector=score" pairs sorted by detector.
+func (s Scores) String() string {
+	detectors := s.sorted()
+	pairs := make([]string, 0, len(detectors))
+	for _, detector := range detectors {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", detector, s[detector]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Rules returns the detectors of the breakdown sorted and comma separated.
+func (s Scores) Rules() string {
+	return strings.Join(s.sorted(), ",")
+}
+
+func (s Scores) sorted() []string {
+	detectors := make([]string, 0, len(s))
+	for detector := range s {
+		detectors = append(detectors, detector)
+	}
+	sort.Strings(detectors)
+	return detectors
 }
 
 type Keywords struct {
 	CommandInjectionKeywords []string `yaml:"command_injection"`
 	PathTraversalKeywords    []string `yaml:"path_traversal"`
+
+	// rules with their own id, targets and match type
+	Rules []KeywordRule `yaml:"rules"`
+
+	// transformations applied before matching, keyed by detector name
+	Transforms map[string][]string `yaml:"transforms"`
+}
+
+// KeywordRule is a rule of the keywords engine.
+type KeywordRule struct {
+	ID          string   `yaml:"id"`
+	Description string   `yaml:"description"`
+	Severity    string   `yaml:"severity"` // critical, error, warning or notice
+	Targets     []string `yaml:"targets"`  // path, query, headers, cookies, body, optionally with a name like header:User-Agent
+	Match       string   `yaml:"match"`    // contains, prefix, exact or regex
+	Patterns    []string `yaml:"patterns"`
+	Action      string   `yaml:"action"` // block, score or log
+	Transforms  []string `yaml:"transforms"`
+	Tags        []string `yaml:"tags"`
+}
+
+// ResponseRules configures the response phase.
+type ResponseRules struct {
+	// action of the built-in detectors: mask, block or log
+	Detectors map[string]string `yaml:"detectors"`
+	Secrets   []ResponseSecret  `yaml:"secrets"`
+}
+
+// ResponseSecret is a regular expression matching a secret that must not leave the backend.
+type ResponseSecret struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	Action  string `yaml:"action"`
+}
+
+type Exclusions struct {
+	Exclusions []Exclusion `yaml:"exclusions"`
+}
+
+// Exclusion disables rules for the requests matching every condition set,
+// empty conditions match any request.
+type Exclusion struct {
+	Description string   `yaml:"description,omitempty"`
+	PathPrefix  string   `yaml:"path_prefix,omitempty"`
+	PathRegex   string   `yaml:"path_regex,omitempty"`
+	Methods     []string `yaml:"methods,omitempty"`
+	Hosts       []string `yaml:"hosts,omitempty"`
+
+	// rules excluded by id or detector name and by tag, every rule when both are empty
+	Rules []string `yaml:"rules,omitempty"`
+	Tags  []string `yaml:"tags,omitempty"`
+
+	// limits the exclusion to these values, every value when all are empty
+	Args    []string `yaml:"args,omitempty"`
+	Headers []string `yaml:"headers,omitempty"`
+	Cookies []string `yaml:"cookies,omitempty"`
+}
+
+type VirtualPatches struct {
+	Patches []VirtualPatch `yaml:"patches"`
+}
+
+// VirtualPatch blocks the requests to an endpoint whose parameter violates
+// a condition, every condition set has to hold.
+type VirtualPatch struct {
+	ID          string   `yaml:"id"`
+	Description string   `yaml:"description"`
+	PathPrefix  string   `yaml:"path_prefix"`
+	PathRegex   string   `yaml:"path_regex"`
+	Methods     []string `yaml:"methods"`
+	Hosts       []string `yaml:"hosts"`
+
+	// argument name, nested JSON keys are named like json.user.id
+	Param string `yaml:"param"`
+
+	// the value is blocked when it matches the regex, is longer than
+	// max_length, is not of the type or is not one of the values
+	Regex     string   `yaml:"regex"`
+	MaxLength int      `yaml:"max_length"`
+	Type      string   `yaml:"type"`
+	Values    []string `yaml:"values"`
+}
+
+// RuleSetInfo describes the compiled rule set currently in use.
+type RuleSetInfo struct {
+	Engine        string    `json:"engine"`
+	Version       int       `json:"version"` // incremented on every successful load
+	Hash          string    `json:"hash"`    // sha256 of the rule files
+	Files         []string  `json:"files"`
+	Rules         int       `json:"rules"`
+	Exclusions    int       `json:"exclusions"`
+	Patches       int       `json:"virtual_patches"`
+	APISpecs      int       `json:"api_specs"`
+	ResponseRules int       `json:"response_rules"`
+	LoadedAt      time.Time `json:"loaded_at"`
+	LastError     string    `json:"last_error,omitempty"` // last rejected reload
 }
 
 type WAFInterface interface {
 	HandleRequest(request *Request) (*Response, error)
-	DetectHeaderThreats(request *Request) bool
-	DetectBodyThreats(request *Request) bool
+	DetectHeaderThreats(request *Request) []Match
+	DetectBodyThreats(request *Request) []Match
+	HandleResponse(request *Request, response *UpstreamResponse) (*Response, error)
+	ValidateSchema(request *Request) (*Response, error)
+	ReloadRules() error
+	RuleSet() RuleSetInfo
 }
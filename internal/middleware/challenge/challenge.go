@@ -0,0 +1,219 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// CookieName is the clearance cookie set once a challenge is solved.
+const CookieName = "gowaf_clearance"
+
+// challengeTTL is the time given to solve a challenge.
+const challengeTTL = 5 * time.Minute
+
+// maxDifficulty keeps the challenge solvable by a browser.
+const maxDifficulty = 32
+
+// Challenge serves a proof-of-work page to suspicious clients: the browser
+// looks for a solution whose SHA-256 hash of "challenge:solution" starts with
+// difficulty zero bits and posts it back. A solved challenge sets an HMAC
+// signed clearance cookie bound to the client IP and User-Agent. The client IP
+// is the peer address, or the address forwarded by a TRUSTED_PROXIES proxy, so
+// a cookie cannot be replayed by a client claiming the IP in a header.
+type Challenge struct {
+	config *config.Config
+	page   *template.Template
+
+	secret     []byte
+	difficulty int
+	ttl        time.Duration
+}
+
+type pageData struct {
+	Action     string
+	Challenge  string
+	Difficulty int
+	Redirect   string
+}
+
+func NewChallenge(config *config.Config) *Challenge {
+	page, err := template.ParseFiles("views/challenge.html")
+	if err != nil {
+		logger.Logger("[fatal] Fail to load the challenge page", err.Error()).Fatal()
+	}
+
+	secret := []byte(config.CHALLENGE_SECRET)
+	if len(secret) == 0 {
+		// the clearances do not survive a restart and are not shared between instances
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.Logger("[fatal] Fail to generate the challenge secret", err.Error()).Fatal()
+		}
+		logger.Logger("[warn] CHALLENGE_SECRET is empty, using a random secret").Warn()
+	}
+
+	return &Challenge{
+		config:     config,
+		page:       page,
+		secret:     secret,
+		difficulty: min(max(config.CHALLENGE_DIFFICULTY, 1), maxDifficulty),
+		ttl:        time.Duration(config.CHALLENGE_TTL) * time.Second,
+	}
+}
+
+// Cleared reports whether the request holds a valid clearance cookie.
+func (ch *Challenge) Cleared(c *gin.Context) bool {
+	_, ok := ch.Clearance(c)
+	return ok
+}
+
+// Clearance returns the random part of the challenge solved for a valid
+// clearance cookie, every solved challenge has its own.
+func (ch *Challenge) Clearance(c *gin.Context) (string, bool) {
+	cookie, err := c.Cookie(CookieName)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Split(cookie, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(ch.sign("clearance", parts[0], parts[1], c.ClientIP(), c.Request.UserAgent()))) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// Serve answers the request with the challenge page.
+func (ch *Challenge) Serve(c *gin.Context) {
+	expiry := strconv.FormatInt(time.Now().Add(challengeTTL).Unix(), 10)
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		c.String(http.StatusInternalServerError, "Error: Internal Server Error")
+		c.Abort()
+		return
+	}
+	random := hex.EncodeToString(nonce)
+
+	data := pageData{
+		Action:     ch.config.CHALLENGE_PATH,
+		Challenge:  expiry + "." + random + "." + ch.sign("challenge", expiry, random, c.ClientIP(), c.Request.UserAgent()),
+		Difficulty: ch.difficulty,
+		Redirect:   c.Request.RequestURI,
+	}
+
+	// the page must not be cached, the challenge is bound to the client
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusForbidden)
+	if err := ch.page.Execute(c.Writer, data); err != nil {
+		logger.Logger("[error] Fail to render the challenge page", err.Error()).Error()
+	}
+	c.Abort()
+}
+
+// Verify handles the solutions posted to CHALLENGE_PATH, the other requests
+// go on.
+func (ch *Challenge) Verify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path != ch.config.CHALLENGE_PATH || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+
+		if !ch.solved(c, c.PostForm("challenge"), c.PostForm("solution")) {
+			logger.Logger(map[string]any{
+				"message": "Challenge failed",
+				"ip":      c.ClientIP(),
+			}).Warn()
+			ch.Serve(c)
+			return
+		}
+
+		// the clearance keeps the random part of the solved challenge
+		random := strings.Split(c.PostForm("challenge"), ".")[1]
+		expiry := strconv.FormatInt(time.Now().Add(ch.ttl).Unix(), 10)
+		secure := ch.config.USE_SSL || c.Request.TLS != nil
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(CookieName, expiry+"."+random+"."+ch.sign("clearance", expiry, random, c.ClientIP(), c.Request.UserAgent()),
+			int(ch.ttl.Seconds()), "/", "", secure, true)
+
+		c.Redirect(http.StatusSeeOther, localRedirect(c.PostForm("redirect")))
+		c.Abort()
+	}
+}
+
+// solved checks the signature, the expiry and the proof of work of a solution.
+func (ch *Challenge) solved(c *gin.Context, challenge, solution string) bool {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || solution == "" || len(solution) > 32 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(ch.sign("challenge", parts[0], parts[1], c.ClientIP(), c.Request.UserAgent()))) {
+		return false
+	}
+
+	return leadingZeros(sha256.Sum256([]byte(challenge+":"+solution))) >= ch.difficulty
+}
+
+// sign returns the HMAC of the fields.
+func (ch *Challenge) sign(fields ...string) string {
+	mac := hmac.New(sha256.New, ch.secret)
+	for _, field := range fields {
+		// the length prefix keeps the fields apart
+		fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func leadingZeros(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// localRedirect keeps the redirect on this site. The browsers drop the tabs
+// and the new lines and read a backslash as a slash, "/\t/host" is "//host".
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	if strings.ContainsFunc(target, unicode.IsControl) {
+		return "/"
+	}
+	if parsed, err := url.Parse(target); err != nil || parsed.Scheme != "" || parsed.Host != "" {
+		return "/"
+	}
+	return target
+}
@@ -0,0 +1,32 @@
+package challenge
+
+import "testing"
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/", "/"},
+		{"/account?tab=1#top", "/account?tab=1#top"},
+		{"/a//b", "/a//b"},
+		{"/%2F%2Fevil.com", "/%2F%2Fevil.com"},
+		{"", "/"},
+		{"account", "/"},
+		{"https://evil.com/", "/"},
+		{"//evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/\r\n/evil.com", "/"},
+		{"/\x00/evil.com", "/"},
+		{"/\u0085/evil.com", "/"},
+		{"/%zz", "/"},
+	}
+
+	for _, test := range tests {
+		if got := localRedirect(test.target); got != test.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
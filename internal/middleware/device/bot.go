@@ -0,0 +1,164 @@
+package device
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gamebtc/devicedetector/parser/client"
+	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
+	"github.com/jahrulnr/go-waf/internal/middleware/ratelimit"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Bot categories sent in the X-Bot-Category header.
+const (
+	BotHuman      = "human"
+	BotGood       = "good"       // search engines, monitoring and the other bots of config/devices/bots.yml
+	BotBad        = "bad"        // scanners listed in BOT_BAD_AGENTS
+	BotAutomation = "automation" // HTTP libraries, headless browsers, generic bots and unknown agents
+)
+
+// Actions of a bot category.
+const (
+	ActionAllow     = "allow"
+	ActionRateLimit = "ratelimit"
+	ActionChallenge = "challenge"
+	ActionBlock     = "block"
+)
+
+// genericBot is the bots.yml entry matching any agent calling itself a bot.
+const genericBot = "Generic Bot"
+
+// headlessBrowsers are browsers driven by scripts.
+var headlessBrowsers = map[string]bool{
+	"Headless Chrome": true,
+}
+
+// DetectBot classifies the request in the X-Bot-Category header and allows,
+// rate limits, challenges or blocks it by category. The crawlers failing the
+// verifier are bad bots, a nil verifier trusts the User-Agent.
+func (m *Device) DetectBot(verifier *Verifier, challenger *challenge.Challenge) gin.HandlerFunc {
+	m.verifier = verifier
+
+	for _, agent := range strings.Split(strings.ToLower(m.config.BOT_BAD_AGENTS), ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			m.badAgents = append(m.badAgents, agent)
+		}
+	}
+
+	m.actions = map[string]string{
+		BotHuman:      strings.ToLower(m.config.BOT_HUMAN_ACTION),
+		BotGood:       strings.ToLower(m.config.BOT_GOOD_ACTION),
+		BotBad:        strings.ToLower(m.config.BOT_BAD_ACTION),
+		BotAutomation: strings.ToLower(m.config.BOT_AUTOMATION_ACTION),
+	}
+	m.limiters = make(map[string]gin.HandlerFunc)
+	for category, action := range m.actions {
+		switch action {
+		case ActionAllow, ActionBlock:
+		case ActionChallenge:
+			if challenger == nil {
+				logger.Logger("[fatal] The bot challenge action requires the challenge", category).Fatal()
+			}
+		case ActionRateLimit:
+			// every category has its own counters
+			limiter := ratelimit.NewRateLimit(m.config)
+			limiter.Driver(m.config.CACHE_DRIVER)
+			limiter.Limit(m.config.BOT_RATELIMIT_SECOND, m.config.BOT_RATELIMIT_MAX, "bot_"+category)
+			m.limiters[category] = limiter.RateLimit()
+		default:
+			logger.Logger("[fatal] Invalid bot action, expected allow, ratelimit, challenge or block", category, action).Fatal()
+		}
+	}
+
+	return func(c *gin.Context) {
+		category := m.classify(c)
+		c.Request.Header.Set("X-Bot-Category", category)
+
+		switch m.actions[category] {
+		case ActionBlock:
+			logger.Logger(map[string]any{
+				"message":    "Bot blocked",
+				"ip":         c.ClientIP(),
+				"path":       c.Request.RequestURI,
+				"category":   category,
+				"user_agent": c.Request.UserAgent(),
+			}).Warn()
+			c.String(http.StatusForbidden, "403 | Forbidden.")
+			c.Abort()
+			return
+		case ActionRateLimit:
+			// the limiter aborts or goes on with the next handlers
+			m.limiters[category](c)
+			return
+		case ActionChallenge:
+			if !challenger.Cleared(c) {
+				challenger.Serve(c)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// verify checks a crawler by DNS, an impersonated crawler is a bad bot and
+// a crawler that could not be checked is unknown automation.
+func (m *Device) verify(c *gin.Context, name string) string {
+	verified, err := m.verifier.Verify(name, c.ClientIP())
+	if err != nil {
+		logger.Logger("[warn] Fail to verify the bot", name, c.ClientIP(), err.Error()).Warn()
+		return BotAutomation
+	}
+	if !verified {
+		logger.Logger(map[string]any{
+			"message": "Impersonated bot",
+			"ip":      c.ClientIP(),
+			"bot":     name,
+		}).Warn()
+		return BotBad
+	}
+	return BotGood
+}
+
+// classify returns the bot category of the request.
+func (m *Device) classify(c *gin.Context) string {
+	userAgent := c.Request.Header.Get("User-Agent")
+	if userAgent == "" {
+		return BotAutomation
+	}
+
+	lower := strings.ToLower(userAgent)
+	for _, agent := range m.badAgents {
+		if strings.Contains(lower, agent) {
+			return BotBad
+		}
+	}
+
+	// without the device rules only the bad bots are known
+	if m.err != nil {
+		return BotHuman
+	}
+
+	info := m.parse(c, userAgent)
+	if info == nil {
+		return BotAutomation
+	}
+	if info.IsBot() {
+		name := info.GetBot().Name
+		if name == genericBot {
+			return BotAutomation
+		}
+		if m.verifier != nil && m.verifier.Verifiable(name) {
+			return m.verify(c, name)
+		}
+		return BotGood
+	}
+
+	detected := info.GetClient()
+	if detected.Type == "" || detected.Type == client.ParserNameLibrary || headlessBrowsers[detected.Name] {
+		return BotAutomation
+	}
+	return BotHuman
+}
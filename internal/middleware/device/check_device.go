@@ -7,22 +7,37 @@ import (
 	"github.com/jahrulnr/go-waf/pkg/logger"
 )
 
+// infoKey stores the parsed User-Agent in the gin context, it is shared by
+// the device and the bot handlers.
+const infoKey = "device.info"
+
 type Device struct {
 	config *config.Config
+
+	detector *devicedetector.DeviceDetector
+	err      error
+
+	// bot classification
+	badAgents []string
+	actions   map[string]string
+	limiters  map[string]gin.HandlerFunc
+	verifier  *Verifier
 }
 
 func NewCheckDevice(config *config.Config) *Device {
+	detector, err := devicedetector.NewDeviceDetector("config/devices")
+
 	return &Device{
-		config: config,
+		config:   config,
+		detector: detector,
+		err:      err,
 	}
 }
 
 func (m *Device) SendHeader() gin.HandlerFunc {
-	detector, err := devicedetector.NewDeviceDetector("config/devices")
-
 	return func(c *gin.Context) {
-		if err != nil {
-			logger.Logger("warn", err.Error()).Warn()
+		if m.err != nil {
+			logger.Logger("warn", m.err.Error()).Warn()
 			c.Next()
 			return
 		}
@@ -35,8 +50,8 @@ func (m *Device) SendHeader() gin.HandlerFunc {
 			return
 		}
 
-		info := detector.Parse(userAgent)
-		if info.IsMobile() {
+		info := m.parse(c, userAgent)
+		if info != nil && info.IsMobile() {
 			c.Request.Header.Add("X-Device", "mobile")
 		} else {
 			c.Request.Header.Add("X-Device", "desktop")
@@ -45,3 +60,14 @@ func (m *Device) SendHeader() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// parse parses the User-Agent once per request, nil when it has no letter.
+func (m *Device) parse(c *gin.Context, userAgent string) *devicedetector.DeviceInfo {
+	if info, ok := c.Get(infoKey); ok {
+		return info.(*devicedetector.DeviceInfo)
+	}
+
+	info := m.detector.Parse(userAgent)
+	c.Set(infoKey, info)
+	return info
+}
@@ -0,0 +1,175 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	service_cache "github.com/jahrulnr/go-waf/internal/service/cache"
+)
+
+// verifyKey is the key prefix of the verifier cache. The cached pages are
+// keyed by their path, which starts with a slash, and a client choosing the
+// device prefix still can't write a key of the verifier: they are name/ip.
+const verifyKey = "botverify"
+
+// Resolver looks up the DNS records verifying a crawler, *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Verifier confirms that a client calling itself a search engine crawler
+// connects from a host name of that search engine: the reverse lookup of the
+// IP has to end with one of the bot domains and the forward lookup of that
+// name has to return the IP.
+type Verifier struct {
+	resolver Resolver
+	cache    service.CacheInterface
+	ttl      time.Duration
+	timeout  time.Duration
+
+	// host name suffixes by bot name
+	domains map[string][]string
+}
+
+// NewVerifier caches the verifications in a cache of its own, the prefix of
+// the shared page cache changes with every proxied request.
+func NewVerifier(config *config.Config) *Verifier {
+	cache := service_cache.NewCacheService(config)
+	cache.SetKey(verifyKey)
+
+	return &Verifier{
+		resolver: NewResolver(config.BOT_DNS_SERVER),
+		cache:    cache,
+		ttl:      time.Duration(config.BOT_VERIFY_CACHE_TTL) * time.Second,
+		timeout:  time.Duration(config.BOT_DNS_TIMEOUT) * time.Second,
+		domains:  parseDomains(config.BOT_VERIFY_DOMAINS),
+	}
+}
+
+// NewResolver returns the system resolver, or a resolver sending every query
+// to server (host:port) when it is not empty.
+func NewResolver(server string) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// SetResolver replaces the resolver, e.g. with a stub.
+func (v *Verifier) SetResolver(resolver Resolver) {
+	v.resolver = resolver
+}
+
+// parseDomains reads a comma separated list of name=domain|domain entries.
+func parseDomains(value string) map[string][]string {
+	domains := make(map[string][]string)
+	for _, item := range strings.Split(value, ",") {
+		name, list, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		for _, domain := range strings.Split(list, "|") {
+			domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+			if domain != "" {
+				domains[strings.TrimSpace(name)] = append(domains[strings.TrimSpace(name)], domain)
+			}
+		}
+	}
+	return domains
+}
+
+// Verifiable reports whether the bot has domains to verify.
+func (v *Verifier) Verifiable(name string) bool {
+	return len(v.domains[name]) > 0
+}
+
+// Verify reports whether the IP belongs to the bot. The answers are cached,
+// the lookup errors other than unknown names are returned and not cached.
+func (v *Verifier) Verify(name, ip string) (bool, error) {
+	key := name + "/" + ip
+	if value, ok := v.cache.Get(key); ok {
+		return string(value) == "1", nil
+	}
+
+	verified, err := v.lookup(name, ip)
+	if err != nil {
+		return false, err
+	}
+
+	value := []byte("0")
+	if verified {
+		value = []byte("1")
+	}
+	v.cache.Set(key, value, v.ttl)
+	return verified, nil
+}
+
+func (v *Verifier) lookup(name, ip string) (bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	hosts, err := v.resolver.LookupAddr(ctx, ip)
+	if notFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if !v.matches(name, host) {
+			continue
+		}
+
+		// anyone controlling the reverse zone of an IP can name it, the
+		// domain of the bot has to point back to the IP
+		addrs, err := v.resolver.LookupIPAddr(ctx, host)
+		if notFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, resolved := range addrs {
+			if resolved.IP.Equal(addr) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matches reports whether the host name is in a domain of the bot.
+func (v *Verifier) matches(name, host string) bool {
+	for _, domain := range v.domains[name] {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,193 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/config"
+	service_cache "github.com/jahrulnr/go-waf/internal/service/cache"
+)
+
+// stubResolver answers from its records and counts the lookups, the names
+// without records are unknown (NXDOMAIN).
+type stubResolver struct {
+	ptr     map[string][]string
+	forward map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	hosts, ok := r.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return hosts, nil
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	ips, ok := r.forward[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func newTestVerifier(resolver Resolver) *Verifier {
+	conf := &config.Config{
+		BOT_VERIFY_DOMAINS:   "Googlebot=googlebot.com|google.com",
+		BOT_DNS_TIMEOUT:      2,
+		BOT_VERIFY_CACHE_TTL: 60,
+	}
+	verifier := NewVerifier(conf)
+	verifier.SetResolver(resolver)
+	return verifier
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		ptr      map[string][]string
+		forward  map[string][]string
+		verified bool
+	}{
+		{
+			name:     "reverse and forward lookups match",
+			ptr:      map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+			forward:  map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+			verified: true,
+		},
+		{
+			name:     "forward lookup returns another IP",
+			ptr:      map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+			forward:  map[string][]string{"crawl-66-249-66-1.googlebot.com": {"203.0.113.7"}},
+			verified: false,
+		},
+		{
+			name:     "reverse lookup outside the bot domains",
+			ptr:      map[string][]string{"66.249.66.1": {"crawl.googlebot.com.evil.example."}},
+			forward:  map[string][]string{"crawl.googlebot.com.evil.example": {"66.249.66.1"}},
+			verified: false,
+		},
+		{
+			name:     "reverse lookup NXDOMAIN",
+			verified: false,
+		},
+		{
+			name:     "forward lookup NXDOMAIN",
+			ptr:      map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+			verified: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := newTestVerifier(&stubResolver{ptr: test.ptr, forward: test.forward})
+
+			verified, err := verifier.Verify("Googlebot", "66.249.66.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified != test.verified {
+				t.Errorf("verified = %v, want %v", verified, test.verified)
+			}
+		})
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	resolver := &stubResolver{
+		ptr:     map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+		forward: map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+	}
+	verifier := newTestVerifier(resolver)
+
+	for i := 0; i < 3; i++ {
+		verified, err := verifier.Verify("Googlebot", "66.249.66.1")
+		if err != nil || !verified {
+			t.Fatalf("Verify = %v, %v, want true", verified, err)
+		}
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want 2, the later answers come from the cache", resolver.lookups)
+	}
+
+	// a NXDOMAIN answer is cached too
+	verifier.Verify("Googlebot", "203.0.113.7")
+	verifier.Verify("Googlebot", "203.0.113.7")
+	if resolver.lookups != 3 {
+		t.Errorf("lookups = %d, want 3", resolver.lookups)
+	}
+}
+
+func TestVerifyErrorNotCached(t *testing.T) {
+	resolver := &stubResolver{err: errors.New("server failure")}
+	verifier := newTestVerifier(resolver)
+
+	for i := 0; i < 2; i++ {
+		if _, err := verifier.Verify("Googlebot", "66.249.66.1"); err == nil {
+			t.Fatal("Verify error = nil, want the lookup error")
+		}
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want 2, errors are not cached", resolver.lookups)
+	}
+}
+
+func TestVerifyCachePoisoning(t *testing.T) {
+	// the file driver shares its directory between the page and the verifier caches
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	conf := &config.Config{
+		CACHE_DRIVER:         "file",
+		BOT_VERIFY_DOMAINS:   "Googlebot=googlebot.com",
+		BOT_DNS_TIMEOUT:      2,
+		BOT_VERIFY_CACHE_TTL: 60,
+	}
+
+	// a client caches pages at paths looking like verifications, with any device prefix
+	for _, device := range []string{"", "desktop", "mobile", "botverify", "botverify-"} {
+		pages := service_cache.NewCacheService(conf)
+		if device != "" {
+			pages.SetKey(device)
+		}
+		for _, path := range []string{"/bot-verify/Googlebot/66.249.66.1", "/Googlebot/66.249.66.1", "/botverify/Googlebot/66.249.66.1"} {
+			pages.Set("http://backend"+path, []byte("0"), time.Minute)
+		}
+	}
+
+	resolver := &stubResolver{
+		ptr:     map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+		forward: map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+	}
+	verifier := NewVerifier(conf)
+	verifier.SetResolver(resolver)
+
+	verified, err := verifier.Verify("Googlebot", "66.249.66.1")
+	if err != nil || !verified {
+		t.Errorf("Verify = %v, %v, want true", verified, err)
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want 2, the cached pages are not verifications", resolver.lookups)
+	}
+}
@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/urlpath"
+)
+
+// InfoKey stores the location of the client IP in the gin context, it is
+// read by the rate limiter and the WAF.
+const InfoKey = "geo.info"
+
+// Info returns the location of the client IP, false when GeoIP is disabled.
+func Info(c *gin.Context) (service.GeoInfo, bool) {
+	info, ok := c.Get(InfoKey)
+	if !ok {
+		return service.GeoInfo{}, false
+	}
+	return info.(service.GeoInfo), true
+}
+
+// NewGeoIPMiddleware sends the country and the autonomous system of the
+// client IP to the backend in the X-Geo-Country and X-Geo-ASN headers and
+// rejects the requests denied by the rule of their path.
+func NewGeoIPMiddleware(geoIP service.GeoIPInterface) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the headers are only trusted from the WAF
+		c.Request.Header.Del("X-Geo-Country")
+		c.Request.Header.Del("X-Geo-ASN")
+
+		info := geoIP.Lookup(c.ClientIP())
+		c.Set(InfoKey, info)
+
+		if allowed, reason := geoIP.Allowed(urlpath.Clean(c.Request.URL.Path), info); !allowed {
+			logger.Logger(map[string]any{
+				"message": "GeoIP denied",
+				"ip":      c.ClientIP(),
+				"path":    c.Request.RequestURI,
+				"reason":  reason,
+			}).Warn()
+			c.String(http.StatusForbidden, "403 | Forbidden.")
+			c.Abort()
+			return
+		}
+
+		if info.Country != "" {
+			c.Request.Header.Set("X-Geo-Country", info.Country)
+		}
+		if info.ASN != 0 {
+			c.Request.Header.Set("X-Geo-ASN", strconv.FormatUint(uint64(info.ASN), 10))
+		}
+
+		c.Next()
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
+	"github.com/jahrulnr/go-waf/internal/middleware/geoip"
 	"github.com/jahrulnr/go-waf/pkg/logger"
 
 	ratelimit "github.com/JGLTechnologies/gin-rate-limit"
@@ -18,6 +20,13 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// Parts of the rate limit key selected with RATELIMIT_KEY.
+const (
+	KeyIP      = "ip"
+	KeyCountry = "country"
+	KeyASN     = "asn"
+)
+
 type RateLimit struct {
 	config  *config.Config
 	page429 []byte
@@ -28,6 +37,10 @@ type RateLimit struct {
 
 	rate  time.Duration
 	limit uint
+	keys  []string
+
+	// nil unless RATELIMIT_CHALLENGE is enabled
+	challenge *challenge.Challenge
 }
 
 func NewRateLimit(config *config.Config) *RateLimit {
@@ -37,9 +50,41 @@ func NewRateLimit(config *config.Config) *RateLimit {
 	}
 }
 
+// Limit replaces the RATELIMIT_* limits and prefixes the keys, so a class of
+// clients is limited separately, per client IP.
+func (s *RateLimit) Limit(second int, max uint, prefix string) {
+	s.rate = time.Duration(second) * time.Second
+	s.limit = max
+	s.prefix = prefix
+	s.keys = []string{KeyIP}
+}
+
+// Challenge serves the proof-of-work challenge instead of the 429 page. The
+// clients who solved it are counted apart under their clearance, so a solved
+// challenge starts a new count and the challenge comes back once it is spent.
+func (s *RateLimit) Challenge(challenge *challenge.Challenge) {
+	s.challenge = challenge
+}
+
 func (s *RateLimit) initialize() {
-	s.rate = time.Duration(s.config.RATELIMIT_SECOND) * time.Second
-	s.limit = s.config.RATELIMIT_MAX
+	if s.rate == 0 {
+		s.rate = time.Duration(s.config.RATELIMIT_SECOND) * time.Second
+		s.limit = s.config.RATELIMIT_MAX
+	}
+	if s.keys == nil {
+		for _, key := range strings.Split(strings.ToLower(s.config.RATELIMIT_KEY), ",") {
+			switch key = strings.TrimSpace(key); key {
+			case KeyIP, KeyCountry, KeyASN:
+				s.keys = append(s.keys, key)
+			case "":
+			default:
+				logger.Logger("[fatal] Invalid RATELIMIT_KEY, expected ip, country or asn", key).Fatal()
+			}
+		}
+		if len(s.keys) == 0 {
+			s.keys = []string{KeyIP}
+		}
+	}
 
 	file, err := os.OpenFile("views/429.html", os.O_RDONLY, 0600)
 	if err != nil {
@@ -64,10 +109,34 @@ func (s *RateLimit) Driver(driver string) {
 }
 
 func (s *RateLimit) keyFunc(c *gin.Context) string {
-	return fmt.Sprintf("%s_%s", s.prefix, c.ClientIP())
+	info, _ := geoip.Info(c)
+
+	key := s.prefix
+	for _, part := range s.keys {
+		// the clients of an unknown location are counted by IP
+		switch {
+		case part == KeyCountry && info.Country != "":
+			key += "_" + info.Country
+		case part == KeyASN && info.ASN != 0:
+			key += fmt.Sprintf("_AS%d", info.ASN)
+		default:
+			key += "_" + c.ClientIP()
+		}
+	}
+	if s.challenge != nil {
+		if clearance, ok := s.challenge.Clearance(c); ok {
+			key += "_" + clearance
+		}
+	}
+	return key
 }
 
 func (s *RateLimit) errorHandler(c *gin.Context, info ratelimit.Info) {
+	if s.challenge != nil {
+		s.challenge.Serve(c)
+		return
+	}
+
 	if s.page429 == nil {
 		c.String(http.StatusTooManyRequests, "429 | Too many request.")
 		c.Abort()
@@ -100,10 +169,8 @@ func (s *RateLimit) RateLimit() gin.HandlerFunc {
 		})
 	}
 
-	middleware := ratelimit.RateLimiter(s.store, &ratelimit.Options{
+	return ratelimit.RateLimiter(s.store, &ratelimit.Options{
 		ErrorHandler: s.errorHandler,
 		KeyFunc:      s.keyFunc,
 	})
-
-	return middleware
 }
@@ -0,0 +1,67 @@
+package reputation
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
+	service_ip_reputation "github.com/jahrulnr/go-waf/internal/service/ip_reputation"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// ListsKey stores the score lists holding the client IP in the gin context,
+// the WAF adds their score to the request.
+const ListsKey = "ip.reputation"
+
+// NewIPReputationMiddleware blocks or challenges the client IPs found in the
+// lists and sends the names of the lists to the backend in the
+// X-IP-Reputation header. The challenger may be nil when no list challenges.
+func NewIPReputationMiddleware(reputation service.IPReputationInterface, challenger *challenge.Challenge) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the header is only trusted from the WAF
+		c.Request.Header.Del("X-IP-Reputation")
+
+		lists := reputation.Lookup(c.ClientIP())
+		if len(lists) == 0 {
+			c.Next()
+			return
+		}
+
+		var names []string
+		var scored []service.IPList
+		challenged := false
+		for _, list := range lists {
+			switch list.Action {
+			case service_ip_reputation.ActionBlock:
+				logger.Logger(map[string]any{
+					"message": "IP blocked",
+					"ip":      c.ClientIP(),
+					"path":    c.Request.RequestURI,
+					"list":    list.Name,
+				}).Warn()
+				c.String(http.StatusForbidden, "403 | Forbidden.")
+				c.Abort()
+				return
+			case service_ip_reputation.ActionChallenge:
+				challenged = true
+			case service_ip_reputation.ActionScore:
+				scored = append(scored, list)
+			}
+			names = append(names, list.Name)
+		}
+
+		if challenged && challenger != nil && !challenger.Cleared(c) {
+			challenger.Serve(c)
+			return
+		}
+
+		c.Request.Header.Set("X-IP-Reputation", strings.Join(names, ","))
+		if len(scored) > 0 {
+			c.Set(ListsKey, scored)
+		}
+
+		c.Next()
+	}
+}
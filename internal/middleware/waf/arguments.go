@@ -0,0 +1,304 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// maxJSONDepth stops walking pathological nested JSON documents, deeper
+// documents are inspected as a whole.
+const maxJSONDepth = 64
+
+// maxXMLDepth stops walking pathological nested XML documents, deeper
+// documents are inspected as a whole.
+const maxXMLDepth = 64
+
+var (
+	errJSONTooDeep      = fmt.Errorf("JSON document nested deeper than %d", maxJSONDepth)
+	errJSONTrailingData = errors.New("data after the JSON document")
+	errJSONDuplicateKey = errors.New("duplicate key in a JSON object")
+	errXMLTooDeep       = fmt.Errorf("XML document nested deeper than %d", maxXMLDepth)
+)
+
+// parseArguments fills the request arguments from the query string and the body.
+func parseArguments(request *service.Request, rawQuery, contentType string) {
+	request.Args = append(request.Args, parseQuery(service.ArgsGet, rawQuery)...)
+
+	if len(request.Body) == 0 {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+
+	var args []service.Argument
+	var files []service.File
+	var processor string
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		args, err = parseURLEncoded(request.Body)
+		processor = service.BodyURLEncoded
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		args, err = parseJSON(request.Body)
+		processor = service.BodyJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		args, err = parseXML(request.Body)
+		processor = service.BodyXML
+	case mediaType == "multipart/form-data":
+		args, files, err = parseMultipart(request.Body, params["boundary"])
+		processor = service.BodyMultipart
+	default:
+		return
+	}
+
+	// an unparsable, ambiguous or too deep body is inspected as a whole
+	if err != nil {
+		return
+	}
+
+	request.Args = append(request.Args, args...)
+	request.Files = files
+	request.BodyProcessor = processor
+}
+
+func parseURLEncoded(body []byte) ([]service.Argument, error) {
+	return parseQuery(service.ArgsPost, string(body)), nil
+}
+
+// parseQuery parses a query string leniently: the pairs url.ParseQuery
+// rejects, holding a semicolon or an invalid escape, may still be read by the
+// backend, so every pair is kept in order.
+func parseQuery(source, rawQuery string) []service.Argument {
+	var args []service.Argument
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		args = append(args, service.Argument{Source: source, Name: queryUnescape(name), Value: queryUnescape(value)})
+	}
+	return args
+}
+
+// queryUnescape decodes a query string component, an invalid escape is kept as is.
+func queryUnescape(value string) string {
+	if decoded, err := url.QueryUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func parseJSON(body []byte) ([]service.Argument, error) {
+	if err := checkJSON(body); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	var args []service.Argument
+	if err := walkJSON(service.ArgsPost, "json", document, 0, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// checkJSON rejects the bodies holding data after the JSON document or
+// objects with duplicate keys: the decoder keeps the last key and ignores the
+// rest of the body, the backend may read the first key or the trailing data.
+func checkJSON(body []byte) error {
+	// the objects being read, nil for arrays
+	type object struct {
+		keys      map[string]bool
+		expectKey bool
+	}
+	var stack []*object
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		var top *object
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		completed := true
+		switch {
+		case top != nil && top.expectKey && token != json.Delim('}'):
+			key, _ := token.(string)
+			if top.keys[key] {
+				return errJSONDuplicateKey
+			}
+			top.keys[key] = true
+			top.expectKey = false
+			continue
+		case token == json.Delim('{'):
+			stack = append(stack, &object{keys: make(map[string]bool), expectKey: true})
+			completed = false
+		case token == json.Delim('['):
+			stack = append(stack, nil)
+			completed = false
+		case token == json.Delim('}') || token == json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		}
+
+		if !completed {
+			continue
+		}
+		if len(stack) == 0 {
+			break
+		}
+		// the value of a key was read, a key or the end of the object follows
+		if parent := stack[len(stack)-1]; parent != nil {
+			parent.expectKey = true
+		}
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return errJSONTrailingData
+	}
+	return nil
+}
+
+// walkJSON adds every scalar of the document as an argument named by its key
+// path, it fails on documents nested deeper than maxJSONDepth.
+func walkJSON(source, name string, value any, depth int, args *[]service.Argument) error {
+	if depth > maxJSONDepth {
+		return errJSONTooDeep
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if err := walkJSON(source, name+"."+key, item, depth+1, args); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, item := range v {
+			if err := walkJSON(source, name+"."+strconv.Itoa(i), item, depth+1, args); err != nil {
+				return err
+			}
+		}
+	case string:
+		*args = append(*args, service.Argument{Source: source, Name: name, Value: v})
+	case json.Number:
+		*args = append(*args, service.Argument{Source: source, Name: name, Value: v.String()})
+	case bool:
+		*args = append(*args, service.Argument{Source: source, Name: name, Value: strconv.FormatBool(v)})
+	}
+	return nil
+}
+
+// parseXML adds the text of every element and every attribute value as an
+// argument named by its element path, e.g. xml.user.name and xml.user@id.
+// The decoder never resolves DTDs, documents using custom entities fail to
+// parse and are inspected as a whole, like documents nested deeper than
+// maxXMLDepth.
+func parseXML(body []byte) ([]service.Argument, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	var args []service.Argument
+	var path []string
+	var text []strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return args, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			text = append(text, strings.Builder{})
+			if len(path) > maxXMLDepth {
+				return nil, errXMLTooDeep
+			}
+
+			name := "xml." + strings.Join(path, ".")
+			for _, attr := range t.Attr {
+				args = append(args, service.Argument{Source: service.ArgsPost, Name: name + "@" + attr.Name.Local, Value: attr.Value})
+			}
+		case xml.CharData:
+			if len(text) > 0 {
+				text[len(text)-1].Write(t)
+			}
+		case xml.EndElement:
+			if value := strings.TrimSpace(text[len(text)-1].String()); value != "" {
+				args = append(args, service.Argument{Source: service.ArgsPost, Name: "xml." + strings.Join(path, "."), Value: value})
+			}
+			path = path[:len(path)-1]
+			text = text[:len(text)-1]
+		}
+	}
+}
+
+func parseMultipart(body []byte, boundary string) ([]service.Argument, []service.File, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	var args []service.Argument
+	var files []service.File
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return args, files, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, err := io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if filename := rawFileName(part); filename != "" {
+			args = append(args, service.Argument{Source: service.Files, Name: part.FormName(), Value: filename})
+			files = append(files, service.File{
+				Field:       part.FormName(),
+				FileName:    filename,
+				ContentType: part.Header.Get("Content-Type"),
+				Content:     value,
+			})
+			continue
+		}
+
+		args = append(args, service.Argument{Source: service.ArgsPost, Name: part.FormName(), Value: string(value)})
+	}
+}
+
+// rawFileName returns the file name as sent by the client, multipart.Part.FileName
+// strips the directories which is exactly what the WAF has to inspect.
+func rawFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
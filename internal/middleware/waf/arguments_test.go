@@ -0,0 +1,123 @@
+package waf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		want     []service.Argument
+	}{
+		{"", nil},
+		{"a=1&b=2", []service.Argument{{Source: service.ArgsGet, Name: "a", Value: "1"}, {Source: service.ArgsGet, Name: "b", Value: "2"}}},
+		{"a=1&a=2", []service.Argument{{Source: service.ArgsGet, Name: "a", Value: "1"}, {Source: service.ArgsGet, Name: "a", Value: "2"}}},
+		{"format=;id", []service.Argument{{Source: service.ArgsGet, Name: "format", Value: ";id"}}},
+		{"a=1;b=2", []service.Argument{{Source: service.ArgsGet, Name: "a", Value: "1;b=2"}}},
+		{"q=%27%20or%201=1", []service.Argument{{Source: service.ArgsGet, Name: "q", Value: "' or 1=1"}}},
+		{"q=100%&r=%zz", []service.Argument{{Source: service.ArgsGet, Name: "q", Value: "100%"}, {Source: service.ArgsGet, Name: "r", Value: "%zz"}}},
+		{"flag&&x=a+b", []service.Argument{{Source: service.ArgsGet, Name: "flag", Value: ""}, {Source: service.ArgsGet, Name: "x", Value: "a b"}}},
+	}
+
+	for _, test := range tests {
+		got := parseQuery(service.ArgsGet, test.rawQuery)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("parseQuery(%q) = %v, want %v", test.rawQuery, got, test.want)
+		}
+	}
+}
+
+func TestParseArgumentsURLEncodedBody(t *testing.T) {
+	request := &service.Request{Body: []byte("name=a;b&id=1%")}
+	parseArguments(request, "", "application/x-www-form-urlencoded")
+
+	want := []service.Argument{
+		{Source: service.ArgsPost, Name: "name", Value: "a;b"},
+		{Source: service.ArgsPost, Name: "id", Value: "1%"},
+	}
+	if !slices.Equal(request.Args, want) || request.BodyProcessor != service.BodyURLEncoded {
+		t.Errorf("args = %v, processor %q, want %v", request.Args, request.BodyProcessor, want)
+	}
+}
+
+func TestParseArgumentsDepthLimit(t *testing.T) {
+	nested := func(open, close string, depth int, value string) []byte {
+		return []byte(strings.Repeat(open, depth) + value + strings.Repeat(close, depth))
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		processor   string
+	}{
+		{"JSON within the limit", "application/json", nested(`{"a":`, `}`, maxJSONDepth, `"<script>"`), service.BodyJSON},
+		{"JSON past the limit", "application/json", nested(`{"a":`, `}`, maxJSONDepth+1, `"<script>"`), ""},
+		{"JSON array past the limit", "application/json", nested(`[`, `]`, maxJSONDepth+1, `"<script>"`), ""},
+		{"XML within the limit", "application/xml", nested(`<a>`, `</a>`, maxXMLDepth, `&lt;script&gt;`), service.BodyXML},
+		{"XML past the limit", "application/xml", nested(`<a>`, `</a>`, maxXMLDepth+1, `&lt;script&gt;`), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &service.Request{Body: test.body}
+			parseArguments(request, "", test.contentType)
+
+			if request.BodyProcessor != test.processor {
+				t.Fatalf("processor = %q, want %q", request.BodyProcessor, test.processor)
+			}
+			// a body past the limit is inspected as a whole, so no argument hides the value
+			if test.processor == "" && len(request.Args) != 0 {
+				t.Errorf("args = %v, want none", request.Args)
+			}
+			if test.processor != "" && (len(request.Args) != 1 || request.Args[0].Value != "<script>") {
+				t.Errorf("args = %v, want the nested value", request.Args)
+			}
+		})
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	tests := []struct {
+		body string
+		err  error
+	}{
+		{`{"a":1,"b":{"a":2},"c":[{"a":3},{"a":4}]}`, nil},
+		{`[1,"a",{"a":{}},[]]`, nil},
+		{` "scalar" `, nil},
+		{`{"a":{"b":1},"b":2}`, nil},
+		{`{"a":1,"a":2}`, errJSONDuplicateKey},
+		{`{"a":{"b":1,"b":2}}`, errJSONDuplicateKey},
+		{`[{"a":[],"a":[]}]`, errJSONDuplicateKey},
+		{`{"a":1}{"a":2}`, errJSONTrailingData},
+		{`{"a":1} <script>`, errJSONTrailingData},
+		{`{"a":1}}`, errJSONTrailingData},
+		{`[1] 2`, errJSONTrailingData},
+	}
+
+	for _, test := range tests {
+		if err := checkJSON([]byte(test.body)); err != test.err {
+			t.Errorf("checkJSON(%s) = %v, want %v", test.body, err, test.err)
+		}
+	}
+
+	if err := checkJSON([]byte(`{"a":`)); err == nil {
+		t.Error("checkJSON of a truncated document = nil")
+	}
+}
+
+func TestParseArgumentsAmbiguousJSON(t *testing.T) {
+	for _, body := range []string{`{"q":"<script>","q":"shoes"}`, `{"q":"shoes"} {"q":"<script>"}`} {
+		request := &service.Request{Body: []byte(body)}
+		parseArguments(request, "", "application/json")
+
+		// inspected as a whole
+		if request.BodyProcessor != "" || len(request.Args) != 0 {
+			t.Errorf("%s: args = %v, processor %q, want the raw body", body, request.Args, request.BodyProcessor)
+		}
+	}
+}
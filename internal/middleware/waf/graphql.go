@@ -0,0 +1,148 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+)
+
+// graphqlPayload is a GraphQL request sent as JSON, in the body or in the query string.
+type graphqlPayload struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+	Variables     any    `json:"variables"`
+}
+
+// graphqlPaths returns the endpoints of WAF_GRAPHQL_PATHS, without their
+// limits and their trailing slash.
+func graphqlPaths(spec string) map[string]bool {
+	paths := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		path, _, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if path != "" {
+			paths[strings.TrimSuffix(path, "/")] = true
+		}
+	}
+	return paths
+}
+
+// graphqlParameters are the query string parameters of a GraphQL GET request.
+var graphqlParameters = []string{"query", "operationName", "variables"}
+
+// parseGraphQL fills the arguments of a GraphQL endpoint request. The queries
+// are parsed into documents and only their literal values are inspected,
+// named like graphql.user.name, the variables are named like
+// graphql.variables.id. A query that fails to parse is inspected as a whole
+// and recorded as an error, like repeated GraphQL query string parameters.
+func parseGraphQL(request *service.Request, rawQuery, contentType string) {
+	args := parseQuery(service.ArgsGet, rawQuery)
+
+	var payloads []graphqlPayload
+	if slices.ContainsFunc(args, func(arg service.Argument) bool { return arg.Name == "query" }) {
+		// the backend may read any of the repeated values, every one is inspected
+		seen := make(map[string]bool)
+		for _, arg := range args {
+			if !slices.Contains(graphqlParameters, arg.Name) {
+				request.Args = append(request.Args, arg)
+				continue
+			}
+			if seen[arg.Name] {
+				request.GraphQLErrors = append(request.GraphQLErrors, fmt.Sprintf("repeated %s parameter", arg.Name))
+			}
+			seen[arg.Name] = true
+
+			switch arg.Name {
+			case "query":
+				payloads = append(payloads, graphqlPayload{Query: arg.Value})
+			case "operationName":
+				payloads = append(payloads, graphqlPayload{OperationName: arg.Value})
+			case "variables":
+				payload := graphqlPayload{Variables: arg.Value}
+				decoder := json.NewDecoder(strings.NewReader(arg.Value))
+				decoder.UseNumber()
+				if err := decoder.Decode(&payload.Variables); err != nil {
+					payload.Variables = arg.Value
+				}
+				payloads = append(payloads, payload)
+			}
+		}
+	} else {
+		request.Args = append(request.Args, args...)
+	}
+	addGraphQLArguments(request, service.ArgsGet, payloads)
+
+	if len(request.Body) == 0 {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+		return
+	case mediaType == "application/graphql":
+		payloads = []graphqlPayload{{Query: string(request.Body)}}
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		payloads, err = parseGraphQLJSON(request.Body)
+		if err != nil {
+			request.GraphQLErrors = append(request.GraphQLErrors, "invalid JSON body: "+err.Error())
+			return
+		}
+	default:
+		// not a GraphQL request, e.g. a multipart upload
+		parseArguments(request, "", contentType)
+		return
+	}
+
+	addGraphQLArguments(request, service.ArgsPost, payloads)
+	request.BodyProcessor = service.BodyGraphQL
+}
+
+// parseGraphQLJSON decodes a single request or a batch of requests, the
+// ambiguous bodies are rejected like by parseJSON.
+func parseGraphQLJSON(body []byte) ([]graphqlPayload, error) {
+	if err := checkJSON(body); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []graphqlPayload
+		err := decoder.Decode(&batch)
+		return batch, err
+	}
+
+	var payload graphqlPayload
+	err := decoder.Decode(&payload)
+	return []graphqlPayload{payload}, err
+}
+
+func addGraphQLArguments(request *service.Request, source string, payloads []graphqlPayload) {
+	for _, payload := range payloads {
+		if payload.Query != "" {
+			if document, err := graphql.Parse(payload.Query); err == nil {
+				request.GraphQL = append(request.GraphQL, document)
+				for _, literal := range document.Literals() {
+					request.Args = append(request.Args, service.Argument{Source: source, Name: "graphql." + literal.Name, Value: literal.Value})
+				}
+			} else {
+				request.GraphQLErrors = append(request.GraphQLErrors, err.Error())
+				request.Args = append(request.Args, service.Argument{Source: source, Name: "graphql.query", Value: payload.Query})
+			}
+		}
+
+		if payload.OperationName != "" {
+			request.Args = append(request.Args, service.Argument{Source: source, Name: "graphql.operationName", Value: payload.OperationName})
+		}
+		if err := walkJSON(source, "graphql.variables", payload.Variables, 0, &request.Args); err != nil {
+			request.GraphQLErrors = append(request.GraphQLErrors, "variables: "+err.Error())
+		}
+	}
+}
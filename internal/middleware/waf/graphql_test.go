@@ -0,0 +1,55 @@
+package waf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name        string
+		rawQuery    string
+		contentType string
+		body        string
+		documents   int
+		errors      int
+		args        []string
+	}{
+		{"query string", "query=%7Buser(id:%221%22)%7Bname%7D%7D&page=2", "", "", 1, 0, []string{"page", "graphql.user.id"}},
+		{"repeated query", "query=%7Ba%7D&query=%7Bb(x:%22y%22)%7Bc%7D%7D", "", "", 2, 1, []string{"graphql.b.x"}},
+		{"repeated variables", "query=%7Ba%7D&variables=%7B%22id%22:1%7D&variables=%7B%22id%22:2%7D", "", "", 1, 1, []string{"graphql.variables.id", "graphql.variables.id"}},
+		{"invalid query", "query=%7Ba(", "", "", 0, 1, []string{"graphql.query"}},
+		{"JSON body", "", "application/json", `{"query":"{user(id:\"1\"){name}}","variables":{"id":"2"}}`, 1, 0, []string{"graphql.user.id", "graphql.variables.id"}},
+		{"batch", "", "application/json", `[{"query":"{a}"},{"query":"{b}"}]`, 2, 0, nil},
+		{"invalid JSON body", "", "application/json", `{"query":`, 0, 1, nil},
+		{"duplicate query key", "", "application/json", `{"query":"{a}","query":"{b}"}`, 0, 1, nil},
+		{"data after the JSON body", "", "application/json", `{"query":"{a}"} {"query":"{b}"}`, 0, 1, nil},
+		{"query nested past the parser limit", "", "application/graphql", strings.Repeat("{a", 600) + strings.Repeat("}", 600), 0, 1, []string{"graphql.query"}},
+		{"variables nested past the limit", "", "application/json",
+			`{"query":"{a}","variables":` + strings.Repeat(`{"a":`, 100) + `1` + strings.Repeat(`}`, 100) + `}`, 1, 1, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &service.Request{Body: []byte(test.body)}
+			parseGraphQL(request, test.rawQuery, test.contentType)
+
+			if len(request.GraphQL) != test.documents {
+				t.Errorf("documents = %d, want %d", len(request.GraphQL), test.documents)
+			}
+			if len(request.GraphQLErrors) != test.errors {
+				t.Errorf("errors = %q, want %d", request.GraphQLErrors, test.errors)
+			}
+			var names []string
+			for _, arg := range request.Args {
+				names = append(names, arg.Name)
+			}
+			if !slices.Equal(names, test.args) {
+				t.Errorf("args = %v, want %v", names, test.args)
+			}
+		})
+	}
+}
@@ -3,51 +3,192 @@ package waf
 import (
 	"bytes"
 	"io"
+	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/internal/middleware/challenge"
+	"github.com/jahrulnr/go-waf/internal/middleware/geoip"
+	"github.com/jahrulnr/go-waf/internal/middleware/reputation"
+	"github.com/jahrulnr/go-waf/pkg/urlpath"
 )
 
 type WAFMiddleware struct {
 }
 
-func NewWAFMiddleware(wafService service.WAFInterface) gin.HandlerFunc {
+// requestKey stores the parsed request in the gin context, it is shared by
+// the WAF and the OpenAPI middlewares.
+const requestKey = "waf.request"
+
+// Request returns the request parsed by the WAF, false when the WAF did not run.
+func Request(c *gin.Context) (*service.Request, bool) {
+	request, ok := c.Get(requestKey)
+	if !ok {
+		return nil, false
+	}
+	return request.(*service.Request), true
+}
+
+// NewWAFMiddleware inspects the requests, the challenger serves the
+// proof-of-work challenge of the suspicious ones and may be nil.
+func NewWAFMiddleware(config *config.Config, wafService service.WAFInterface, challenger *challenge.Challenge) gin.HandlerFunc {
+	graphqlEndpoints := graphqlPaths(config.WAF_GRAPHQL_PATHS)
+
 	return func(c *gin.Context) {
-		request := &service.Request{
-			IP:      c.Request.RemoteAddr,
-			Path:    c.Request.RequestURI,
-			Headers: make(map[string]string),
-			Body:    []byte{},
-		}
+		request := newRequest(c, config, graphqlEndpoints)
 
-		// Read the request body
-		if c.Request.Body != nil {
-			body, err := io.ReadAll(c.Request.Body)
-			if err == nil {
-				request.Body = body
-				// Reset the body so it can be read again later
-				c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
-			}
+		response, err := wafService.HandleRequest(request)
+		if !respond(c, response, err) {
+			return
 		}
 
-		for key, value := range c.Request.Header {
-			request.Headers[key] = value[0]
+		if response != nil && response.Challenge && challenger != nil && !challenger.Cleared(c) {
+			challenger.Serve(c)
+			return
 		}
 
-		request.Headers["RequestURI"] = request.Path
-		response, err := wafService.HandleRequest(request)
-		if err != nil {
-			c.String(500, "Error: Internal Server Error")
-			c.Abort()
+		c.Next()
+	}
+}
+
+// NewOpenAPIMiddleware rejects the requests not conforming to the OpenAPI
+// spec of their host and path.
+func NewOpenAPIMiddleware(config *config.Config, wafService service.WAFInterface) gin.HandlerFunc {
+	graphqlEndpoints := graphqlPaths(config.WAF_GRAPHQL_PATHS)
+
+	return func(c *gin.Context) {
+		request := newRequest(c, config, graphqlEndpoints)
+
+		response, err := wafService.ValidateSchema(request)
+		if !respond(c, response, err) {
 			return
 		}
 
-		if response != nil {
-			c.String(403, string(response.Body))
+		c.Next()
+	}
+}
+
+// respond sets the headers of the WAF response and aborts the blocked
+// requests, it reports whether the request goes on.
+func respond(c *gin.Context, response *service.Response, err error) bool {
+	if err != nil {
+		c.String(500, "Error: Internal Server Error")
+		c.Abort()
+		return false
+	}
+
+	if response != nil {
+		for key, value := range response.Headers {
+			c.Header(key, value)
+		}
+
+		if response.Blocked {
+			c.String(response.StatusCode, string(response.Body))
 			c.Abort()
-			return
+			return false
 		}
+	}
 
-		c.Next()
+	return true
+}
+
+// newRequest builds the request inspected by the WAF, once per request.
+func newRequest(c *gin.Context, config *config.Config, graphqlEndpoints map[string]bool) *service.Request {
+	if request, ok := Request(c); ok {
+		return request
+	}
+
+	request := &service.Request{
+		IP:     c.ClientIP(),
+		Method: c.Request.Method,
+		Host:   c.Request.Host,
+		Path:   c.Request.RequestURI,
+		// the rules scoped to a path must not be evaded by encoding or dot segments
+		CleanPath: urlpath.Clean(c.Request.URL.Path),
+		Headers:   make(map[string][]string),
+		Body:      []byte{},
+		Protocol:  c.Request.Proto,
+		// the Host header is not part of Request.Header
+		HeaderCount: 1,
+	}
+
+	readBody(c, request, config.WAF_MAX_BODY_SIZE)
+
+	for key, values := range c.Request.Header {
+		request.Headers[key] = values
+		request.HeaderCount += len(values)
+	}
+	request.Cookies = parseCookies(c.Request.Header.Values("Cookie"))
+
+	if lists, ok := c.Get(reputation.ListsKey); ok {
+		request.IPLists = lists.([]service.IPList)
+	}
+	request.Geo, _ = geoip.Info(c)
+
+	// the backends usually route the endpoints with and without a trailing slash
+	if graphqlEndpoints[strings.TrimSuffix(request.CleanPath, "/")] {
+		parseGraphQL(request, c.Request.URL.RawQuery, c.Request.Header.Get("Content-Type"))
+	} else {
+		parseArguments(request, c.Request.URL.RawQuery, c.Request.Header.Get("Content-Type"))
+	}
+
+	c.Set(requestKey, request)
+	return request
+}
+
+// readBody reads the request body up to maxSize bytes, 0 means no limit. A
+// larger body is not inspected and is passed on untouched.
+func readBody(c *gin.Context, request *service.Request, maxSize int64) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return
+	}
+
+	if maxSize > 0 && c.Request.ContentLength > maxSize {
+		request.BodySize = c.Request.ContentLength
+		return
+	}
+
+	reader := io.Reader(c.Request.Body)
+	if maxSize > 0 {
+		// chunked bodies have no Content-Length, one more byte tells they are too large
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return
+	}
+	request.BodySize = int64(len(body))
+
+	if maxSize > 0 && request.BodySize > maxSize {
+		// Put back what was read in front of the rest of the body
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+		return
+	}
+
+	request.Body = body
+	// Reset the body so it can be read again later
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+}
+
+// parseCookies parses the Cookie headers leniently: invalid cookies dropped by
+// net/http may still be read by the backend, so every pair is kept as is.
+func parseCookies(headers []string) map[string][]string {
+	cookies := make(map[string][]string)
+	for _, header := range headers {
+		for _, pair := range strings.Split(header, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(pair, "=")
+			cookies[name] = append(cookies[name], strings.Trim(value, `"`))
+		}
 	}
+	return cookies
 }
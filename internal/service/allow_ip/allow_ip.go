@@ -6,6 +6,7 @@ import (
 
 	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
 )
 
 type AllowIP struct {
@@ -13,22 +14,43 @@ type AllowIP struct {
 }
 
 func NewAllowIP(config *config.Config) service.AllowIPInterface {
+	return NewAllowIPList("CACHE_REMOVE_ALLOW_IP", config.CACHE_REMOVE_ALLOW_IP)
+}
+
+// NewAllowIPList creates an AllowIP from a comma separated list of IPs and
+// CIDR prefixes, name is the variable of the list reported when it is invalid.
+func NewAllowIPList(name, ips string) service.AllowIPInterface {
 	s := &AllowIP{}
-	s.loadIPs(config.CACHE_REMOVE_ALLOW_IP)
+	s.loadIPs(name, ips)
 
 	return s
 }
 
-func (s *AllowIP) loadIPs(ipv4s string) {
+func (s *AllowIP) loadIPs(name, ipv4s string) {
 	// List of IP prefixes to parse
 	ips := strings.Split(ipv4s, ",")
 
 	// Parse the IP prefixes and store them in the struct
 	for _, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
 		if !strings.Contains(ip, "/") {
-			ip += "/32"
+			// a single address, /32 for IPv4 and /128 for IPv6
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				logger.Logger("[fatal] Invalid "+name+", expected IPs or CIDR prefixes", ip).Fatal()
+				continue
+			}
+			s.prefixes = append(s.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			logger.Logger("[fatal] Invalid "+name+", expected IPs or CIDR prefixes", ip).Fatal()
+			continue
 		}
-		prefix := netip.MustParsePrefix(ip)
 		s.prefixes = append(s.prefixes, prefix)
 	}
 }
@@ -0,0 +1,30 @@
+package service_allow_ip
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  string
+		ip   string
+		want bool
+	}{
+		{"address", "127.0.0.1", "127.0.0.1", true},
+		{"other address", "127.0.0.1", "127.0.0.2", false},
+		{"prefix", "10.0.0.0/8", "10.1.2.3", true},
+		{"IPv6 address", "::1", "::1", true},
+		{"IPv6 prefix", "2001:db8::/32", "2001:db8::1", true},
+		{"spaces", " 127.0.0.1 , 10.0.0.0/8 ", "10.1.2.3", true},
+		{"empty list", "", "127.0.0.1", false},
+		{"empty items", ",127.0.0.1,,", "127.0.0.1", true},
+		{"invalid client IP", "0.0.0.0/0", "localhost", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NewAllowIPList("TEST_ALLOW_IP", test.ips).Check(test.ip); got != test.want {
+				t.Errorf("Check(%s) = %v, want %v", test.ip, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package service_geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/mmdb"
+	"gopkg.in/yaml.v2"
+)
+
+// databases are the MaxMind DB files and the rules in use, swapped atomically
+// on reload.
+type databases struct {
+	country *mmdb.Reader // nil when GEOIP_COUNTRY_DB is empty
+	asn     *mmdb.Reader // nil when GEOIP_ASN_DB is empty
+	rules   []service.GeoRule
+}
+
+// GeoIP locates the client IPs with GeoLite2 Country and ASN databases and
+// restricts the countries and autonomous systems by path prefix. The files
+// are reloaded when they change.
+type GeoIP struct {
+	config  *config.Config
+	current atomic.Pointer[databases]
+
+	// serializes reloads and guards the fingerprint
+	mu          sync.Mutex
+	fingerprint string
+}
+
+func NewGeoIP(config *config.Config) service.GeoIPInterface {
+	g := &GeoIP{config: config}
+
+	// there are no previous databases to fall back to on startup
+	current, err := g.load(&databases{})
+	if err != nil {
+		logger.Logger("[fatal] Fail to load the GeoIP databases", err.Error()).Fatal()
+	}
+	g.current.Store(current)
+	g.fingerprint = g.filesFingerprint()
+
+	g.watch()
+
+	return g
+}
+
+// Lookup returns the country and the autonomous system of the IP.
+func (g *GeoIP) Lookup(ip string) service.GeoInfo {
+	var info service.GeoInfo
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return info
+	}
+
+	current := g.current.Load()
+	if current.country != nil {
+		record, err := current.country.Lookup(addr)
+		if err != nil {
+			logger.Logger("[warn] Fail to look up the country", ip, err.Error()).Warn()
+		}
+		info.Country, _ = field(record, "country", "iso_code").(string)
+		if info.Country == "" {
+			// anonymous proxies and satellite providers have no country of their own
+			info.Country, _ = field(record, "registered_country", "iso_code").(string)
+		}
+	}
+	if current.asn != nil {
+		record, err := current.asn.Lookup(addr)
+		if err != nil {
+			logger.Logger("[warn] Fail to look up the ASN", ip, err.Error()).Warn()
+		}
+		asn, _ := field(record, "autonomous_system_number").(uint64)
+		info.ASN = uint(asn)
+		info.Organization, _ = field(record, "autonomous_system_organization").(string)
+	}
+
+	return info
+}
+
+// field returns the value of the nested map keys of a record.
+func field(record any, keys ...string) any {
+	for _, key := range keys {
+		fields, ok := record.(map[string]any)
+		if !ok {
+			return nil
+		}
+		record = fields[key]
+	}
+	return record
+}
+
+// Allowed applies the rule of the longest path prefix matching the path.
+func (g *GeoIP) Allowed(path string, info service.GeoInfo) (bool, string) {
+	rules := g.current.Load().rules
+	var rule *service.GeoRule
+	for i, candidate := range rules {
+		if strings.HasPrefix(path, candidate.PathPrefix) && (rule == nil || len(candidate.PathPrefix) > len(rule.PathPrefix)) {
+			rule = &rules[i]
+		}
+	}
+	if rule == nil {
+		return true, ""
+	}
+
+	if info.Country != "" && slices.Contains(rule.DenyCountries, info.Country) {
+		return false, "country " + info.Country + " denied"
+	}
+	if info.ASN != 0 && slices.Contains(rule.DenyASNs, info.ASN) {
+		return false, fmt.Sprintf("AS%d denied", info.ASN)
+	}
+
+	if len(rule.AllowCountries) == 0 && len(rule.AllowASNs) == 0 {
+		return true, ""
+	}
+	if info.Country != "" && slices.Contains(rule.AllowCountries, info.Country) {
+		return true, ""
+	}
+	if info.ASN != 0 && slices.Contains(rule.AllowASNs, info.ASN) {
+		return true, ""
+	}
+	return false, fmt.Sprintf("country %q and AS%d not allowed", info.Country, info.ASN)
+}
+
+// Reload reads the databases and the rules again, a file that cannot be read
+// keeps the previous version.
+func (g *GeoIP) Reload() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.fingerprint = g.filesFingerprint()
+	current, err := g.load(g.current.Load())
+	if err != nil {
+		logger.Logger("[error] GeoIP files rejected, previous files stay active", err.Error()).Error()
+	}
+	g.current.Store(current)
+}
+
+// load reads the files over previous, it returns the files loaded before the
+// first error.
+func (g *GeoIP) load(previous *databases) (*databases, error) {
+	current := *previous
+
+	if g.config.GEOIP_COUNTRY_DB != "" {
+		reader, err := mmdb.Open(g.config.GEOIP_COUNTRY_DB)
+		if err != nil {
+			return &current, fmt.Errorf("error reading %s: %w", g.config.GEOIP_COUNTRY_DB, err)
+		}
+		current.country = reader
+		logDatabase(g.config.GEOIP_COUNTRY_DB, reader)
+	}
+
+	if g.config.GEOIP_ASN_DB != "" {
+		reader, err := mmdb.Open(g.config.GEOIP_ASN_DB)
+		if err != nil {
+			return &current, fmt.Errorf("error reading %s: %w", g.config.GEOIP_ASN_DB, err)
+		}
+		current.asn = reader
+		logDatabase(g.config.GEOIP_ASN_DB, reader)
+	}
+
+	if g.config.GEOIP_RULES != "" {
+		rules, err := loadRules(g.config.GEOIP_RULES)
+		if err != nil {
+			return &current, err
+		}
+		current.rules = rules
+	}
+
+	return &current, nil
+}
+
+func logDatabase(file string, reader *mmdb.Reader) {
+	logger.Logger(map[string]any{
+		"message": "GeoIP database loaded",
+		"file":    file,
+		"type":    reader.Metadata.DatabaseType,
+		"built":   time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format(time.DateOnly),
+	}).Info()
+}
+
+func loadRules(filename string) ([]service.GeoRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GeoIP rules file: %w", err)
+	}
+
+	var config service.GeoRules
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling GeoIP rules: %w", err)
+	}
+
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.PathPrefix == "" {
+			return nil, fmt.Errorf("error in GeoIP rule %d %q: path_prefix is required", i+1, rule.Description)
+		}
+		// the databases use upper case ISO codes
+		for j := range rule.AllowCountries {
+			rule.AllowCountries[j] = strings.ToUpper(rule.AllowCountries[j])
+		}
+		for j := range rule.DenyCountries {
+			rule.DenyCountries[j] = strings.ToUpper(rule.DenyCountries[j])
+		}
+	}
+
+	return config.Rules, nil
+}
+
+// watch reloads the files on SIGHUP and when a file changes.
+func (g *GeoIP) watch() {
+	interval := time.Duration(g.config.GEOIP_RELOAD_INTERVAL) * time.Second
+	filewatch.Watch("GeoIP files", interval, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.fingerprint != g.filesFingerprint()
+	}, g.Reload)
+}
+
+// filesFingerprint summarizes the size and modification time of the files.
+func (g *GeoIP) filesFingerprint() string {
+	return filewatch.Fingerprint(g.config.GEOIP_COUNTRY_DB, g.config.GEOIP_ASN_DB, g.config.GEOIP_RULES)
+}
@@ -0,0 +1,251 @@
+package service_ip_reputation
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/iptrie"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Actions of a list.
+const (
+	ActionBlock     = "block"
+	ActionChallenge = "challenge"
+	ActionScore     = "score"
+)
+
+// IPReputation matches the client IPs against blocklist files, FireHOL and
+// Spamhaus DROP style lists of addresses and CIDR prefixes or Tor exit lists.
+// The files are reloaded when they change.
+type IPReputation struct {
+	config *config.Config
+	lists  []service.IPList
+
+	// prefixes of every list by index, swapped atomically on reload
+	prefixes atomic.Pointer[[]*iptrie.Trie]
+	// serializes reloads and guards the fingerprint
+	mu          sync.Mutex
+	fingerprint string
+}
+
+func NewIPReputation(config *config.Config) service.IPReputationInterface {
+	lists, err := parseLists(config.IP_REPUTATION_LISTS, config.IP_REPUTATION_SCORE)
+	if err != nil {
+		logger.Logger("[fatal] Invalid IP_REPUTATION_LISTS", err.Error()).Fatal()
+	}
+
+	r := &IPReputation{
+		config: config,
+		lists:  lists,
+	}
+	r.Reload()
+
+	r.watch()
+
+	return r
+}
+
+// parseLists reads a comma separated list of file[:name=x][:action=y][:score=n] entries.
+func parseLists(value string, defaultScore int) ([]service.IPList, error) {
+	var lists []service.IPList
+	for _, item := range strings.Split(value, ",") {
+		options := strings.Split(strings.TrimSpace(item), ":")
+		if options[0] == "" {
+			continue
+		}
+
+		list := service.IPList{
+			Name:   strings.TrimSuffix(filepath.Base(options[0]), filepath.Ext(options[0])),
+			File:   options[0],
+			Action: ActionBlock,
+			Score:  defaultScore,
+		}
+		for _, option := range options[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "name":
+				list.Name = value
+			case "action":
+				switch value {
+				case ActionBlock, ActionChallenge, ActionScore:
+					list.Action = value
+				default:
+					return nil, fmt.Errorf("invalid action %q of %s, expected block, challenge or score", value, options[0])
+				}
+			case "score":
+				score, err := strconv.Atoi(value)
+				if err != nil || score < 0 {
+					return nil, fmt.Errorf("invalid score %q of %s", value, options[0])
+				}
+				list.Score = score
+			default:
+				return nil, fmt.Errorf("unknown option %q of %s", key, options[0])
+			}
+		}
+
+		lists = append(lists, list)
+	}
+
+	return lists, nil
+}
+
+// Lookup returns the lists holding the IP.
+func (r *IPReputation) Lookup(ip string) []service.IPList {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+
+	var matched []service.IPList
+	for i, prefixes := range *r.prefixes.Load() {
+		if prefixes.Contains(addr) {
+			matched = append(matched, r.lists[i])
+		}
+	}
+	return matched
+}
+
+// Lists returns the configured lists and the number of prefixes loaded.
+func (r *IPReputation) Lists() []service.IPList {
+	lists := make([]service.IPList, len(r.lists))
+	for i, prefixes := range *r.prefixes.Load() {
+		lists[i] = r.lists[i]
+		lists[i].Prefixes = prefixes.Len()
+	}
+	return lists
+}
+
+// Reload reads the list files again. A file that cannot be read keeps its
+// previous prefixes, feeds are often replaced while they are downloaded.
+func (r *IPReputation) Reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fingerprint = r.filesFingerprint()
+
+	var previous []*iptrie.Trie
+	if current := r.prefixes.Load(); current != nil {
+		previous = *current
+	}
+
+	loaded := make([]*iptrie.Trie, len(r.lists))
+	for i, list := range r.lists {
+		prefixes, invalid, err := loadList(list.File)
+		if err != nil {
+			logger.Logger("[warn] Fail to load the IP list, previous prefixes stay active", list.Name, err.Error()).Warn()
+			if previous != nil {
+				loaded[i] = previous[i]
+			} else {
+				loaded[i] = &iptrie.Trie{}
+			}
+			continue
+		}
+
+		if invalid > 0 {
+			logger.Logger("[warn] Invalid lines skipped in the IP list", list.Name, invalid).Warn()
+		}
+		logger.Logger(map[string]any{
+			"message":  "IP list loaded",
+			"list":     list.Name,
+			"file":     list.File,
+			"action":   list.Action,
+			"prefixes": prefixes.Len(),
+		}).Info()
+		loaded[i] = prefixes
+	}
+
+	r.prefixes.Store(&loaded)
+}
+
+// loadList reads a list file, one address or CIDR prefix per line. Comments
+// start with # or ; and the Tor exit-addresses format is understood too.
+func loadList(file string) (*iptrie.Trie, int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	prefixes := &iptrie.Trie{}
+	invalid := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		value := fields[0]
+		switch value {
+		case "ExitNode", "Published", "LastStatus":
+			// the other lines of the Tor exit-addresses format
+			continue
+		case "ExitAddress":
+			if len(fields) < 2 {
+				invalid++
+				continue
+			}
+			value = fields[1]
+		}
+
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			invalid++
+			continue
+		}
+		prefixes.Insert(prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return prefixes, invalid, nil
+}
+
+// parsePrefix parses a CIDR prefix or a single address.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		return netip.ParsePrefix(value)
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// watch reloads the lists on SIGHUP and when a list file changes.
+func (r *IPReputation) watch() {
+	interval := time.Duration(r.config.IP_REPUTATION_RELOAD_INTERVAL) * time.Second
+	filewatch.Watch("IP list files", interval, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.fingerprint != r.filesFingerprint()
+	}, r.Reload)
+}
+
+// filesFingerprint summarizes the size and modification time of the list files.
+func (r *IPReputation) filesFingerprint() string {
+	files := make([]string, len(r.lists))
+	for i, list := range r.lists {
+		files[i] = list.File
+	}
+	return filewatch.Fingerprint(files...)
+}
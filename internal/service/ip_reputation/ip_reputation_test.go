@@ -0,0 +1,115 @@
+package service_ip_reputation
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadList(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     string
+		len      int
+		invalid  int
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "FireHOL",
+			list: `#
+# firehol_level1
+#
+0.0.0.0/8
+10.0.0.0/8
+192.0.2.1
+2001:db8::/32
+`,
+			len:      4,
+			contains: []string{"10.1.2.3", "192.0.2.1", "::ffff:10.1.2.3", "2001:db8::1"},
+			excludes: []string{"192.0.2.2", "2001:db9::1"},
+		},
+		{
+			name: "Spamhaus DROP",
+			list: `; Spamhaus DROP List 2024/01/01
+; Last-Modified: Mon, 01 Jan 2024 00:00:00 GMT
+198.51.100.0/24 ; SBL000001
+203.0.113.0/24 ; SBL000002
+`,
+			len:      2,
+			contains: []string{"198.51.100.7", "203.0.113.200"},
+			excludes: []string{"198.51.101.7"},
+		},
+		{
+			name: "Tor exit addresses",
+			list: `ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E
+Published 2024-01-01 00:00:00
+LastStatus 2024-01-01 01:00:00
+ExitAddress 192.0.2.10 2024-01-01 01:10:00
+ExitNode 0111BA9B604669E636FFD5B503F382A4B7AD6E80
+Published 2024-01-01 00:00:00
+LastStatus 2024-01-01 01:00:00
+ExitAddress 192.0.2.11 2024-01-01 01:10:00
+ExitAddress 2001:db8::11 2024-01-01 01:20:00
+`,
+			len:      3,
+			contains: []string{"192.0.2.10", "192.0.2.11", "2001:db8::11"},
+			excludes: []string{"192.0.2.12"},
+		},
+		{
+			name: "invalid lines",
+			list: `10.0.0.0/8
+ExitAddress
+not-an-ip
+10.0.0.0/33
+300.0.0.1
+192.0.2.1 # trailing comment
+`,
+			len:      2,
+			invalid:  4,
+			contains: []string{"10.0.0.1", "192.0.2.1"},
+		},
+		{
+			name:     "covered prefixes",
+			list:     "10.1.0.0/16\n10.1.2.3\n10.0.0.0/8\n",
+			len:      1,
+			contains: []string{"10.200.0.1"},
+		},
+		{
+			name: "empty",
+			list: "\n# nothing\n;\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "list.txt")
+			if err := os.WriteFile(file, []byte(test.list), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			prefixes, invalid, err := loadList(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefixes.Len() != test.len || invalid != test.invalid {
+				t.Errorf("loadList = %d prefixes, %d invalid, want %d and %d", prefixes.Len(), invalid, test.len, test.invalid)
+			}
+			for _, addr := range test.contains {
+				if !prefixes.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("Contains(%s) = false, want true", addr)
+				}
+			}
+			for _, addr := range test.excludes {
+				if prefixes.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("Contains(%s) = true, want false", addr)
+				}
+			}
+		})
+	}
+
+	if _, _, err := loadList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loadList of a missing file: no error")
+	}
+}
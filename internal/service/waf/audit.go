@@ -0,0 +1,97 @@
+package service_waf
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditBlocked    = "blocked"
+	AuditDetected   = "detected"   // would have been blocked in detection mode
+	AuditPassed     = "passed"     // below the inbound threshold or logged only
+	AuditChallenged = "challenged" // proof-of-work challenge required, unless already solved
+	AuditMasked     = "masked"     // leaked data masked in the response
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	TransactionID string       `json:"transaction_id"`
+	Timestamp     time.Time    `json:"timestamp"`
+	ClientIP      string       `json:"client_ip"`
+	Country       string       `json:"country,omitempty"`
+	ASN           uint         `json:"asn,omitempty"`
+	Method        string       `json:"method"`
+	Host          string       `json:"host"`
+	URI           string       `json:"uri"`
+	Rules         []string     `json:"rules"`
+	Matches       []auditMatch `json:"matches"`
+	Score         int          `json:"score"`
+	Action        string       `json:"action"`
+}
+
+type auditMatch struct {
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+	Variable string `json:"variable"`
+	Data     string `json:"data"`
+	Score    int    `json:"score"`
+}
+
+// newTransactionID returns a random id identifying a request in the logs.
+func newTransactionID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// audit writes the request to the audit log, requests without any logged match are skipped.
+func (w *WAFService) audit(request *service.Request, response *service.Response, action string) {
+	if w.auditLog == nil {
+		return
+	}
+
+	record := auditRecord{
+		TransactionID: response.TransactionID,
+		Timestamp:     time.Now().UTC(),
+		ClientIP:      request.IP,
+		Country:       request.Geo.Country,
+		ASN:           request.Geo.ASN,
+		Method:        request.Method,
+		Host:          request.Host,
+		URI:           request.Path,
+		Score:         response.Score,
+		Action:        action,
+	}
+
+	rules := make(map[string]bool)
+	for _, match := range response.Matches {
+		if match.NoLog {
+			continue
+		}
+
+		record.Matches = append(record.Matches, auditMatch{
+			Rule:     match.Rule,
+			Message:  match.Message,
+			Variable: match.Variable,
+			Data:     truncate(match.Value, maxLogValueLength),
+			Score:    match.Score,
+		})
+		if !rules[match.Rule] {
+			rules[match.Rule] = true
+			record.Rules = append(record.Rules, match.Rule)
+		}
+	}
+
+	if len(record.Matches) == 0 && action != AuditBlocked {
+		return
+	}
+
+	if err := w.auditLog.Write(record); err != nil {
+		logger.Logger("[error] Fail to write the WAF audit log", err.Error()).Error()
+	}
+}
@@ -0,0 +1,195 @@
+package service_waf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"gopkg.in/yaml.v2"
+)
+
+// conditions select the requests an exclusion or a virtual patch applies to.
+type conditions struct {
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    []string
+	hosts      []string
+}
+
+// exclusion is a compiled service.Exclusion.
+type exclusion struct {
+	conditions
+
+	rules []string
+	tags  []string
+
+	// excluded variables, e.g. ARGS:content or REQUEST_HEADERS:user-agent
+	variables []string
+}
+
+// exclusionCollections maps the collection of a match variable to the
+// exclusion field it is compared with.
+var exclusionCollections = map[string]string{
+	"ARGS":                  "args",
+	"ARGS_NAMES":            "args",
+	"ARGS_GET":              "args",
+	"ARGS_GET_NAMES":        "args",
+	"ARGS_POST":             "args",
+	"ARGS_POST_NAMES":       "args",
+	"FILES":                 "args",
+	"FILES_NAMES":           "args",
+	"REQUEST_HEADERS":       "headers",
+	"REQUEST_HEADERS_NAMES": "headers",
+	"REQUEST_COOKIES":       "cookies",
+	"REQUEST_COOKIES_NAMES": "cookies",
+}
+
+// loadExclusions reads and compiles the exclusions file, no file disables exclusions.
+func loadExclusions(filename string, sources *ruleSources) ([]exclusion, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	data, err := sources.read(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading exclusions file: %w", err)
+	}
+
+	var config service.Exclusions
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling exclusions: %w", err)
+	}
+
+	exclusions := make([]exclusion, 0, len(config.Exclusions))
+	for i, e := range config.Exclusions {
+		compiled, err := compileExclusion(e)
+		if err != nil {
+			return nil, fmt.Errorf("error in exclusion %d %q: %w", i+1, e.Description, err)
+		}
+		exclusions = append(exclusions, compiled)
+	}
+
+	return exclusions, nil
+}
+
+func compileExclusion(e service.Exclusion) (exclusion, error) {
+	conditions, err := compileConditions(e.PathPrefix, e.PathRegex, e.Methods, e.Hosts)
+	if err != nil {
+		return exclusion{}, err
+	}
+
+	compiled := exclusion{
+		conditions: conditions,
+		rules:      e.Rules,
+		tags:       e.Tags,
+	}
+
+	for _, name := range e.Args {
+		compiled.variables = append(compiled.variables, "args:"+name)
+	}
+	// header names are case insensitive
+	for _, name := range e.Headers {
+		compiled.variables = append(compiled.variables, "headers:"+strings.ToLower(name))
+	}
+	for _, name := range e.Cookies {
+		compiled.variables = append(compiled.variables, "cookies:"+name)
+	}
+
+	return compiled, nil
+}
+
+func compileConditions(pathPrefix, pathRegex string, methods, hosts []string) (conditions, error) {
+	compiled := conditions{pathPrefix: pathPrefix}
+
+	if pathRegex != "" {
+		re, err := regexp.Compile(pathRegex)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid path_regex: %w", err)
+		}
+		compiled.pathRegex = re
+	}
+
+	for _, method := range methods {
+		compiled.methods = append(compiled.methods, strings.ToUpper(method))
+	}
+	for _, host := range hosts {
+		compiled.hosts = append(compiled.hosts, strings.ToLower(host))
+	}
+
+	return compiled, nil
+}
+
+// applies reports whether the request matches every condition.
+func (c *conditions) applies(request *service.Request) bool {
+	if !strings.HasPrefix(request.CleanPath, c.pathPrefix) {
+		return false
+	}
+	if c.pathRegex != nil && !c.pathRegex.MatchString(request.CleanPath) {
+		return false
+	}
+	if len(c.methods) > 0 && !slices.Contains(c.methods, strings.ToUpper(request.Method)) {
+		return false
+	}
+	if len(c.hosts) > 0 && !slices.Contains(c.hosts, requestHost(request)) {
+		return false
+	}
+	return true
+}
+
+// excludes reports whether the exclusion removes a match.
+func (e *exclusion) excludes(match service.Match) bool {
+	if len(e.rules) > 0 || len(e.tags) > 0 {
+		byRule := slices.Contains(e.rules, match.Rule)
+		byTag := slices.ContainsFunc(match.Tags, func(tag string) bool {
+			return slices.Contains(e.tags, tag)
+		})
+		if !byRule && !byTag {
+			return false
+		}
+	}
+
+	if len(e.variables) == 0 {
+		return true
+	}
+
+	collection, name, _ := strings.Cut(match.Variable, ":")
+	field, ok := exclusionCollections[collection]
+	if !ok {
+		return false
+	}
+	if field == "headers" {
+		name = strings.ToLower(name)
+	}
+	return slices.Contains(e.variables, field+":"+name)
+}
+
+// exclude removes the matches disabled by the exclusions applying to the request.
+func exclude(exclusions []exclusion, request *service.Request, matches []service.Match) []service.Match {
+	var applying []*exclusion
+	for i := range exclusions {
+		if exclusions[i].applies(request) {
+			applying = append(applying, &exclusions[i])
+		}
+	}
+	if len(applying) == 0 {
+		return matches
+	}
+
+	return slices.DeleteFunc(matches, func(match service.Match) bool {
+		return slices.ContainsFunc(applying, func(e *exclusion) bool {
+			return e.excludes(match)
+		})
+	})
+}
+
+// requestHost returns the lowercased host of the request without the port.
+func requestHost(request *service.Request) string {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,127 @@
+package service_waf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// GraphQL rule ids, every rule blocks on its own.
+const (
+	RuleGraphQLDepth         = "2301"
+	RuleGraphQLAliases       = "2302"
+	RuleGraphQLFields        = "2303"
+	RuleGraphQLIntrospection = "2304"
+	RuleGraphQLInvalid       = "2305"
+)
+
+// graphqlTag categorizes the GraphQL rules for exclusions.
+const graphqlTag = "attack-graphql"
+
+// graphqlLimits are the limits of a GraphQL endpoint, 0 disables a limit.
+type graphqlLimits struct {
+	depth         int
+	aliases       int
+	fields        int
+	introspection bool
+}
+
+// parseGraphQLPaths reads WAF_GRAPHQL_PATHS, a comma separated list of
+// endpoints overriding the default limits with path:depth=20:introspection=allow.
+func parseGraphQLPaths(config *config.Config) (map[string]graphqlLimits, error) {
+	defaults := graphqlLimits{
+		depth:         config.WAF_GRAPHQL_MAX_DEPTH,
+		aliases:       config.WAF_GRAPHQL_MAX_ALIASES,
+		fields:        config.WAF_GRAPHQL_MAX_FIELDS,
+		introspection: config.WAF_GRAPHQL_INTROSPECTION,
+	}
+
+	endpoints := make(map[string]graphqlLimits)
+	for _, item := range splitList(config.WAF_GRAPHQL_PATHS) {
+		options := strings.Split(item, ":")
+		limits := defaults
+
+		for _, option := range options[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			if key == "introspection" {
+				switch value {
+				case "allow":
+					limits.introspection = true
+				case "block":
+					limits.introspection = false
+				default:
+					return nil, fmt.Errorf("invalid introspection %q of %s, expected allow or block", value, options[0])
+				}
+				continue
+			}
+
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("invalid %s %q of %s", key, value, options[0])
+			}
+			switch key {
+			case "depth":
+				limits.depth = limit
+			case "aliases":
+				limits.aliases = limit
+			case "fields":
+				limits.fields = limit
+			default:
+				return nil, fmt.Errorf("unknown GraphQL limit %q of %s", key, options[0])
+			}
+		}
+
+		endpoints[strings.TrimSuffix(options[0], "/")] = limits
+	}
+
+	return endpoints, nil
+}
+
+// detectGraphQL enforces the limits of the endpoint on the parsed GraphQL
+// documents and rejects the requests failing to parse, the literals and
+// variables are inspected by the rule engine.
+func (w *WAFService) detectGraphQL(request *service.Request) []service.Match {
+	// the endpoints are matched like the middleware does, on the clean path
+	limits, ok := w.graphqlEndpoints[strings.TrimSuffix(request.CleanPath, "/")]
+	if !ok {
+		return nil
+	}
+
+	var matches []service.Match
+	violation := func(rule, message, value string) {
+		matches = append(matches, service.Match{
+			Rule:     rule,
+			Message:  message,
+			Variable: "GRAPHQL",
+			Value:    value,
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{graphqlTag},
+		})
+	}
+
+	// the limits can't be checked on a request the WAF can't parse
+	for _, err := range request.GraphQLErrors {
+		violation(RuleGraphQLInvalid, "Invalid GraphQL request", truncate(err, maxProtocolValueLength))
+	}
+
+	for _, document := range request.GraphQL {
+		cost := document.Cost()
+		if limits.depth > 0 && cost.Depth > limits.depth {
+			violation(RuleGraphQLDepth, fmt.Sprintf("GraphQL query deeper than %d", limits.depth), strconv.Itoa(cost.Depth))
+		}
+		if limits.aliases > 0 && cost.Aliases > limits.aliases {
+			violation(RuleGraphQLAliases, fmt.Sprintf("GraphQL query with more than %d aliases", limits.aliases), strconv.Itoa(cost.Aliases))
+		}
+		if limits.fields > 0 && cost.Fields > limits.fields {
+			violation(RuleGraphQLFields, fmt.Sprintf("GraphQL query with more than %d fields", limits.fields), strconv.Itoa(cost.Fields))
+		}
+		if !limits.introspection && cost.Introspection {
+			violation(RuleGraphQLIntrospection, "GraphQL introspection query", "")
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,385 @@
+package service_waf
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/corazawaf/libinjection-go"
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/ahocorasick"
+	"gopkg.in/yaml.v2"
+)
+
+// keywordEngine is the default rule engine, it runs libinjection and the
+// keyword lists from the WAF config file.
+type keywordEngine struct {
+	config    *config.Config
+	detectors []keywordDetector
+
+	// distinct normalization pipelines, a value is normalized once per pipeline
+	pipelines []pipeline
+	// every keyword list compiled into one automaton
+	matcher *ahocorasick.Matcher
+	// detectors owning each pattern of the automaton
+	owners [][]int
+}
+
+// keywordDetector is a rule set with its own normalization pipeline.
+type keywordDetector struct {
+	name       string
+	score      int
+	transforms []string
+	pipeline   int // index in keywordEngine.pipelines
+	// values inspected by the detector, every value but the raw Cookie header when empty
+	targets []targetSelector
+	// detect returns the match message when the normalized value is a threat,
+	// detectors without it are keyword lists matched by the automaton
+	detect   func(value string) (string, bool)
+	keywords []string
+	message  string
+	tags     []string
+}
+
+// targetSelector selects the values of a source, all of them when name is empty.
+type targetSelector struct {
+	source string
+	name   string
+}
+
+// Keyword rule match types.
+const (
+	MatchContains = "contains"
+	MatchPrefix   = "prefix"
+	MatchExact    = "exact"
+	MatchRegex    = "regex"
+)
+
+// Keyword rule actions.
+const (
+	ActionBlock = "block"
+	ActionScore = "score"
+	ActionLog   = "log"
+)
+
+func newKeywordEngine(config *config.Config, keywordsFile string, sources *ruleSources) (*keywordEngine, error) {
+	keywords, err := loadKeywords(keywordsFile, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	engine := &keywordEngine{
+		config: config,
+		detectors: []keywordDetector{
+			{name: DetectorSQLi, score: config.WAF_SCORE_SQLI, tags: []string{"attack-sqli"}, detect: func(value string) (string, bool) {
+				injection, fingerprint := libinjection.IsSQLi(value)
+				return "SQL Injection " + fingerprint, injection
+			}},
+			{name: DetectorXSS, score: config.WAF_SCORE_XSS, tags: []string{"attack-xss"}, detect: func(value string) (string, bool) {
+				return "XSS Attack", libinjection.IsXSS(value)
+			}},
+			{name: DetectorCommandInjection, score: config.WAF_SCORE_COMMAND_INJECTION, keywords: keywords.CommandInjectionKeywords, message: "Command Injection", tags: []string{"attack-rce"}},
+			{name: DetectorPathTraversal, score: config.WAF_SCORE_PATH_TRAVERSAL, keywords: keywords.PathTraversalKeywords, message: "Path Traversal", tags: []string{"attack-lfi"}},
+		},
+	}
+
+	ids := make(map[string]bool)
+	for _, detector := range engine.detectors {
+		ids[detector.name] = true
+	}
+	for _, rule := range keywords.Rules {
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("duplicate rule id %q", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		detector, err := newRuleDetector(config, rule)
+		if err != nil {
+			return nil, fmt.Errorf("error in rule %q: %w", rule.ID, err)
+		}
+		engine.detectors = append(engine.detectors, detector)
+	}
+
+	if err := engine.compile(keywords.Transforms); err != nil {
+		return nil, err
+	}
+
+	return engine, nil
+}
+
+// compile builds the pipelines of the detectors and the keyword automaton.
+func (e *keywordEngine) compile(transforms map[string][]string) error {
+	pipelineIndex := make(map[string]int)
+	patternIndex := make(map[string]int)
+	var patterns []string
+
+	for i := range e.detectors {
+		detector := &e.detectors[i]
+
+		// every detector normalizes values with its own transformations or the
+		// ones configured for its name
+		names := detector.transforms
+		if names == nil {
+			var ok bool
+			if names, ok = transforms[detector.name]; !ok {
+				names = defaultPipeline
+			}
+		}
+		key := strings.Join(names, ",")
+		if index, ok := pipelineIndex[key]; ok {
+			detector.pipeline = index
+		} else {
+			p, err := newPipeline(names, e.config.WAF_DECODE_MAX_DEPTH)
+			if err != nil {
+				return fmt.Errorf("error in %s transforms: %w", detector.name, err)
+			}
+			detector.pipeline = len(e.pipelines)
+			pipelineIndex[key] = detector.pipeline
+			e.pipelines = append(e.pipelines, p)
+		}
+
+		for _, keyword := range detector.keywords {
+			id, ok := patternIndex[keyword]
+			if !ok {
+				id = len(patterns)
+				patternIndex[keyword] = id
+				patterns = append(patterns, keyword)
+				e.owners = append(e.owners, nil)
+			}
+			e.owners[id] = append(e.owners[id], i)
+		}
+	}
+
+	e.matcher = ahocorasick.New(patterns)
+
+	return nil
+}
+
+// newRuleDetector compiles a rule of the rules section.
+func newRuleDetector(config *config.Config, rule service.KeywordRule) (keywordDetector, error) {
+	if rule.ID == "" {
+		return keywordDetector{}, fmt.Errorf("missing id")
+	}
+	if len(rule.Patterns) == 0 {
+		return keywordDetector{}, fmt.Errorf("missing patterns")
+	}
+
+	detector := keywordDetector{
+		name:       rule.ID,
+		transforms: rule.Transforms,
+		message:    rule.Description,
+		tags:       rule.Tags,
+	}
+	if detector.message == "" {
+		detector.message = rule.ID
+	}
+
+	severity := rule.Severity
+	if severity == "" {
+		severity = "warning"
+	}
+	level, err := parseSeverity(severity)
+	if err != nil {
+		return detector, err
+	}
+	detector.score = severityScores[level]
+
+	switch strings.ToLower(rule.Action) {
+	case ActionScore, "":
+	case ActionBlock:
+		// like a SecRule deny, the rule is enough to reach the inbound threshold
+		detector.score = max(detector.score, config.WAF_INBOUND_THRESHOLD)
+	case ActionLog:
+		detector.score = 0
+	default:
+		return detector, fmt.Errorf("invalid action %q", rule.Action)
+	}
+
+	for _, spec := range rule.Targets {
+		selector, err := parseTargetSelector(spec)
+		if err != nil {
+			return detector, err
+		}
+		detector.targets = append(detector.targets, selector)
+	}
+
+	patterns, message := rule.Patterns, detector.message
+	switch strings.ToLower(rule.Match) {
+	case MatchContains, "":
+		detector.keywords = patterns
+	case MatchPrefix:
+		detector.detect = func(value string) (string, bool) {
+			for _, pattern := range patterns {
+				if strings.HasPrefix(value, pattern) {
+					return message + " " + pattern, true
+				}
+			}
+			return "", false
+		}
+	case MatchExact:
+		detector.detect = func(value string) (string, bool) {
+			if slices.Contains(patterns, value) {
+				return message + " " + value, true
+			}
+			return "", false
+		}
+	case MatchRegex:
+		regexps := make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return detector, fmt.Errorf("invalid regex %q: %w", pattern, err)
+			}
+			regexps = append(regexps, re)
+		}
+		detector.detect = func(value string) (string, bool) {
+			for _, re := range regexps {
+				if re.MatchString(value) {
+					return message, true
+				}
+			}
+			return "", false
+		}
+	default:
+		return detector, fmt.Errorf("invalid match type %q", rule.Match)
+	}
+
+	return detector, nil
+}
+
+// parseTargetSelector parses a rule target like "headers" or "header:User-Agent".
+func parseTargetSelector(spec string) (targetSelector, error) {
+	source, name, _ := strings.Cut(strings.TrimSpace(spec), ":")
+
+	switch strings.ToLower(source) {
+	case "path":
+		if name != "" {
+			return targetSelector{}, fmt.Errorf("invalid target %q, path has no name", spec)
+		}
+		return targetSelector{source: sourcePath}, nil
+	case "query":
+		return targetSelector{source: sourceQuery, name: name}, nil
+	case "header", "headers":
+		return targetSelector{source: sourceHeader, name: name}, nil
+	case "cookie", "cookies":
+		return targetSelector{source: sourceCookie, name: name}, nil
+	case "body":
+		return targetSelector{source: sourceBody, name: name}, nil
+	}
+
+	return targetSelector{}, fmt.Errorf("invalid target %q", spec)
+}
+
+// inspects reports whether the detector inspects a target.
+func (d *keywordDetector) inspects(t target) bool {
+	if d.targets == nil {
+		// the Cookie header is inspected cookie by cookie
+		return t.source != sourceHeader || !strings.EqualFold(t.name, "Cookie")
+	}
+
+	for _, selector := range d.targets {
+		if selector.source != t.source {
+			continue
+		}
+		// header names are case insensitive
+		if selector.name == "" || selector.name == t.name ||
+			(t.source == sourceHeader && strings.EqualFold(selector.name, t.name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadKeywords(filename string, sources *ruleSources) (service.Keywords, error) {
+	var keywords service.Keywords
+
+	data, err := sources.read(filename)
+	if err != nil {
+		return keywords, fmt.Errorf("error reading keywords file: %w", err)
+	}
+
+	// strict, a typo in a key must not silently disable a rule set
+	err = yaml.UnmarshalStrict(data, &keywords)
+	if err != nil {
+		return keywords, fmt.Errorf("error unmarshalling keywords: %w", err)
+	}
+
+	return keywords, nil
+}
+
+func (e *keywordEngine) size() int {
+	return len(e.detectors)
+}
+
+func (e *keywordEngine) detectHeaders(request *service.Request) []service.Match {
+	return e.detect(headerTargets(request))
+}
+
+func (e *keywordEngine) detectBody(request *service.Request) []service.Match {
+	return e.detect(bodyTargets(request))
+}
+
+// detect runs every detector on the normalized value of every target, the
+// keyword lists are scanned once per distinct normalization.
+func (e *keywordEngine) detect(targets []target) []service.Match {
+	var matches []service.Match
+	values := make([]string, len(e.pipelines))
+	normalized := make([]bool, len(e.pipelines))
+	found := make([][]int, len(e.pipelines))
+	scanned := make([]bool, len(e.pipelines))
+
+	for _, t := range targets {
+		clear(normalized)
+		clear(scanned)
+
+		for i, detector := range e.detectors {
+			if !detector.inspects(t) {
+				continue
+			}
+
+			if !normalized[detector.pipeline] {
+				values[detector.pipeline] = e.pipelines[detector.pipeline].apply(t.value)
+				normalized[detector.pipeline] = true
+			}
+			value := values[detector.pipeline]
+
+			var message string
+			var ok bool
+			if detector.detect != nil {
+				message, ok = detector.detect(value)
+			} else {
+				if !scanned[detector.pipeline] {
+					found[detector.pipeline] = e.matcher.FindAll(value)
+					scanned[detector.pipeline] = true
+				}
+				message, ok = e.keywordMessage(i, found[detector.pipeline])
+			}
+			if !ok {
+				continue
+			}
+
+			matches = append(matches, service.Match{
+				Rule:     detector.name,
+				Message:  message,
+				Variable: t.variable,
+				Value:    t.value,
+				Score:    detector.score,
+				Tags:     detector.tags,
+			})
+		}
+	}
+
+	return matches
+}
+
+// keywordMessage returns the message of the first pattern found that belongs to the detector.
+func (e *keywordEngine) keywordMessage(detector int, found []int) (string, bool) {
+	for _, id := range found {
+		if slices.Contains(e.owners[id], detector) {
+			return e.detectors[detector].message + " " + e.matcher.Pattern(id), true
+		}
+	}
+	return "", false
+}
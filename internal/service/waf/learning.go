@@ -0,0 +1,690 @@
+package service_waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/openapi"
+	"gopkg.in/yaml.v2"
+)
+
+// Limits of the learning mode, the traffic beyond them is not recorded.
+const (
+	maxLearnedOperations = 1000
+	maxLearnedExclusions = 1000
+	maxLearnedParameters = 64
+	maxLearnedVariables  = 32
+	maxLearnedDepth      = 16
+	// values with more distinct symbols are free text, they get no pattern
+	maxPatternSymbols = 12
+)
+
+// Character classes of the learned values.
+const (
+	classDigit = 1 << iota
+	classLower
+	classUpper
+	classSpace
+	classUnicode
+)
+
+// hexIdentifier matches the hashes and object ids used as path segments.
+var hexIdentifier = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+
+// learner records the passed requests during the learning window, then
+// proposes an OpenAPI spec per host and the exclusions of the rules that
+// matched them.
+type learner struct {
+	dir string
+
+	mu         sync.Mutex
+	started    time.Time
+	done       bool
+	requests   int
+	operations map[operationKey]*learnedOperation
+	exclusions map[exclusionKey]*learnedExclusion
+}
+
+type operationKey struct {
+	host, template, method string
+}
+
+type exclusionKey struct {
+	operationKey
+	rule string
+}
+
+// learnedOperation is the traffic observed on a method of a path template.
+type learnedOperation struct {
+	count      int
+	pathParams []string
+	path       map[string]*parameterProfile
+	query      map[string]*parameterProfile
+	bodies     int
+	media      map[string]*learnedMedia
+}
+
+// learnedMedia is the bodies observed with a content type.
+type learnedMedia struct {
+	count int
+	json  *jsonProfile
+	form  map[string]*parameterProfile
+	open  bool // more form fields than recorded
+}
+
+// learnedExclusion is a rule matching the passed requests of an operation.
+type learnedExclusion struct {
+	count     int
+	message   string
+	variables map[string]bool // args:name, headers:name or cookies:name
+	whole     bool            // matched a variable the exclusions cannot name
+}
+
+type parameterProfile struct {
+	present  int
+	repeated bool
+	values   valueProfile
+}
+
+// valueProfile sums up the lengths, types and characters of the values.
+type valueProfile struct {
+	count      int
+	minLength  int
+	maxLength  int
+	notInteger bool
+	notNumber  bool
+	notBoolean bool
+	notUUID    bool
+	classes    uint8
+	symbols    map[rune]bool
+}
+
+// jsonProfile sums up the values observed at a location of JSON bodies.
+type jsonProfile struct {
+	types      map[string]bool
+	strings    valueProfile
+	objects    int
+	present    int // times present as a property of the parent object
+	properties map[string]*jsonProfile
+	open       bool // more properties than recorded
+	items      *jsonProfile
+}
+
+func newLearner(dir string) *learner {
+	return &learner{
+		dir:        dir,
+		started:    time.Now(),
+		operations: make(map[operationKey]*learnedOperation),
+		exclusions: make(map[exclusionKey]*learnedExclusion),
+	}
+}
+
+// record learns a passed request, the rules it matched are false positives.
+func (l *learner) record(request *service.Request, matches []service.Match) {
+	// the specs and the exclusions are matched on the decoded and cleaned path
+	template, names, values := pathTemplate(request.CleanPath)
+	key := operationKey{host: requestHost(request), template: template, method: request.Method}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return
+	}
+	l.requests++
+
+	for _, match := range matches {
+		if !match.NoLog {
+			l.recordMatch(exclusionKey{operationKey: key, rule: match.Rule}, match)
+		}
+	}
+
+	operation, ok := l.operations[key]
+	if !ok {
+		if len(l.operations) >= maxLearnedOperations {
+			return
+		}
+		operation = &learnedOperation{
+			pathParams: names,
+			path:       make(map[string]*parameterProfile),
+			query:      make(map[string]*parameterProfile),
+			media:      make(map[string]*learnedMedia),
+		}
+		l.operations[key] = operation
+	}
+	operation.count++
+
+	for i, name := range names {
+		addParameter(operation.path, name, []string{values[i]})
+	}
+	addParameters(operation.query, request.Args, service.ArgsGet)
+
+	if len(request.Body) == 0 {
+		return
+	}
+	operation.bodies++
+
+	mediaType := "application/octet-stream"
+	if contentType := headerValue(request, "Content-Type"); contentType != "" {
+		if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+			mediaType = parsed
+		}
+	}
+	media, ok := operation.media[mediaType]
+	if !ok {
+		media = &learnedMedia{form: make(map[string]*parameterProfile)}
+		operation.media[mediaType] = media
+	}
+	media.count++
+
+	switch request.BodyProcessor {
+	case service.BodyJSON:
+		decoder := json.NewDecoder(bytes.NewReader(request.Body))
+		decoder.UseNumber()
+		var document any
+		if decoder.Decode(&document) == nil {
+			if media.json == nil {
+				media.json = &jsonProfile{}
+			}
+			media.json.add(document, 0)
+		}
+	case service.BodyURLEncoded, service.BodyMultipart:
+		media.open = !addParameters(media.form, request.Args, service.ArgsPost) || media.open
+	}
+}
+
+func (l *learner) recordMatch(key exclusionKey, match service.Match) {
+	exclusion, ok := l.exclusions[key]
+	if !ok {
+		if len(l.exclusions) >= maxLearnedExclusions {
+			return
+		}
+		exclusion = &learnedExclusion{message: match.Message, variables: make(map[string]bool)}
+		l.exclusions[key] = exclusion
+	}
+	exclusion.count++
+
+	collection, name, _ := strings.Cut(match.Variable, ":")
+	field, ok := exclusionCollections[collection]
+	if !ok || name == "" || len(exclusion.variables) >= maxLearnedVariables {
+		exclusion.whole = true
+		return
+	}
+	exclusion.variables[field+":"+name] = true
+}
+
+// addParameters learns the arguments of a source, it reports false when some
+// were left out.
+func addParameters(profiles map[string]*parameterProfile, args []service.Argument, source string) bool {
+	values := make(map[string][]string)
+	var names []string
+	for _, arg := range args {
+		if arg.Source != source {
+			continue
+		}
+		if _, ok := values[arg.Name]; !ok {
+			names = append(names, arg.Name)
+		}
+		values[arg.Name] = append(values[arg.Name], arg.Value)
+	}
+
+	complete := true
+	for _, name := range names {
+		if !addParameter(profiles, name, values[name]) {
+			complete = false
+		}
+	}
+	return complete
+}
+
+func addParameter(profiles map[string]*parameterProfile, name string, values []string) bool {
+	profile, ok := profiles[name]
+	if !ok {
+		if len(profiles) >= maxLearnedParameters {
+			return false
+		}
+		profile = &parameterProfile{}
+		profiles[name] = profile
+	}
+
+	profile.present++
+	profile.repeated = profile.repeated || len(values) > 1
+	for _, value := range values {
+		profile.values.add(value)
+	}
+	return true
+}
+
+// pathTemplate replaces the path segments looking like identifiers with
+// parameters named id, id2, ...
+func pathTemplate(path string) (string, []string, []string) {
+	segments := strings.Split(path, "/")
+	var names, values []string
+	for i, segment := range segments {
+		if !patchTypes["integer"].MatchString(segment) && !patchTypes["uuid"].MatchString(segment) && !hexIdentifier.MatchString(segment) {
+			continue
+		}
+
+		name := "id"
+		if len(names) > 0 {
+			name = fmt.Sprintf("id%d", len(names)+1)
+		}
+		names = append(names, name)
+		values = append(values, segment)
+		segments[i] = "{" + name + "}"
+	}
+	return strings.Join(segments, "/"), names, values
+}
+
+// templateRegex matches the paths of a template, for the exclusions.
+func templateRegex(template string) string {
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") {
+			segments[i] = "[^/]+"
+		} else {
+			segments[i] = regexp.QuoteMeta(segment)
+		}
+	}
+	return "^" + strings.Join(segments, "/") + "$"
+}
+
+func (p *valueProfile) add(value string) {
+	length := utf8.RuneCountInString(value)
+	if p.count == 0 || length < p.minLength {
+		p.minLength = length
+	}
+	p.maxLength = max(p.maxLength, length)
+	p.count++
+
+	p.notInteger = p.notInteger || !patchTypes["integer"].MatchString(value)
+	p.notNumber = p.notNumber || !patchTypes["number"].MatchString(value)
+	p.notBoolean = p.notBoolean || (value != "true" && value != "false")
+	p.notUUID = p.notUUID || !patchTypes["uuid"].MatchString(value)
+
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			p.classes |= classDigit
+		case r >= 'a' && r <= 'z':
+			p.classes |= classLower
+		case r >= 'A' && r <= 'Z':
+			p.classes |= classUpper
+		case r == ' ':
+			p.classes |= classSpace
+		case r >= utf8.RuneSelf:
+			p.classes |= classUnicode
+		default:
+			if p.symbols == nil {
+				p.symbols = make(map[rune]bool)
+			}
+			p.symbols[r] = true
+		}
+	}
+}
+
+// schema proposes the narrowest type of the parameter values.
+func (p *valueProfile) schema() *openapi.Schema {
+	switch {
+	case !p.notBoolean:
+		return &openapi.Schema{Type: "boolean"}
+	case !p.notInteger:
+		return &openapi.Schema{Type: "integer"}
+	case !p.notNumber:
+		return &openapi.Schema{Type: "number"}
+	}
+	schema := &openapi.Schema{Type: "string"}
+	p.constrain(schema)
+	return schema
+}
+
+// constrain sets the length and the pattern of the string values.
+func (p *valueProfile) constrain(schema *openapi.Schema) {
+	if !p.notUUID {
+		schema.Pattern = patchTypes["uuid"].String()
+		return
+	}
+
+	if p.minLength > 0 {
+		schema.MinLength = &p.minLength
+	}
+	schema.MaxLength = &p.maxLength
+	schema.Pattern = p.pattern()
+}
+
+// pattern returns a character class of the observed characters.
+func (p *valueProfile) pattern() string {
+	if len(p.symbols) > maxPatternSymbols || (p.classes == 0 && len(p.symbols) == 0) {
+		return ""
+	}
+
+	var class strings.Builder
+	for _, c := range []struct {
+		class uint8
+		chars string
+	}{
+		{classDigit, "0-9"},
+		{classLower, "a-z"},
+		{classUpper, "A-Z"},
+		{classSpace, " "},
+		{classUnicode, `\x{80}-\x{10FFFF}`},
+	} {
+		if p.classes&c.class != 0 {
+			class.WriteString(c.chars)
+		}
+	}
+
+	symbols := make([]rune, 0, len(p.symbols))
+	for r := range p.symbols {
+		symbols = append(symbols, r)
+	}
+	slices.Sort(symbols)
+	for _, r := range symbols {
+		switch {
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&class, `\x{%x}`, r)
+		case strings.ContainsRune(`\]^-[`, r):
+			class.WriteString(`\` + string(r))
+		default:
+			class.WriteRune(r)
+		}
+	}
+	return "^[" + class.String() + "]*$"
+}
+
+func (p *jsonProfile) add(value any, depth int) {
+	if p.types == nil {
+		p.types = make(map[string]bool)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		p.types["null"] = true
+	case bool:
+		p.types["boolean"] = true
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			p.types["number"] = true
+		} else {
+			p.types["integer"] = true
+		}
+	case string:
+		p.types["string"] = true
+		p.strings.add(v)
+	case []any:
+		p.types["array"] = true
+		if depth >= maxLearnedDepth {
+			return
+		}
+		for _, item := range v {
+			if p.items == nil {
+				p.items = &jsonProfile{}
+			}
+			p.items.add(item, depth+1)
+		}
+	case map[string]any:
+		p.types["object"] = true
+		p.objects++
+		if depth >= maxLearnedDepth {
+			p.open = true
+			return
+		}
+		if p.properties == nil {
+			p.properties = make(map[string]*jsonProfile)
+		}
+		for name, item := range v {
+			property, ok := p.properties[name]
+			if !ok {
+				if len(p.properties) >= maxLearnedParameters {
+					p.open = true
+					continue
+				}
+				property = &jsonProfile{}
+				p.properties[name] = property
+			}
+			property.present++
+			property.add(item, depth+1)
+		}
+	}
+}
+
+func (p *jsonProfile) schema() *openapi.Schema {
+	schema := &openapi.Schema{}
+
+	var types []string
+	for _, name := range []string{"object", "array", "string", "number", "integer", "boolean"} {
+		if p.types[name] && (name != "integer" || !p.types["number"]) {
+			types = append(types, name)
+		}
+	}
+	switch {
+	case len(types) == 0 && p.types["null"]:
+		schema.Type = "null"
+	case len(types) == 1:
+		schema.Type = types[0]
+		schema.Nullable = p.types["null"]
+	case len(types) > 1:
+		if p.types["null"] {
+			types = append(types, "null")
+		}
+		schema.Type = types
+	}
+
+	if p.types["string"] {
+		p.strings.constrain(schema)
+	}
+	if p.items != nil {
+		schema.Items = p.items.schema()
+	}
+	if p.types["object"] {
+		schema.Properties = make(map[string]*openapi.Schema)
+		for name, property := range p.properties {
+			schema.Properties[name] = property.schema()
+			if property.present == p.objects {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		slices.Sort(schema.Required)
+		if !p.open {
+			schema.AdditionalProperties = &openapi.Additional{}
+		}
+	}
+	return schema
+}
+
+func (p *parameterProfile) schema() *openapi.Schema {
+	if p.repeated {
+		return &openapi.Schema{Type: "array", Items: p.values.schema()}
+	}
+	return p.values.schema()
+}
+
+// operation proposes the OpenAPI operation of the observed traffic.
+func (o *learnedOperation) operation() *openapi.Operation {
+	operation := &openapi.Operation{}
+	for _, name := range o.pathParams {
+		operation.Parameters = append(operation.Parameters, &openapi.Parameter{
+			Name: name, In: "path", Required: true, Schema: o.path[name].schema(),
+		})
+	}
+
+	names := make([]string, 0, len(o.query))
+	for name := range o.query {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		profile := o.query[name]
+		operation.Parameters = append(operation.Parameters, &openapi.Parameter{
+			Name: name, In: "query", Required: profile.present == o.count, Schema: profile.schema(),
+		})
+	}
+
+	if o.bodies == 0 {
+		return operation
+	}
+	operation.RequestBody = &openapi.RequestBody{
+		Required: o.bodies == o.count,
+		Content:  make(map[string]*openapi.MediaType),
+	}
+	for mediaType, media := range o.media {
+		content := &openapi.MediaType{}
+		switch {
+		case media.json != nil:
+			content.Schema = media.json.schema()
+		case len(media.form) > 0:
+			content.Schema = &openapi.Schema{Type: "object", Properties: make(map[string]*openapi.Schema)}
+			for name, profile := range media.form {
+				content.Schema.Properties[name] = profile.schema()
+				if profile.present == media.count {
+					content.Schema.Required = append(content.Schema.Required, name)
+				}
+			}
+			slices.Sort(content.Schema.Required)
+			if !media.open {
+				content.Schema.AdditionalProperties = &openapi.Additional{}
+			}
+		}
+		operation.RequestBody.Content[mediaType] = content
+	}
+	return operation
+}
+
+// finish stops the learning and writes the proposed specs and exclusions.
+func (l *learner) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done = true
+
+	specs, exclusions, err := l.write()
+	if err != nil {
+		logger.Logger("[error] Fail to write the learned rules", err.Error()).Error()
+		return
+	}
+
+	logger.Logger(map[string]any{
+		"message":    "Learning finished, review the proposed rules before loading them",
+		"requests":   l.requests,
+		"specs":      specs,
+		"exclusions": exclusions,
+	}).Info()
+}
+
+// write writes an OpenAPI spec per host and the exclusions file, it returns
+// the WAF_OPENAPI_SPECS value of the specs and the exclusions file name.
+func (l *learner) write() (string, string, error) {
+	if err := os.MkdirAll(l.dir, 0o755); err != nil {
+		return "", "", err
+	}
+
+	description := fmt.Sprintf("Proposed by the WAF learning mode from %d requests between %s and %s.",
+		l.requests, l.started.Format(time.RFC3339), time.Now().Format(time.RFC3339))
+
+	specs := make(map[string]*openapi.Spec)
+	for key, operation := range l.operations {
+		spec, ok := specs[key.host]
+		if !ok {
+			spec = &openapi.Spec{
+				OpenAPI: "3.0.3",
+				Info:    &openapi.Info{Title: key.host, Description: description, Version: "1.0.0"},
+				Paths:   make(map[string]*openapi.PathItem),
+			}
+			specs[key.host] = spec
+		}
+
+		item, ok := spec.Paths[key.template]
+		if !ok {
+			item = &openapi.PathItem{}
+			spec.Paths[key.template] = item
+		}
+		item.SetOperation(key.method, operation.operation())
+	}
+
+	var entries []string
+	for host, spec := range specs {
+		filename := filepath.Join(l.dir, "openapi-"+fileSafe(host)+".yml")
+		if err := writeYAML(filename, description, spec); err != nil {
+			return "", "", err
+		}
+		entries = append(entries, host+"/="+filename)
+	}
+	slices.Sort(entries)
+
+	keys := make([]exclusionKey, 0, len(l.exclusions))
+	for key := range l.exclusions {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b exclusionKey) int {
+		return strings.Compare(a.host+" "+a.template+" "+a.method+" "+a.rule, b.host+" "+b.template+" "+b.method+" "+b.rule)
+	})
+
+	var exclusions service.Exclusions
+	for _, key := range keys {
+		learned := l.exclusions[key]
+		exclusion := service.Exclusion{
+			Description: fmt.Sprintf("%s, matched %d passed requests", learned.message, learned.count),
+			PathRegex:   templateRegex(key.template),
+			Methods:     []string{key.method},
+			Rules:       []string{key.rule},
+		}
+		if key.host != "" {
+			exclusion.Hosts = []string{key.host}
+		}
+		if !learned.whole {
+			for variable := range learned.variables {
+				field, name, _ := strings.Cut(variable, ":")
+				switch field {
+				case "args":
+					exclusion.Args = append(exclusion.Args, name)
+				case "headers":
+					exclusion.Headers = append(exclusion.Headers, name)
+				case "cookies":
+					exclusion.Cookies = append(exclusion.Cookies, name)
+				}
+			}
+			slices.Sort(exclusion.Args)
+			slices.Sort(exclusion.Headers)
+			slices.Sort(exclusion.Cookies)
+		}
+		exclusions.Exclusions = append(exclusions.Exclusions, exclusion)
+	}
+
+	filename := filepath.Join(l.dir, "exclusions.yml")
+	if err := writeYAML(filename, description+" Every rule listed here matched legitimate traffic.", exclusions); err != nil {
+		return "", "", err
+	}
+	return strings.Join(entries, ","), filename, nil
+}
+
+// writeYAML writes a document preceded by a comment.
+func writeYAML(filename, comment string, document any) error {
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append([]byte("# "+comment+"\n"), data...), 0o644)
+}
+
+// fileSafe replaces the characters of a host not allowed in file names.
+func fileSafe(host string) string {
+	if host == "" {
+		return "default"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') {
+			return r
+		}
+		return '_'
+	}, host)
+}
@@ -0,0 +1,344 @@
+package service_waf
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/openapi"
+	"gopkg.in/yaml.v2"
+)
+
+// learnedRequest builds the request of the WAF and the request of the OpenAPI
+// validation of the same traffic.
+func learnedRequest(t *testing.T, method, target, contentType, body string) (*service.Request, openapi.Request) {
+	t.Helper()
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &service.Request{
+		Method:    method,
+		Host:      "api.example.com:8080",
+		Path:      target,
+		CleanPath: parsed.Path,
+		Headers:   map[string][]string{},
+		Body:      []byte(body),
+	}
+	for name, values := range parsed.Query() {
+		for _, value := range values {
+			request.Args = append(request.Args, service.Argument{Source: service.ArgsGet, Name: name, Value: value})
+		}
+	}
+	if contentType != "" {
+		request.Headers["Content-Type"] = []string{contentType}
+		request.BodyProcessor = service.BodyJSON
+	}
+
+	return request, openapi.Request{
+		Method:      method,
+		Path:        parsed.Path,
+		Query:       parsed.Query(),
+		Headers:     request.Headers,
+		ContentType: contentType,
+		Body:        request.Body,
+	}
+}
+
+func TestLearnerRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "learned")
+	learner := newLearner(dir)
+
+	traffic := []struct {
+		method, target, body string
+		matches              []service.Match
+	}{
+		{"GET", "/users/42?page=1&sort=name", "", nil},
+		{"GET", "/users/7?page=2", "", []service.Match{{Rule: "942100", Message: "SQL Injection", Variable: "ARGS_GET:page"}}},
+		{"GET", "/search?q=a-b]", "", nil},
+		{"GET", `/search?q=^x\`, "", []service.Match{{Rule: "941100", Message: "XSS", Variable: "REQUEST_BODY"}}},
+		{"POST", "/users", `{"name":"Al","email":"a@b.c","tags":["x"]}`, nil},
+		{"POST", "/users", `{"name":"Bo","email":"b@c.d","age":30}`, []service.Match{{Rule: "920100", Message: "Logged only", Variable: "ARGS_POST:name", NoLog: true}}},
+	}
+
+	var recorded []openapi.Request
+	for _, traffic := range traffic {
+		contentType := ""
+		if traffic.body != "" {
+			contentType = "application/json"
+		}
+		request, validated := learnedRequest(t, traffic.method, traffic.target, contentType, traffic.body)
+		learner.record(request, traffic.matches)
+		recorded = append(recorded, validated)
+	}
+	learner.finish()
+
+	// the traffic after the learning window is not recorded
+	request, _ := learnedRequest(t, "GET", "/late", "", "")
+	learner.record(request, nil)
+	if learner.requests != len(traffic) {
+		t.Errorf("requests = %d, want %d", learner.requests, len(traffic))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "openapi-api.example.com.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := openapi.Load(data)
+	if err != nil {
+		t.Fatalf("the learned spec does not load: %v\n%s", err, data)
+	}
+
+	for _, request := range recorded {
+		if violations := spec.Validate(request); len(violations) > 0 {
+			t.Errorf("recorded %s %s: violations = %v", request.Method, request.Path, violations)
+		}
+	}
+
+	outOfProfile := []struct {
+		method, target, body string
+	}{
+		{"GET", "/late", ""},
+		{"GET", "/users/abc", ""},
+		{"GET", "/users/42?page=one", ""},
+		{"GET", "/users/42?debug=1", ""},
+		{"GET", "/search?q=<script>", ""},
+		{"GET", "/search?q=aaaaaa", ""},
+		{"DELETE", "/users/42", ""},
+		{"POST", "/users", `{"name":"Al"}`},
+		{"POST", "/users", `{"name":"Al","email":"a@b.c","admin":true}`},
+		{"POST", "/users", `{"name":"Al","email":"a@b.c","age":"30"}`},
+		{"POST", "/users", `{"name":"Al","email":"a@b.c","tags":[1]}`},
+	}
+	for _, traffic := range outOfProfile {
+		contentType := ""
+		if traffic.body != "" {
+			contentType = "application/json"
+		}
+		_, request := learnedRequest(t, traffic.method, traffic.target, contentType, traffic.body)
+		if violations := spec.Validate(request); len(violations) == 0 {
+			t.Errorf("%s %s %s: no violation", traffic.method, traffic.target, traffic.body)
+		}
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "exclusions.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exclusions service.Exclusions
+	if err := yaml.Unmarshal(data, &exclusions); err != nil {
+		t.Fatal(err)
+	}
+	want := []service.Exclusion{
+		{
+			Description: "XSS, matched 1 passed requests",
+			PathRegex:   `^/search$`,
+			Methods:     []string{"GET"},
+			Hosts:       []string{"api.example.com"},
+			Rules:       []string{"941100"},
+		},
+		{
+			Description: "SQL Injection, matched 1 passed requests",
+			PathRegex:   `^/users/[^/]+$`,
+			Methods:     []string{"GET"},
+			Hosts:       []string{"api.example.com"},
+			Rules:       []string{"942100"},
+			Args:        []string{"page"},
+		},
+	}
+	if !reflect.DeepEqual(exclusions.Exclusions, want) {
+		t.Errorf("exclusions = %+v, want %+v", exclusions.Exclusions, want)
+	}
+	for _, exclusion := range exclusions.Exclusions {
+		if _, err := regexp.Compile(exclusion.PathRegex); err != nil {
+			t.Errorf("path_regex %q: %v", exclusion.PathRegex, err)
+		}
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	tests := []struct {
+		path     string
+		template string
+		names    []string
+		values   []string
+	}{
+		{"/", "/", nil, nil},
+		{"/users", "/users", nil, nil},
+		{"/users/42", "/users/{id}", []string{"id"}, []string{"42"}},
+		{"/users/42/posts/7", "/users/{id}/posts/{id2}", []string{"id", "id2"}, []string{"42", "7"}},
+		{"/orders/0e8400e2-9b1d-41d4-a716-446655440000", "/orders/{id}", []string{"id"}, []string{"0e8400e2-9b1d-41d4-a716-446655440000"}},
+		{"/files/5f3a1b2c3d4e5f60718293a4/raw", "/files/{id}/raw", []string{"id"}, []string{"5f3a1b2c3d4e5f60718293a4"}},
+		{"/files/cafe", "/files/cafe", nil, nil},
+		{"/v2/users", "/v2/users", nil, nil},
+	}
+
+	for _, test := range tests {
+		template, names, values := pathTemplate(test.path)
+		if template != test.template || !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("pathTemplate(%q) = %q, %q, %q, want %q, %q, %q", test.path, template, names, values, test.template, test.names, test.values)
+		}
+	}
+}
+
+func TestValueProfilePattern(t *testing.T) {
+	tests := []struct {
+		values  []string
+		pattern string
+	}{
+		{[]string{"abc", "42"}, `^[0-9a-z]*$`},
+		{[]string{"John Doe", "Zoë"}, `^[a-zA-Z \x{80}-\x{10FFFF}]*$`},
+		{[]string{`a-b]`, `^x\`}, `^[a-z\-\\\]\^]*$`},
+		{[]string{"[x]", "a.b"}, `^[a-z.\[\]]*$`},
+		{[]string{"a\tb\x7f"}, `^[a-z\x{9}\x{7f}]*$`},
+		{[]string{"!\"#$%&'()*+,./:;<=>?@"}, ""},
+		{[]string{""}, ""},
+	}
+
+	for _, test := range tests {
+		var profile valueProfile
+		for _, value := range test.values {
+			profile.add(value)
+		}
+		pattern := profile.pattern()
+		if pattern != test.pattern {
+			t.Errorf("pattern of %q = %q, want %q", test.values, pattern, test.pattern)
+			continue
+		}
+		if pattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			t.Errorf("pattern of %q: %v", test.values, err)
+			continue
+		}
+		for _, value := range test.values {
+			if !compiled.MatchString(value) {
+				t.Errorf("pattern %q does not match %q", pattern, value)
+			}
+		}
+	}
+}
+
+func TestJSONProfileSchema(t *testing.T) {
+	profile := &jsonProfile{}
+	for _, document := range []any{
+		map[string]any{"name": "Al", "nickname": nil},
+		map[string]any{"name": "Bo", "nickname": "b"},
+	} {
+		profile.add(document, 0)
+	}
+	schema := profile.schema()
+	if schema.Type != "object" || !reflect.DeepEqual(schema.Required, []string{"name", "nickname"}) || schema.AdditionalProperties == nil {
+		t.Errorf("schema = %+v, want an object requiring name and nickname without additional properties", schema)
+	}
+	if nickname := schema.Properties["nickname"]; nickname == nil || nickname.Type != "string" || !nickname.Nullable {
+		t.Errorf("nickname = %+v, want a nullable string", nickname)
+	}
+
+	// the properties past the limit leave the object open
+	wide := make(map[string]any)
+	for i := 0; i <= maxLearnedParameters; i++ {
+		wide[fmt.Sprintf("p%d", i)] = true
+	}
+	profile = &jsonProfile{}
+	profile.add(wide, 0)
+	if schema := profile.schema(); len(schema.Properties) != maxLearnedParameters || schema.AdditionalProperties != nil {
+		t.Errorf("wide object: %d properties, additional properties %v, want %d and open", len(schema.Properties), schema.AdditionalProperties, maxLearnedParameters)
+	}
+
+	// so do the objects past the depth limit
+	var deep any = map[string]any{}
+	for i := 0; i <= maxLearnedDepth; i++ {
+		deep = map[string]any{"a": deep}
+	}
+	profile = &jsonProfile{}
+	profile.add(deep, 0)
+	schema = profile.schema()
+	for i := 0; i < maxLearnedDepth; i++ {
+		schema = schema.Properties["a"]
+	}
+	if schema == nil || schema.Type != "object" || schema.AdditionalProperties != nil {
+		t.Errorf("object past the depth limit = %+v, want an open object", schema)
+	}
+}
+
+func TestLearnerLimits(t *testing.T) {
+	learner := newLearner(t.TempDir())
+	for i := 0; i <= maxLearnedOperations; i++ {
+		request, _ := learnedRequest(t, "GET", fmt.Sprintf("/page%d", i), "", "")
+		learner.record(request, []service.Match{{Rule: fmt.Sprintf("%d", i), Variable: "ARGS:q"}})
+	}
+	if len(learner.operations) != maxLearnedOperations || len(learner.exclusions) != maxLearnedExclusions {
+		t.Errorf("operations = %d, exclusions = %d, want %d and %d", len(learner.operations), len(learner.exclusions), maxLearnedOperations, maxLearnedExclusions)
+	}
+
+	// the variables past the limit turn into an exclusion of the whole rule
+	learner = newLearner(t.TempDir())
+	request, _ := learnedRequest(t, "GET", "/search", "", "")
+	for i := 0; i <= maxLearnedVariables; i++ {
+		learner.record(request, []service.Match{{Rule: "942100", Variable: fmt.Sprintf("ARGS:q%d", i)}})
+	}
+	if exclusion := learner.exclusions[exclusionKey{operationKey{"api.example.com", "/search", "GET"}, "942100"}]; exclusion == nil || !exclusion.whole {
+		t.Errorf("exclusion = %+v, want the whole rule", exclusion)
+	}
+
+	// the query parameters past the limit are left out
+	query := make([]string, 0, maxLearnedParameters+1)
+	for i := 0; i <= maxLearnedParameters; i++ {
+		query = append(query, fmt.Sprintf("p%d=1", i))
+	}
+	request, _ = learnedRequest(t, "GET", "/wide?"+strings.Join(query, "&"), "", "")
+	learner.record(request, nil)
+	if operation := learner.operations[operationKey{"api.example.com", "/wide", "GET"}]; len(operation.query) != maxLearnedParameters {
+		t.Errorf("query parameters = %d, want %d", len(operation.query), maxLearnedParameters)
+	}
+}
+
+func TestLearnerWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "learned")
+	learner := newLearner(dir)
+	for _, host := range []string{"b.example.com", "", "A.Example.com:443"} {
+		request, _ := learnedRequest(t, "GET", "/", "", "")
+		request.Host = host
+		learner.record(request, nil)
+	}
+
+	specs, exclusions, err := learner.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSpecs := strings.Join([]string{
+		"/=" + filepath.Join(dir, "openapi-default.yml"),
+		"a.example.com/=" + filepath.Join(dir, "openapi-a.example.com.yml"),
+		"b.example.com/=" + filepath.Join(dir, "openapi-b.example.com.yml"),
+	}, ",")
+	if specs != wantSpecs {
+		t.Errorf("specs = %q, want %q", specs, wantSpecs)
+	}
+	if exclusions != filepath.Join(dir, "exclusions.yml") {
+		t.Errorf("exclusions = %q", exclusions)
+	}
+
+	for _, entry := range strings.Split(specs, ",") {
+		_, filename, _ := strings.Cut(entry, "=")
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "# Proposed by the WAF learning mode from 3 requests") {
+			t.Errorf("%s does not start with the description:\n%s", filename, data)
+		}
+		if _, err := openapi.Load(data); err != nil {
+			t.Errorf("%s: %v", filename, err)
+		}
+	}
+}
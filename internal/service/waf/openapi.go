@@ -0,0 +1,168 @@
+package service_waf
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/openapi"
+)
+
+// OpenAPI rule ids, every rule blocks on its own.
+const (
+	RuleOpenAPIPath      = "2501"
+	RuleOpenAPIMethod    = "2502"
+	RuleOpenAPIParameter = "2503"
+	RuleOpenAPIBody      = "2504"
+)
+
+// openapiTag categorizes the OpenAPI rules for exclusions.
+const openapiTag = "openapi"
+
+// apiSpec is an OpenAPI spec enforced on a host and a path prefix.
+type apiSpec struct {
+	host   string // empty for every host
+	prefix string
+	spec   *openapi.Spec
+}
+
+// openapiViolations maps the violation kinds to their rule id.
+var openapiViolations = map[string]string{
+	openapi.ViolationPath:      RuleOpenAPIPath,
+	openapi.ViolationMethod:    RuleOpenAPIMethod,
+	openapi.ViolationParameter: RuleOpenAPIParameter,
+	openapi.ViolationBody:      RuleOpenAPIBody,
+}
+
+// parameterCollections names the parameter violations after the SecRule collections.
+var parameterCollections = map[string]string{
+	"path":   "REQUEST_FILENAME",
+	"query":  "ARGS_GET:",
+	"header": "REQUEST_HEADERS:",
+	"cookie": "REQUEST_COOKIES:",
+}
+
+// loadSpecs reads the specs of WAF_OPENAPI_SPECS, a comma separated list of
+// [host]/prefix=file entries.
+func loadSpecs(value string, sources *ruleSources) ([]apiSpec, error) {
+	var specs []apiSpec
+	for _, item := range splitList(value) {
+		scope, filename, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OpenAPI spec %q, expected [host]/prefix=file", item)
+		}
+
+		slash := strings.IndexByte(scope, '/')
+		if slash < 0 {
+			return nil, fmt.Errorf("invalid OpenAPI spec scope %q, expected [host]/prefix", scope)
+		}
+
+		data, err := sources.read(strings.TrimSpace(filename))
+		if err != nil {
+			return nil, fmt.Errorf("error reading OpenAPI spec: %w", err)
+		}
+		spec, err := openapi.Load(data)
+		if err != nil {
+			return nil, fmt.Errorf("error in OpenAPI spec %s: %w", filename, err)
+		}
+
+		specs = append(specs, apiSpec{
+			host:   strings.ToLower(strings.TrimSpace(scope[:slash])),
+			prefix: scope[slash:],
+			spec:   spec,
+		})
+	}
+	return specs, nil
+}
+
+// findSpec returns the spec of the request, the longest prefix wins.
+func findSpec(specs []apiSpec, request *service.Request, path string) *apiSpec {
+	host := requestHost(request)
+
+	var found *apiSpec
+	for i := range specs {
+		spec := &specs[i]
+		if spec.host != "" && spec.host != host {
+			continue
+		}
+		if !strings.HasPrefix(path, spec.prefix) {
+			continue
+		}
+		if found == nil || len(spec.prefix) > len(found.prefix) || (len(spec.prefix) == len(found.prefix) && spec.host != "") {
+			found = spec
+		}
+	}
+	return found
+}
+
+// detectOpenAPI validates the request against the spec of its host and path,
+// the decoded and cleaned path the backend receives.
+func (w *WAFService) detectOpenAPI(specs []apiSpec, request *service.Request) []service.Match {
+	spec := findSpec(specs, request, request.CleanPath)
+	if spec == nil {
+		return nil
+	}
+
+	// the query arguments keep the pairs url.ParseQuery rejects
+	query := url.Values{}
+	for _, arg := range request.Args {
+		if arg.Source == service.ArgsGet {
+			query.Add(arg.Name, arg.Value)
+		}
+	}
+	violations := spec.spec.Validate(openapi.Request{
+		Method:      request.Method,
+		Path:        (&url.URL{Path: request.CleanPath}).EscapedPath(),
+		Query:       query,
+		Headers:     request.Headers,
+		Cookies:     request.Cookies,
+		ContentType: headerValue(request, "Content-Type"),
+		Body:        request.Body,
+	})
+
+	var matches []service.Match
+	for _, violation := range violations {
+		matches = append(matches, service.Match{
+			Rule:     openapiViolations[violation.Kind],
+			Message:  violation.Message,
+			Variable: violationVariable(violation),
+			Value:    truncate(violation.Value, maxLogValueLength),
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{openapiTag},
+		})
+	}
+	return matches
+}
+
+// headerValue returns the first value of a request header.
+func headerValue(request *service.Request, name string) string {
+	for key, values := range request.Headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// violationVariable names a violation like the matches of the rule engines,
+// body fields are named like the JSON arguments.
+func violationVariable(violation openapi.Violation) string {
+	switch violation.Kind {
+	case openapi.ViolationPath:
+		return "REQUEST_FILENAME"
+	case openapi.ViolationMethod:
+		return "REQUEST_METHOD"
+	case openapi.ViolationParameter:
+		collection := parameterCollections[violation.In]
+		if strings.HasSuffix(collection, ":") {
+			return collection + violation.Name
+		}
+		return collection
+	}
+
+	if field, ok := strings.CutPrefix(violation.Name, "body."); ok {
+		return "ARGS_POST:json." + field
+	}
+	return "REQUEST_BODY"
+}
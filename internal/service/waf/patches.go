@@ -0,0 +1,163 @@
+package service_waf
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"gopkg.in/yaml.v2"
+)
+
+// patchTag categorizes the virtual patches for exclusions.
+const patchTag = "virtual-patch"
+
+// patchTypes validate the type condition of a virtual patch.
+var patchTypes = map[string]*regexp.Regexp{
+	"integer":      regexp.MustCompile(`^-?\d+$`),
+	"number":       regexp.MustCompile(`^-?\d+(?:\.\d+)?(?:[eE][-+]?\d+)?$`),
+	"alpha":        regexp.MustCompile(`^[a-zA-Z]+$`),
+	"alphanumeric": regexp.MustCompile(`^[a-zA-Z0-9]+$`),
+	"uuid":         regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// virtualPatch is a compiled service.VirtualPatch.
+type virtualPatch struct {
+	conditions
+
+	id      string
+	message string
+	param   string
+
+	regex     *regexp.Regexp
+	maxLength int
+	valueType *regexp.Regexp
+	typeName  string
+	values    []string
+}
+
+// loadPatches reads and compiles the virtual patches file, no file disables virtual patching.
+func loadPatches(filename string, sources *ruleSources) ([]virtualPatch, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	data, err := sources.read(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading virtual patches file: %w", err)
+	}
+
+	var config service.VirtualPatches
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling virtual patches: %w", err)
+	}
+
+	patches := make([]virtualPatch, 0, len(config.Patches))
+	for i, p := range config.Patches {
+		compiled, err := compilePatch(p)
+		if err != nil {
+			return nil, fmt.Errorf("error in virtual patch %d %q: %w", i+1, p.ID, err)
+		}
+		if slices.ContainsFunc(patches, func(other virtualPatch) bool { return other.id == compiled.id }) {
+			return nil, fmt.Errorf("duplicate virtual patch id %q", p.ID)
+		}
+		patches = append(patches, compiled)
+	}
+
+	return patches, nil
+}
+
+func compilePatch(p service.VirtualPatch) (virtualPatch, error) {
+	if p.ID == "" {
+		return virtualPatch{}, fmt.Errorf("missing id")
+	}
+	if p.Param == "" {
+		return virtualPatch{}, fmt.Errorf("missing param")
+	}
+	if p.Regex == "" && p.MaxLength == 0 && p.Type == "" && len(p.Values) == 0 {
+		return virtualPatch{}, fmt.Errorf("missing condition, expected regex, max_length, type or values")
+	}
+
+	conditions, err := compileConditions(p.PathPrefix, p.PathRegex, p.Methods, p.Hosts)
+	if err != nil {
+		return virtualPatch{}, err
+	}
+
+	message := "Virtual Patch " + p.ID
+	if p.Description != "" {
+		message += ": " + p.Description
+	}
+
+	compiled := virtualPatch{
+		conditions: conditions,
+		id:         p.ID,
+		message:    message,
+		param:      p.Param,
+		maxLength:  p.MaxLength,
+		typeName:   strings.ToLower(p.Type),
+		values:     p.Values,
+	}
+
+	if p.Regex != "" {
+		if compiled.regex, err = regexp.Compile(p.Regex); err != nil {
+			return compiled, fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	if compiled.typeName != "" {
+		var ok bool
+		if compiled.valueType, ok = patchTypes[compiled.typeName]; !ok {
+			return compiled, fmt.Errorf("unknown type %q, expected integer, number, alpha, alphanumeric or uuid", p.Type)
+		}
+	}
+
+	return compiled, nil
+}
+
+// violates returns why a value breaks the patch, empty when it does not.
+func (p *virtualPatch) violates(value string) string {
+	switch {
+	case p.regex != nil && p.regex.MatchString(value):
+		return "matches the pattern"
+	case p.maxLength > 0 && len(value) > p.maxLength:
+		return fmt.Sprintf("longer than %d", p.maxLength)
+	case p.valueType != nil && !p.valueType.MatchString(value):
+		return "not " + p.typeName
+	case len(p.values) > 0 && !slices.Contains(p.values, value):
+		return "not an allowed value"
+	}
+	return ""
+}
+
+// detectPatches evaluates the virtual patches applying to the request.
+func (w *WAFService) detectPatches(patches []virtualPatch, request *service.Request) []service.Match {
+	var matches []service.Match
+	for i := range patches {
+		patch := &patches[i]
+		if !patch.applies(request) {
+			continue
+		}
+
+		for _, arg := range request.Args {
+			if arg.Name != patch.param {
+				continue
+			}
+
+			reason := patch.violates(arg.Value)
+			if reason == "" {
+				continue
+			}
+			matches = append(matches, service.Match{
+				Rule:     patch.id,
+				Message:  patch.message + " (" + patch.param + " " + reason + ")",
+				Variable: arg.Source + ":" + arg.Name,
+				Value:    arg.Value,
+				Score:    w.config.WAF_INBOUND_THRESHOLD,
+				Tags:     []string{patchTag},
+			})
+			break
+		}
+	}
+
+	return matches
+}
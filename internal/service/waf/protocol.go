@@ -0,0 +1,111 @@
+package service_waf
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// Protocol enforcement rule ids, every rule blocks on its own.
+const (
+	RuleMethodNotAllowed   = "2001"
+	RuleVersionNotAllowed  = "2002"
+	RuleURITooLong         = "2003"
+	RuleURIControlChar     = "2004"
+	RuleTooManyHeaders     = "2005"
+	RuleInvalidHeaderName  = "2006"
+	RuleInvalidHeaderValue = "2007"
+	RuleTooManyArgs        = "2008"
+	RuleBodyTooLarge       = "2009"
+)
+
+// protocolTag categorizes the protocol enforcement rules for exclusions.
+const protocolTag = "protocol-enforcement"
+
+// maxProtocolValueLength limits the value of a protocol match, oversize
+// values are reported by their length.
+const maxProtocolValueLength = 64
+
+// detectProtocol validates the request itself, limits set to 0 and empty
+// lists are disabled.
+func (w *WAFService) detectProtocol(request *service.Request) []service.Match {
+	var matches []service.Match
+	violation := func(rule, message, variable, value string) {
+		matches = append(matches, service.Match{
+			Rule:     rule,
+			Message:  message,
+			Variable: variable,
+			Value:    truncate(value, maxProtocolValueLength),
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{protocolTag},
+		})
+	}
+
+	// the cache purge method is handled by the router, whatever the policy
+	purge := w.config.USE_CACHE && strings.EqualFold(request.Method, w.config.CACHE_REMOVE_METHOD)
+	if len(w.allowedMethods) > 0 && !slices.Contains(w.allowedMethods, request.Method) && !purge {
+		violation(RuleMethodNotAllowed, "Method is not allowed by policy", "REQUEST_METHOD", request.Method)
+	}
+	if len(w.allowedVersions) > 0 && request.Protocol != "" && !slices.Contains(w.allowedVersions, request.Protocol) {
+		violation(RuleVersionNotAllowed, "HTTP protocol version is not allowed by policy", "REQUEST_PROTOCOL", request.Protocol)
+	}
+
+	if limit := w.config.WAF_MAX_URI_LENGTH; limit > 0 && len(request.Path) > limit {
+		violation(RuleURITooLong, fmt.Sprintf("Request URI longer than %d", limit), "REQUEST_URI", request.Path)
+	}
+	if path, _, _ := strings.Cut(request.Path, "?"); hasControlChar(path) {
+		violation(RuleURIControlChar, "Control character in request path", "REQUEST_FILENAME", path)
+	}
+
+	if limit := w.config.WAF_MAX_HEADERS; limit > 0 && request.HeaderCount > limit {
+		violation(RuleTooManyHeaders, fmt.Sprintf("Too many request headers, %d > %d", request.HeaderCount, limit), "REQUEST_HEADERS", "")
+	}
+	for name, values := range request.Headers {
+		if limit := w.config.WAF_MAX_HEADER_NAME_LENGTH; limit > 0 && len(name) > limit {
+			violation(RuleInvalidHeaderName, fmt.Sprintf("Header name longer than %d", limit), "REQUEST_HEADERS_NAMES:"+name, name)
+		}
+
+		for _, value := range values {
+			if limit := w.config.WAF_MAX_HEADER_VALUE_LENGTH; limit > 0 && len(value) > limit {
+				violation(RuleInvalidHeaderValue, fmt.Sprintf("Header value longer than %d", limit), "REQUEST_HEADERS:"+name, value)
+			} else if strings.ContainsFunc(value, func(r rune) bool { return r != '\t' && isControl(r) }) {
+				violation(RuleInvalidHeaderValue, "Control character in header value", "REQUEST_HEADERS:"+name, value)
+			}
+		}
+	}
+
+	if limit := w.config.WAF_MAX_ARGS; limit > 0 && len(request.Args) > limit {
+		violation(RuleTooManyArgs, fmt.Sprintf("Too many arguments, %d > %d", len(request.Args), limit), "ARGS", "")
+	}
+	if limit := w.config.WAF_MAX_BODY_SIZE; limit > 0 && request.BodySize > limit {
+		violation(RuleBodyTooLarge, fmt.Sprintf("Request body larger than %d bytes", limit), "REQUEST_BODY", "")
+	}
+
+	return matches
+}
+
+// hasControlChar reports whether the path contains control characters, encoded or not.
+func hasControlChar(path string) bool {
+	if decoded, err := url.PathUnescape(path); err == nil {
+		path = decoded
+	}
+	return strings.ContainsFunc(path, isControl)
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// splitList splits a comma separated list, empty items are dropped.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,202 @@
+package service_waf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// ruleSet is a compiled rule engine and the files it was built from.
+type ruleSet struct {
+	engine     ruleEngine
+	exclusions []exclusion
+	patches    []virtualPatch
+	specs      []apiSpec
+	// nil when the response phase is disabled
+	response *responseEngine
+	info     service.RuleSetInfo
+}
+
+// ruleSources reads the rule files of a rule set and hashes their content.
+type ruleSources struct {
+	files []string
+	hash  hash.Hash
+}
+
+func newRuleSources() *ruleSources {
+	return &ruleSources{hash: sha256.New()}
+}
+
+func (s *ruleSources) read(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.files = append(s.files, file)
+	s.hash.Write([]byte(file))
+	s.hash.Write(data)
+
+	return data, nil
+}
+
+// ReloadRules compiles the rule files and swaps the active rule set, the
+// previous rule set stays active when the new files are invalid.
+func (w *WAFService) ReloadRules() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// taken before loading, a file changed meanwhile triggers another reload
+	w.fingerprint = w.rulesFingerprint()
+
+	set, err := w.load()
+	if err != nil {
+		w.lastError = err.Error()
+		return err
+	}
+
+	if previous := w.current.Load(); previous != nil {
+		set.info.Version = previous.info.Version + 1
+	} else {
+		set.info.Version = 1
+	}
+	w.lastError = ""
+	w.current.Store(set)
+
+	logger.Logger(map[string]any{
+		"message": "WAF rules loaded",
+		"engine":  set.info.Engine,
+		"version": set.info.Version,
+		"hash":    set.info.Hash,
+		"rules":   set.info.Rules,
+	}).Info()
+
+	return nil
+}
+
+// RuleSet returns the description of the active rule set.
+func (w *WAFService) RuleSet() service.RuleSetInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info := w.current.Load().info
+	info.LastError = w.lastError
+	return info
+}
+
+// load compiles the rule engine selected with WAF_ENGINE.
+func (w *WAFService) load() (*ruleSet, error) {
+	var engine ruleEngine
+	var err error
+	sources := newRuleSources()
+
+	name := strings.ToLower(w.config.WAF_ENGINE)
+	switch name {
+	case EngineSecRule:
+		engine, err = newSecRuleEngine(w.config, w.config.WAF_SECRULE_FILES, sources)
+	default:
+		name = EngineKeywords
+		engine, err = newKeywordEngine(w.config, w.keywordsFile, sources)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// exclusions are part of the rule set, they apply to every engine
+	exclusions, err := loadExclusions(w.config.WAF_EXCLUSIONS, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	patches, err := loadPatches(w.config.WAF_VIRTUAL_PATCHES, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	specs, err := loadSpecs(w.config.WAF_OPENAPI_SPECS, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &ruleSet{
+		engine:     engine,
+		exclusions: exclusions,
+		patches:    patches,
+		specs:      specs,
+		info: service.RuleSetInfo{
+			Engine:     name,
+			Rules:      engine.size(),
+			Exclusions: len(exclusions),
+			Patches:    len(patches),
+			APISpecs:   len(specs),
+			LoadedAt:   time.Now(),
+		},
+	}
+
+	if w.config.WAF_PROTECT_RESPONSE {
+		if set.response, err = newResponseEngine(w.config.WAF_RESPONSE_CONFIG, sources); err != nil {
+			return nil, err
+		}
+		set.info.ResponseRules = len(set.response.detectors)
+	}
+
+	set.info.Hash = hex.EncodeToString(sources.hash.Sum(nil))
+	set.info.Files = sources.files
+
+	return set, nil
+}
+
+// watch reloads the rules on SIGHUP and when a rule file changes.
+func (w *WAFService) watch() {
+	interval := time.Duration(w.config.WAF_RELOAD_INTERVAL) * time.Second
+	filewatch.Watch("WAF rule files", interval, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.fingerprint != w.rulesFingerprint()
+	}, func() {
+		if err := w.ReloadRules(); err != nil {
+			logger.Logger("[error] WAF rules rejected, previous rules stay active", err.Error()).Error()
+		}
+	})
+}
+
+// rulesFingerprint summarizes the size and modification time of the rule files,
+// including files added to the configured patterns since the last load.
+func (w *WAFService) rulesFingerprint() string {
+	files := []string{w.keywordsFile}
+	if strings.EqualFold(w.config.WAF_ENGINE, EngineSecRule) {
+		files = nil
+		for _, pattern := range strings.Split(w.config.WAF_SECRULE_FILES, ",") {
+			matches, _ := filepath.Glob(strings.TrimSpace(pattern))
+			files = append(files, matches...)
+		}
+	}
+	if w.config.WAF_EXCLUSIONS != "" {
+		files = append(files, w.config.WAF_EXCLUSIONS)
+	}
+	if w.config.WAF_VIRTUAL_PATCHES != "" {
+		files = append(files, w.config.WAF_VIRTUAL_PATCHES)
+	}
+	for _, item := range splitList(w.config.WAF_OPENAPI_SPECS) {
+		if _, file, ok := strings.Cut(item, "="); ok {
+			files = append(files, strings.TrimSpace(file))
+		}
+	}
+	if w.config.WAF_PROTECT_RESPONSE {
+		files = append(files, w.config.WAF_RESPONSE_CONFIG)
+	}
+	if set := w.current.Load(); set != nil {
+		files = append(files, set.info.Files...)
+	}
+	slices.Sort(files)
+	return filewatch.Fingerprint(slices.Compact(files)...)
+}
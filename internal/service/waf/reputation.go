@@ -0,0 +1,26 @@
+package service_waf
+
+import "github.com/jahrulnr/go-waf/internal/interface/service"
+
+// RuleIPReputation scores the client IPs found in a score list of the IP
+// reputation, the lists contribute once whatever their number.
+const RuleIPReputation = "2601"
+
+// reputationTag categorizes the IP reputation rule for exclusions.
+const reputationTag = "ip-reputation"
+
+// detectReputation reports the score lists holding the client IP.
+func detectReputation(request *service.Request) []service.Match {
+	var matches []service.Match
+	for _, list := range request.IPLists {
+		matches = append(matches, service.Match{
+			Rule:     RuleIPReputation,
+			Message:  "IP address in the " + list.Name + " list",
+			Variable: "REMOTE_ADDR",
+			Value:    request.IP,
+			Score:    list.Score,
+			Tags:     []string{reputationTag},
+		})
+	}
+	return matches
+}
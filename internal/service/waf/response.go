@@ -0,0 +1,429 @@
+package service_waf
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// Response detector names, keys of the detectors section of WAF_RESPONSE_CONFIG.
+const (
+	DetectorSQLError         = "sql_error"
+	DetectorStackTrace       = "stack_trace"
+	DetectorDirectoryListing = "directory_listing"
+	DetectorCreditCard       = "credit_card"
+)
+
+// Response phase actions.
+const (
+	ResponseMask  = "mask"  // replace the leaked data with asterisks
+	ResponseBlock = "block" // replace the body with an error page
+	ResponseLog   = "log"
+)
+
+// responseEngine scans upstream responses for leaked data.
+type responseEngine struct {
+	detectors []responseDetector
+}
+
+type responseDetector struct {
+	name    string
+	message string
+	tag     string
+	action  string
+	// sensitive values are masked in the logs too
+	sensitive bool
+	// find returns the [start, end) offsets of every leak in the body
+	find func(body []byte) [][]int
+}
+
+// responseDetectors are the built-in detectors with their default action.
+var responseDetectors = []responseDetector{
+	{
+		name:    DetectorSQLError,
+		message: "SQL Error Disclosure",
+		tag:     "attack-disclosure",
+		action:  ResponseBlock,
+		find: regexpFinder(`(?i)(?:You have an error in your SQL syntax|Warning: (?:mysqli?|pg|sqlite|oci|mssql)_\w+\(|` +
+			`SQLSTATE\[\w+\]|ORA-\d{5}:|PG::SyntaxError|ERROR:\s+syntax error at or near|` +
+			`Unclosed quotation mark after the character string|Microsoft OLE DB Provider for SQL Server|` +
+			`SQLite3?::(?:SQL)?Exception|sqlite3\.OperationalError|com\.mysql\.jdbc\.exceptions)`),
+	},
+	{
+		name:    DetectorStackTrace,
+		message: "Stack Trace Disclosure",
+		tag:     "attack-disclosure",
+		action:  ResponseBlock,
+		find: regexpFinder(`(?m)(?:Traceback \(most recent call last\):|^\s*at [\w$.<>]+\([\w$]+\.(?:java|kt|scala):\d+\)|` +
+			`Exception in thread "[^"]*"|^goroutine \d+ \[[\w ]+\]:|` +
+			`(?:Fatal error|Parse error|Warning)</b>:.+ on line <b>\d+|^Stack trace:\s*$|` +
+			`^\s*at [\w.]+\(.*\) in .+:line \d+)`),
+	},
+	{
+		name:    DetectorDirectoryListing,
+		message: "Directory Listing",
+		tag:     "attack-disclosure",
+		action:  ResponseBlock,
+		find:    regexpFinder(`(?i)<title>(?:Index of /|Directory listing for /)`),
+	},
+	{
+		name:      DetectorCreditCard,
+		message:   "Credit Card Number Leakage",
+		tag:       "leakage-credit-card",
+		action:    ResponseMask,
+		sensitive: true,
+		find:      findCreditCards,
+	},
+}
+
+func newResponseEngine(filename string, sources *ruleSources) (*responseEngine, error) {
+	var rules service.ResponseRules
+
+	data, err := sources.read(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response rules file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response rules: %w", err)
+	}
+
+	engine := &responseEngine{}
+	for _, detector := range responseDetectors {
+		if action, ok := rules.Detectors[detector.name]; ok {
+			detector.action = strings.ToLower(action)
+		}
+		engine.detectors = append(engine.detectors, detector)
+	}
+	for name := range rules.Detectors {
+		if !slices.ContainsFunc(responseDetectors, func(d responseDetector) bool { return d.name == name }) {
+			return nil, fmt.Errorf("unknown response detector %q", name)
+		}
+	}
+
+	for _, secret := range rules.Secrets {
+		if secret.Name == "" {
+			return nil, fmt.Errorf("missing secret name")
+		}
+		re, err := regexp.Compile(secret.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in secret %q: %w", secret.Name, err)
+		}
+
+		action := strings.ToLower(secret.Action)
+		if action == "" {
+			action = ResponseMask
+		}
+		engine.detectors = append(engine.detectors, responseDetector{
+			name:      secret.Name,
+			message:   "Secret Leakage",
+			tag:       "leakage-secret",
+			action:    action,
+			sensitive: true,
+			find: func(body []byte) [][]int {
+				return re.FindAllIndex(body, -1)
+			},
+		})
+	}
+
+	for _, detector := range engine.detectors {
+		switch detector.action {
+		case ResponseMask, ResponseBlock, ResponseLog:
+		default:
+			return nil, fmt.Errorf("invalid action %q of %s", detector.action, detector.name)
+		}
+	}
+
+	return engine, nil
+}
+
+func regexpFinder(pattern string) func(body []byte) [][]int {
+	re := regexp.MustCompile(pattern)
+	return func(body []byte) [][]int {
+		return re.FindAllIndex(body, -1)
+	}
+}
+
+// creditCardPattern finds the runs of 13 to 19 digits, optionally separated
+// by spaces or dashes, their issuer and length are checked by cardNumber.
+var creditCardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// cardIssuers are the prefix ranges of the card networks and the lengths of
+// their numbers, the bounds of a range have the same number of digits.
+var cardIssuers = []struct {
+	low, high string
+	lengths   []int
+}{
+	{"4", "4", []int{13, 16, 19}},                 // Visa
+	{"51", "55", []int{16}},                       // Mastercard
+	{"2221", "2720", []int{16}},                   // Mastercard
+	{"34", "34", []int{15}},                       // American Express
+	{"37", "37", []int{15}},                       // American Express
+	{"6011", "6011", []int{16, 17, 18, 19}},       // Discover
+	{"644", "649", []int{16, 17, 18, 19}},         // Discover
+	{"65", "65", []int{16, 17, 18, 19}},           // Discover
+	{"3528", "3589", []int{16, 17, 18, 19}},       // JCB
+	{"300", "305", []int{14, 15, 16, 17, 18, 19}}, // Diners Club
+	{"36", "36", []int{14, 15, 16, 17, 18, 19}},   // Diners Club
+	{"38", "39", []int{16, 17, 18, 19}},           // Diners Club
+	{"62", "62", []int{16, 17, 18, 19}},           // UnionPay
+}
+
+// findCreditCards returns the card numbers of a known issuer passing the Luhn
+// check, the digits of JSON numbers are skipped.
+func findCreditCards(body []byte) [][]int {
+	isJSON := false
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 {
+		isJSON = trimmed[0] == '{' || trimmed[0] == '['
+	}
+
+	var found [][]int
+	for _, loc := range creditCardPattern.FindAllIndex(body, -1) {
+		// the pattern takes the digits following a number too, e.g. the 1 of
+		// "4111 1111 1111 1111 1", so the shorter numbers are tried
+		start, end := loc[0], loc[1]
+		for {
+			number := body[start:end]
+			if cardNumber(number) && luhn(number) && !inNumber(body, start, end, isJSON) {
+				found = append(found, []int{start, end})
+				break
+			}
+			cut := bytes.LastIndexAny(number, " -")
+			if cut < 0 {
+				break
+			}
+			end = start + cut
+		}
+	}
+	return found
+}
+
+// cardNumber reports whether the prefix and the length of a number, separators
+// ignored, match a card issuer.
+func cardNumber(number []byte) bool {
+	digits := make([]byte, 0, len(number))
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, c)
+		}
+	}
+
+	for _, issuer := range cardIssuers {
+		if !slices.Contains(issuer.lengths, len(digits)) {
+			continue
+		}
+		if prefix := string(digits[:len(issuer.low)]); prefix >= issuer.low && prefix <= issuer.high {
+			return true
+		}
+	}
+	return false
+}
+
+// inNumber reports whether the digits at [start, end) are part of a decimal
+// number like 0.4111111111111111 or, in a JSON body, a number value.
+func inNumber(body []byte, start, end int, isJSON bool) bool {
+	digit := func(i int) bool { return i >= 0 && i < len(body) && body[i] >= '0' && body[i] <= '9' }
+	at := func(i int, chars string) bool {
+		return i >= 0 && i < len(body) && strings.IndexByte(chars, body[i]) >= 0
+	}
+
+	// the integer part, the fraction or the exponent of a decimal number
+	if at(end, ".") && digit(end+1) || at(start-1, ".") && digit(start-2) || at(start-1, "+-") && at(start-2, "eE") {
+		return true
+	}
+	if !isJSON {
+		return false
+	}
+
+	// JSON numbers are values outside of the strings, without separators
+	if bytes.ContainsAny(body[start:end], " -") {
+		return false
+	}
+	before := bytes.TrimRight(bytes.TrimSuffix(body[:start], []byte("-")), " \t\r\n")
+	after := bytes.TrimLeft(body[end:], " \t\r\n")
+	return len(before) > 0 && strings.IndexByte(":,[", before[len(before)-1]) >= 0 &&
+		(len(after) == 0 || strings.IndexByte(",}]", after[0]) >= 0)
+}
+
+// luhn validates the check digit of a number, separators are ignored.
+func luhn(number []byte) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// mask replaces every character but separators with asterisks, sensitive
+// numbers keep their last four digits.
+func mask(value []byte, keepLast int) []byte {
+	masked := make([]byte, len(value))
+	kept := 0
+	for i := len(value) - 1; i >= 0; i-- {
+		switch {
+		case value[i] == ' ' || value[i] == '-':
+			masked[i] = value[i]
+		case kept < keepLast:
+			masked[i] = value[i]
+			kept++
+		default:
+			masked[i] = '*'
+		}
+	}
+	return masked
+}
+
+// inspectable reports whether a response content type holds text to scan.
+func inspectable(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "javascript")
+}
+
+// HandleResponse scans an upstream response for leaked data. It returns nil
+// when nothing is found, otherwise the status and the body to send.
+func (w *WAFService) HandleResponse(request *service.Request, upstream *service.UpstreamResponse) (*service.Response, error) {
+	set := w.current.Load()
+	if set.response == nil || !inspectable(upstream.Headers["Content-Type"]) {
+		return nil, nil
+	}
+
+	var matches []service.Match
+	var leaks [][]int // offsets of the leaks to mask
+	block := false
+
+	for _, detector := range set.response.detectors {
+		for _, loc := range detector.find(upstream.Body) {
+			value := upstream.Body[loc[0]:loc[1]]
+			if detector.sensitive {
+				value = mask(value, 4)
+			}
+
+			match := service.Match{
+				Rule:     detector.name,
+				Message:  detector.message,
+				Variable: "RESPONSE_BODY",
+				Value:    string(value),
+				Tags:     []string{detector.tag},
+			}
+			if len(exclude(set.exclusions, request, []service.Match{match})) == 0 {
+				continue
+			}
+
+			matches = append(matches, match)
+			switch detector.action {
+			case ResponseBlock:
+				block = true
+			case ResponseMask:
+				leaks = append(leaks, loc)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	detectOnly := strings.EqualFold(w.config.WAF_MODE, ModeDetect)
+	response := &service.Response{
+		StatusCode:    upstream.StatusCode,
+		Headers:       make(map[string]string),
+		Body:          upstream.Body,
+		TransactionID: newTransactionID(),
+		Matches:       matches,
+	}
+
+	action := AuditPassed
+	switch {
+	case detectOnly && (block || len(leaks) > 0):
+		action = AuditDetected
+	case block:
+		action = AuditBlocked
+		response.Blocked = true
+		response.StatusCode = 500
+		response.Body = w.errorPage
+		response.Headers["Content-Type"] = w.errorPageType
+		response.Headers["X-WAF-Transaction-ID"] = response.TransactionID
+	case len(leaks) > 0:
+		action = AuditMasked
+		response.Body = maskLeaks(upstream.Body, leaks)
+	}
+
+	w.logResponseMatches(request, response, action)
+	w.audit(request, response, action)
+
+	return response, nil
+}
+
+// maskLeaks returns a copy of body with every leak masked, overlapping leaks are masked once.
+func maskLeaks(body []byte, leaks [][]int) []byte {
+	slices.SortFunc(leaks, func(a, b []int) int { return a[0] - b[0] })
+
+	masked := slices.Clone(body)
+	end := 0
+	for _, loc := range leaks {
+		start := max(loc[0], end)
+		if start >= loc[1] {
+			continue
+		}
+		copy(masked[start:loc[1]], mask(body[start:loc[1]], 0))
+		end = loc[1]
+	}
+	return masked
+}
+
+// logResponseMatches writes every leak found in a response.
+func (w *WAFService) logResponseMatches(request *service.Request, response *service.Response, action string) {
+	for _, match := range response.Matches {
+		logger.Logger(map[string]any{
+			"message":  "Data Leakage Detected",
+			"id":       response.TransactionID,
+			"ip":       request.IP,
+			"method":   request.Method,
+			"path":     request.Path,
+			"rule":     match.Rule,
+			"msg":      match.Message,
+			"variable": match.Variable,
+			"value":    truncate(match.Value, maxLogValueLength),
+			"action":   action,
+		}).Warn()
+	}
+}
+
+// loadErrorPage reads the page replacing blocked responses.
+func loadErrorPage() ([]byte, string) {
+	page, err := os.ReadFile("views/500.html")
+	if err != nil {
+		logger.Logger(err).Warn()
+		return []byte("500 | Internal Server Error"), "text/plain; charset=utf-8"
+	}
+	return page, "text/html; charset=utf-8"
+}
@@ -0,0 +1,60 @@
+package service_waf
+
+import (
+	"testing"
+)
+
+func TestFindCreditCards(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"Visa", "card 4111111111111111 on file", []string{"4111111111111111"}},
+		{"Visa 13 digits", "card 4222222222222", []string{"4222222222222"}},
+		{"spaces", "card 4111 1111 1111 1111.", []string{"4111 1111 1111 1111"}},
+		{"dashes", "card 5555-5555-5555-4444", []string{"5555-5555-5555-4444"}},
+		{"Mastercard 2 series", "2221000000000009", []string{"2221000000000009"}},
+		{"American Express", "378282246310005", []string{"378282246310005"}},
+		{"Discover", "6011111111111117", []string{"6011111111111117"}},
+		{"JCB", "3530111333300000", []string{"3530111333300000"}},
+		{"Diners Club", "30569309025904", []string{"30569309025904"}},
+		{"UnionPay", "6200000000000005", []string{"6200000000000005"}},
+		{"JSON string", `{"card":"4111111111111111"}`, []string{"4111111111111111"}},
+		{"JSON string with spaces", `{"card":"4111 1111 1111 1111"}`, []string{"4111 1111 1111 1111"}},
+
+		// Luhn valid numbers of no card issuer
+		{"unknown issuer", "order 1234567812345670", nil},
+		{"repeated digits", "id 9999999999999995", nil},
+		{"timestamp", "at 1672254890002", nil},
+		{"wrong length", "4111111111111111111 card 378282246310005 1", []string{"378282246310005"}},
+		{"Luhn invalid", "4111111111111112", nil},
+		{"too short", "411111111111", nil},
+
+		// digits of JSON numbers
+		{"fraction", `{"ratio":0.4111111111111111}`, nil},
+		{"integer part", "4111111111111111.5", nil},
+		{"exponent", "1e+4111111111111111", nil},
+		{"JSON number", `{"id":4111111111111111,"n":[4111111111111111 , -4111111111111111]}`, nil},
+		{"JSON number at the end", `[4111111111111111]`, nil},
+		{"number outside of JSON", "ids: 4111111111111111, 2", []string{"4111111111111111"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := []byte(test.body)
+			var got []string
+			for _, loc := range findCreditCards(body) {
+				got = append(got, string(body[loc[0]:loc[1]]))
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("findCreditCards(%q) = %q, want %q", test.body, got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("findCreditCards(%q) = %q, want %q", test.body, got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package service_waf
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// severityScores maps the SecRule severity levels to anomaly scores like the OWASP CRS.
+var severityScores = map[int]int{
+	0: 5, // EMERGENCY
+	1: 5, // ALERT
+	2: 5, // CRITICAL
+	3: 4, // ERROR
+	4: 3, // WARNING
+	5: 2, // NOTICE
+}
+
+type secRule struct {
+	id       string
+	phase    int
+	msg      string
+	severity int
+	deny     bool
+	log      bool
+	chained  bool
+	tags     []string
+
+	variables      []secVariable
+	operator       secOperator
+	transforms     []transformation
+	transformNames []string
+
+	// next link of the chain, every link has to match
+	next *secRule
+}
+
+type secVariable struct {
+	collection string
+	key        string
+	keyRegex   *regexp.Regexp
+	exclude    bool
+}
+
+type secOperator struct {
+	name   string
+	negate bool
+	match  func(string) bool
+}
+
+// secValue is a single inspected value of a collection.
+type secValue struct {
+	key   string
+	value string
+}
+
+// secMatch describes the value that triggered a rule.
+type secMatch struct {
+	variable string
+	value    string
+}
+
+// secRuleEngine evaluates a practical subset of the ModSecurity SecRule language.
+type secRuleEngine struct {
+	config *config.Config
+	rules  []*secRule
+}
+
+func newSecRuleEngine(config *config.Config, patterns string, sources *ruleSources) (*secRuleEngine, error) {
+	rules, err := loadSecRules(patterns, sources)
+	if err != nil {
+		return nil, fmt.Errorf("error loading SecRule files: %w", err)
+	}
+
+	return &secRuleEngine{
+		config: config,
+		rules:  rules,
+	}, nil
+}
+
+func (e *secRuleEngine) size() int {
+	return len(e.rules)
+}
+
+func (e *secRuleEngine) detectHeaders(request *service.Request) []service.Match {
+	collections := newSecCollections(request, false)
+	matches := e.evaluate(collections, 1)
+
+	// phase 2 is the default phase, most rules inspect the arguments, the
+	// headers and the URI, they run without the body values unless the body
+	// is inspected
+	if !e.config.WAF_PROTECT_BODY {
+		matches = append(matches, e.evaluate(collections, 2)...)
+	}
+	return matches
+}
+
+func (e *secRuleEngine) detectBody(request *service.Request) []service.Match {
+	return e.evaluate(newSecCollections(request, true), 2)
+}
+
+func (e *secRuleEngine) evaluate(collections map[string][]secValue, phase int) []service.Match {
+	var matches []service.Match
+
+	for _, rule := range e.rules {
+		if rule.phase != phase {
+			continue
+		}
+
+		match, ok := rule.evaluate(collections)
+		if !ok {
+			continue
+		}
+
+		matches = append(matches, service.Match{
+			Rule:     rule.id,
+			Message:  rule.msg,
+			Variable: match.variable,
+			Value:    match.value,
+			Score:    e.score(rule),
+			NoLog:    !rule.log,
+			Tags:     rule.tags,
+		})
+	}
+
+	return matches
+}
+
+// score returns the anomaly score of a rule, deny rules always reach the inbound threshold.
+func (e *secRuleEngine) score(rule *secRule) int {
+	score := severityScores[rule.severity]
+	if rule.deny && score < e.config.WAF_INBOUND_THRESHOLD {
+		score = e.config.WAF_INBOUND_THRESHOLD
+	}
+	return score
+}
+
+// evaluate returns the first value matched by the rule when the whole chain matches.
+func (r *secRule) evaluate(collections map[string][]secValue) (secMatch, bool) {
+	var first secMatch
+	matched := false
+
+	for _, target := range r.targets(collections) {
+		value := target.value
+		for _, transform := range r.transforms {
+			value = transform(value)
+		}
+
+		if r.operator.match(value) != r.operator.negate {
+			first, matched = target, true
+			break
+		}
+	}
+
+	if !matched {
+		return secMatch{}, false
+	}
+
+	if r.next != nil {
+		if _, ok := r.next.evaluate(collections); !ok {
+			return secMatch{}, false
+		}
+	}
+
+	return first, true
+}
+
+// targets resolves the rule variables into the values to inspect.
+func (r *secRule) targets(collections map[string][]secValue) []secMatch {
+	var targets []secMatch
+
+	for _, variable := range r.variables {
+		if variable.exclude {
+			continue
+		}
+
+		for _, item := range collections[variable.collection] {
+			if !variable.selects(item.key) || r.excluded(variable.collection, item.key) {
+				continue
+			}
+
+			name := variable.collection
+			if item.key != "" {
+				name += ":" + item.key
+			}
+			targets = append(targets, secMatch{variable: name, value: item.value})
+		}
+	}
+
+	return targets
+}
+
+// excluded reports whether a "!COLLECTION:key" variable removes the key.
+func (r *secRule) excluded(collection, key string) bool {
+	for _, variable := range r.variables {
+		if variable.exclude && variable.collection == collection && variable.selects(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v secVariable) selects(key string) bool {
+	switch {
+	case v.keyRegex != nil:
+		return v.keyRegex.MatchString(key)
+	case v.key != "":
+		return strings.EqualFold(v.key, key)
+	default:
+		return true
+	}
+}
+
+// newSecCollections returns the values of the request by collection, the
+// body, its arguments and its files only when body is set.
+func newSecCollections(request *service.Request, body bool) map[string][]secValue {
+	collections := make(map[string][]secValue)
+	add := func(collection, key, value string) {
+		collections[collection] = append(collections[collection], secValue{key: key, value: value})
+	}
+
+	uri, err := url.ParseRequestURI(request.Path)
+	if err != nil {
+		uri = &url.URL{Path: request.Path}
+	}
+
+	add("REQUEST_URI", "", request.Path)
+	add("REQUEST_FILENAME", "", uri.Path)
+	add("REQUEST_BASENAME", "", path.Base(uri.Path))
+	add("REQUEST_METHOD", "", request.Method)
+	add("QUERY_STRING", "", uri.RawQuery)
+	if body {
+		add("REQUEST_BODY", "", string(request.Body))
+	}
+
+	for name, values := range request.Headers {
+		for _, value := range values {
+			add("REQUEST_HEADERS", name, value)
+		}
+		add("REQUEST_HEADERS_NAMES", name, name)
+	}
+
+	names, sourceNames := make(map[string]bool), make(map[[2]string]bool)
+	for _, arg := range request.Args {
+		if !body && arg.Source != service.ArgsGet {
+			continue
+		}
+		if arg.Source == service.Files {
+			add("FILES", arg.Name, arg.Value)
+			add("FILES_NAMES", arg.Name, arg.Name)
+			continue
+		}
+
+		add(arg.Source, arg.Name, arg.Value)
+		add("ARGS", arg.Name, arg.Value)
+		if request.BodyProcessor == service.BodyXML && arg.Source == service.ArgsPost && strings.HasPrefix(arg.Name, "xml.") {
+			add("XML", arg.Name, arg.Value)
+		}
+		if key := [2]string{arg.Source, arg.Name}; !sourceNames[key] {
+			sourceNames[key] = true
+			add(arg.Source+"_NAMES", arg.Name, arg.Name)
+		}
+		if !names[arg.Name] {
+			names[arg.Name] = true
+			add("ARGS_NAMES", arg.Name, arg.Name)
+		}
+	}
+
+	for name, values := range request.Cookies {
+		for _, value := range values {
+			add("REQUEST_COOKIES", name, value)
+		}
+		add("REQUEST_COOKIES_NAMES", name, name)
+	}
+
+	return collections
+}
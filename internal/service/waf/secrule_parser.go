@@ -0,0 +1,688 @@
+package service_waf
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/corazawaf/libinjection-go"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// directive is a single configuration line split into its arguments.
+type directive struct {
+	file string
+	line int
+	args []string
+}
+
+// secRuleParser compiles SecRule files into rules, unsupported rules are
+// skipped with a warning so OWASP CRS files can be loaded as they are.
+type secRuleParser struct {
+	sources *ruleSources
+	rules   []*secRule
+	removed []idRange
+
+	// last rule of the current chain, nil when not in a chain
+	chainTail *secRule
+	// the current chain was skipped, so its remaining links are skipped too
+	skipChain bool
+}
+
+type idRange struct {
+	from, to int
+}
+
+// loadSecRules parses every file matched by the comma separated glob patterns.
+func loadSecRules(patterns string, sources *ruleSources) ([]*secRule, error) {
+	parser := &secRuleParser{sources: sources}
+
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if err := parser.include(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(parser.rules) == 0 {
+		return nil, fmt.Errorf("no SecRule found in %q", patterns)
+	}
+
+	return parser.result(), nil
+}
+
+// include parses every file matched by a glob pattern in lexical order.
+func (p *secRuleParser) include(pattern string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid rule file pattern %q: %w", pattern, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no rule file matches %q", pattern)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		data, err := p.sources.read(file)
+		if err != nil {
+			return fmt.Errorf("error reading rule file: %w", err)
+		}
+		if err := p.parse(file, string(data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *secRuleParser) parse(file, data string) error {
+	directives, err := readDirectives(file, data)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range directives {
+		if err := p.directive(d); err != nil {
+			return fmt.Errorf("%s:%d: %w", d.file, d.line, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *secRuleParser) directive(d directive) error {
+	switch strings.ToLower(d.args[0]) {
+	case "secrule":
+		if len(d.args) < 3 || len(d.args) > 4 {
+			return fmt.Errorf("SecRule expects variables, operator and actions")
+		}
+		actions := ""
+		if len(d.args) == 4 {
+			actions = d.args[3]
+		}
+		return p.secRule(d, d.args[1], d.args[2], actions)
+	case "secruleremovebyid":
+		for _, arg := range d.args[1:] {
+			r, err := parseIDRange(arg)
+			if err != nil {
+				return err
+			}
+			p.removed = append(p.removed, r)
+		}
+	case "include":
+		if len(d.args) != 2 {
+			return fmt.Errorf("Include expects a file pattern")
+		}
+		pattern := d.args[1]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(d.file), pattern)
+		}
+		return p.include(pattern)
+	default:
+		logger.Logger("[debug] SecRule directive ignored", d.args[0], fmt.Sprintf("%s:%d", d.file, d.line)).Debug()
+	}
+
+	return nil
+}
+
+func (p *secRuleParser) secRule(d directive, variables, operator, actions string) error {
+	rule, err := compileSecRule(variables, operator, actions)
+	if err != nil {
+		if _, unsupported := err.(unsupportedError); !unsupported {
+			return err
+		}
+
+		if !p.skipChain {
+			logger.Logger("[warn] SecRule skipped", fmt.Sprintf("%s:%d", d.file, d.line), err.Error()).Warn()
+		}
+
+		// drop the whole chain, its head is the last appended rule
+		if p.chainTail != nil {
+			p.rules = p.rules[:len(p.rules)-1]
+			p.chainTail = nil
+		}
+		p.skipChain = chainContinues(actions)
+		return nil
+	}
+
+	switch {
+	case p.skipChain:
+		p.skipChain = rule.chained
+		return nil
+	case p.chainTail != nil:
+		p.chainTail.next = rule
+	default:
+		if rule.id == "" {
+			return fmt.Errorf("SecRule is missing the id action")
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	p.chainTail = nil
+	if rule.chained {
+		p.chainTail = rule
+	}
+
+	return nil
+}
+
+// chainContinues reports whether the raw actions contain the chain action.
+func chainContinues(actions string) bool {
+	for _, action := range splitActions(actions) {
+		if strings.EqualFold(strings.TrimSpace(action), "chain") {
+			return true
+		}
+	}
+	return false
+}
+
+// result returns the parsed rules without the ones removed by SecRuleRemoveById.
+func (p *secRuleParser) result() []*secRule {
+	if len(p.removed) == 0 {
+		return p.rules
+	}
+
+	rules := make([]*secRule, 0, len(p.rules))
+	for _, rule := range p.rules {
+		id, _ := strconv.Atoi(rule.id)
+		removed := false
+		for _, r := range p.removed {
+			if id >= r.from && id <= r.to {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func parseIDRange(value string) (idRange, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	start, err := strconv.Atoi(from)
+	if err != nil {
+		return idRange{}, fmt.Errorf("invalid rule id %q", value)
+	}
+	if !isRange {
+		return idRange{start, start}, nil
+	}
+
+	end, err := strconv.Atoi(to)
+	if err != nil {
+		return idRange{}, fmt.Errorf("invalid rule id range %q", value)
+	}
+	return idRange{start, end}, nil
+}
+
+// unsupportedError marks a valid rule using a feature go-waf does not implement.
+type unsupportedError string
+
+func (e unsupportedError) Error() string {
+	return string(e)
+}
+
+func compileSecRule(variables, operator, actions string) (*secRule, error) {
+	rule := &secRule{
+		phase:    2,
+		severity: -1,
+		log:      true,
+	}
+
+	vars, err := parseVariables(variables)
+	if err != nil {
+		return nil, err
+	}
+	rule.variables = vars
+
+	op, err := parseOperator(operator)
+	if err != nil {
+		return nil, err
+	}
+	rule.operator = op
+
+	if err := rule.applyActions(actions); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (r *secRule) applyActions(actions string) error {
+	for _, action := range splitActions(actions) {
+		name, value, _ := strings.Cut(strings.TrimSpace(action), ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = unquote(strings.TrimSpace(value))
+
+		switch name {
+		case "":
+		case "id":
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid rule id %q", value)
+			}
+			r.id = value
+		case "phase":
+			phase, err := parsePhase(value)
+			if err != nil {
+				return err
+			}
+			r.phase = phase
+		case "msg":
+			r.msg = value
+		case "severity":
+			severity, err := parseSeverity(value)
+			if err != nil {
+				return err
+			}
+			r.severity = severity
+		case "deny", "drop":
+			r.deny = true
+		case "block", "pass":
+			r.deny = false
+		case "log", "auditlog":
+			r.log = true
+		case "nolog", "noauditlog":
+			r.log = false
+		case "chain":
+			r.chained = true
+		case "tag":
+			r.tags = append(r.tags, value)
+		case "t":
+			if strings.EqualFold(value, "none") {
+				r.transforms = nil
+				r.transformNames = nil
+				continue
+			}
+			transform, ok := transformations[strings.ToLower(value)]
+			if !ok {
+				return unsupportedError("unsupported transformation " + value)
+			}
+			r.transforms = append(r.transforms, transform)
+			r.transformNames = append(r.transformNames, value)
+		case "allow", "skip", "skipafter", "ctl", "exec":
+			// flow control and runtime configuration would change the meaning of the rule set
+			return unsupportedError("unsupported action " + name)
+		default:
+			// metadata and variable handling actions (ver, setvar, capture, ...) are ignored
+		}
+	}
+
+	if r.phase > 2 {
+		return unsupportedError(fmt.Sprintf("unsupported phase %d", r.phase))
+	}
+
+	return nil
+}
+
+func parsePhase(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "request":
+		return 2, nil
+	case "response":
+		return 4, nil
+	case "logging":
+		return 5, nil
+	}
+
+	phase, err := strconv.Atoi(value)
+	if err != nil || phase < 1 || phase > 5 {
+		return 0, fmt.Errorf("invalid phase %q", value)
+	}
+	return phase, nil
+}
+
+var severityNames = []string{"EMERGENCY", "ALERT", "CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+func parseSeverity(value string) (int, error) {
+	for level, name := range severityNames {
+		if strings.EqualFold(value, name) {
+			return level, nil
+		}
+	}
+
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 0 || level >= len(severityNames) {
+		return 0, fmt.Errorf("invalid severity %q", value)
+	}
+	return level, nil
+}
+
+// secRuleCollections lists the supported variables and whether they hold key/value pairs.
+var secRuleCollections = map[string]bool{
+	"ARGS":                  true,
+	"ARGS_NAMES":            true,
+	"ARGS_GET":              true,
+	"ARGS_GET_NAMES":        true,
+	"ARGS_POST":             true,
+	"ARGS_POST_NAMES":       true,
+	"REQUEST_HEADERS":       true,
+	"REQUEST_HEADERS_NAMES": true,
+	"FILES":                 true,
+	"FILES_NAMES":           true,
+	"REQUEST_COOKIES":       true,
+	"REQUEST_COOKIES_NAMES": true,
+	"REQUEST_URI":           false,
+	"REQUEST_FILENAME":      false,
+	"REQUEST_BASENAME":      false,
+	"REQUEST_METHOD":        false,
+	"QUERY_STRING":          false,
+	"REQUEST_BODY":          false,
+	"XML":                   true,
+}
+
+// xmlSelectors are the XPath expressions of the XML variable, the XML
+// arguments are named by their element path, with @ before an attribute.
+var xmlSelectors = map[string]*regexp.Regexp{
+	"/*":   regexp.MustCompile(`^[^@]*$`), // element text
+	"//@*": regexp.MustCompile(`@`),       // attribute values
+}
+
+func parseVariables(value string) ([]secVariable, error) {
+	var variables []secVariable
+
+	for _, item := range splitVariables(value) {
+		variable := secVariable{}
+		if strings.HasPrefix(item, "&") {
+			return nil, unsupportedError("unsupported variable count " + item)
+		}
+		if strings.HasPrefix(item, "!") {
+			variable.exclude = true
+			item = item[1:]
+		}
+
+		collection, key, hasKey := strings.Cut(item, ":")
+		variable.collection = strings.ToUpper(collection)
+		keyed, ok := secRuleCollections[variable.collection]
+		if !ok {
+			return nil, unsupportedError("unsupported variable " + collection)
+		}
+
+		if hasKey {
+			if !keyed {
+				return nil, fmt.Errorf("variable %s has no keys", collection)
+			}
+			key = unquote(key)
+			if variable.collection == "XML" {
+				selector, ok := xmlSelectors[key]
+				if !ok {
+					return nil, unsupportedError("unsupported XPath " + key)
+				}
+				variable.keyRegex = selector
+			} else if len(key) > 1 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") {
+				re, err := regexp.Compile("(?i)" + key[1:len(key)-1])
+				if err != nil {
+					return nil, unsupportedError("unsupported variable regex " + key)
+				}
+				variable.keyRegex = re
+			} else {
+				variable.key = strings.ToLower(key)
+			}
+		} else if variable.exclude {
+			return nil, fmt.Errorf("variable exclusion %s needs a key", collection)
+		}
+
+		variables = append(variables, variable)
+	}
+
+	if len(variables) == 0 {
+		return nil, fmt.Errorf("SecRule has no variables")
+	}
+
+	return variables, nil
+}
+
+// splitVariables splits on '|' while keeping regex selectors intact.
+func splitVariables(value string) []string {
+	var items []string
+	var current strings.Builder
+	inRegex := false
+
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case ch == '\\' && inRegex && i+1 < len(value):
+			current.WriteByte(ch)
+			i++
+			current.WriteByte(value[i])
+			continue
+		case ch == '/' && !inRegex && strings.HasSuffix(current.String(), ":") && !isXMLVariable(current.String()):
+			inRegex = true
+		case ch == '/' && inRegex:
+			inRegex = false
+		case ch == '|' && !inRegex:
+			if item := strings.TrimSpace(current.String()); item != "" {
+				items = append(items, item)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteByte(ch)
+	}
+
+	if item := strings.TrimSpace(current.String()); item != "" {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// isXMLVariable reports whether the item is the XML variable, its key is an
+// XPath expression rather than a regex.
+func isXMLVariable(item string) bool {
+	return strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(item), "!"), "XML:")
+}
+
+func parseOperator(value string) (secOperator, error) {
+	op := secOperator{}
+	value = strings.TrimSpace(value)
+
+	if strings.HasPrefix(value, "!") {
+		op.negate = true
+		value = strings.TrimSpace(value[1:])
+	}
+
+	name, argument := "rx", value
+	if strings.HasPrefix(value, "@") {
+		name, argument, _ = strings.Cut(value[1:], " ")
+		argument = strings.TrimSpace(argument)
+	}
+	op.name = strings.ToLower(name)
+
+	if strings.Contains(argument, "%{") {
+		return op, unsupportedError("unsupported macro in operator " + value)
+	}
+
+	switch op.name {
+	case "rx":
+		re, err := regexp.Compile(argument)
+		if err != nil {
+			return op, unsupportedError("unsupported regex: " + err.Error())
+		}
+		op.match = re.MatchString
+	case "pm":
+		phrases := strings.Fields(strings.ToLower(argument))
+		if len(phrases) == 0 {
+			return op, fmt.Errorf("@pm needs at least one phrase")
+		}
+		op.match = func(v string) bool {
+			v = strings.ToLower(v)
+			for _, phrase := range phrases {
+				if strings.Contains(v, phrase) {
+					return true
+				}
+			}
+			return false
+		}
+	case "contains":
+		op.match = func(v string) bool { return strings.Contains(v, argument) }
+	case "streq":
+		op.match = func(v string) bool { return v == argument }
+	case "beginswith":
+		op.match = func(v string) bool { return strings.HasPrefix(v, argument) }
+	case "endswith":
+		op.match = func(v string) bool { return strings.HasSuffix(v, argument) }
+	case "within":
+		op.match = func(v string) bool { return v != "" && strings.Contains(argument, v) }
+	case "eq", "ge", "gt", "le", "lt":
+		expected, err := strconv.Atoi(argument)
+		if err != nil {
+			return op, fmt.Errorf("@%s needs a number", name)
+		}
+		op.match = numericOperator(op.name, expected)
+	case "detectsqli":
+		op.match = func(v string) bool {
+			injection, _ := libinjection.IsSQLi(v)
+			return injection
+		}
+	case "detectxss":
+		op.match = libinjection.IsXSS
+	case "unconditionalmatch":
+		op.match = func(string) bool { return true }
+	case "nomatch":
+		op.match = func(string) bool { return false }
+	default:
+		return op, unsupportedError("unsupported operator @" + name)
+	}
+
+	return op, nil
+}
+
+func numericOperator(name string, expected int) func(string) bool {
+	return func(v string) bool {
+		// like ModSecurity, values that are not numbers are compared as 0
+		actual, _ := strconv.Atoi(strings.TrimSpace(v))
+		switch name {
+		case "eq":
+			return actual == expected
+		case "ge":
+			return actual >= expected
+		case "gt":
+			return actual > expected
+		case "le":
+			return actual <= expected
+		default:
+			return actual < expected
+		}
+	}
+}
+
+// splitActions splits the action list on commas outside single quotes.
+func splitActions(actions string) []string {
+	var items []string
+	var current strings.Builder
+	inQuote := false
+
+	for i := 0; i < len(actions); i++ {
+		ch := actions[i]
+		switch {
+		case ch == '\\' && inQuote && i+1 < len(actions):
+			current.WriteByte(ch)
+			i++
+			current.WriteByte(actions[i])
+			continue
+		case ch == '\'':
+			inQuote = !inQuote
+		case ch == ',' && !inQuote:
+			items = append(items, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteByte(ch)
+	}
+	items = append(items, current.String())
+
+	return items
+}
+
+// unquote removes surrounding single quotes.
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], `\'`, `'`)
+	}
+	return value
+}
+
+// readDirectives joins continuation lines, drops comments and tokenizes every directive.
+func readDirectives(file, data string) ([]directive, error) {
+	var directives []directive
+	var current strings.Builder
+	start := 0
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if current.Len() == 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			start = i + 1
+		}
+
+		if strings.HasSuffix(trimmed, "\\") {
+			current.WriteString(strings.TrimSuffix(trimmed, "\\"))
+			current.WriteByte(' ')
+			if i < len(lines)-1 {
+				continue
+			}
+		} else {
+			current.WriteString(trimmed)
+		}
+
+		args, err := tokenize(current.String())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, start, err)
+		}
+		current.Reset()
+		if len(args) > 0 {
+			directives = append(directives, directive{file: file, line: start, args: args})
+		}
+	}
+
+	return directives, nil
+}
+
+// tokenize splits a directive on whitespace, double quoted arguments may contain
+// whitespace and escaped quotes, other escapes are kept for the regex engine.
+func tokenize(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuote, hasToken := false, false
+
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case inQuote && ch == '\\' && i+1 < len(line) && line[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case ch == '"':
+			inQuote = !inQuote
+			hasToken = true
+		case !inQuote && (ch == ' ' || ch == '\t'):
+			if hasToken {
+				args = append(args, current.String())
+				current.Reset()
+				hasToken = false
+			}
+		default:
+			current.WriteByte(ch)
+			hasToken = true
+		}
+	}
+
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if hasToken {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
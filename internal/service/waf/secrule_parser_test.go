@@ -0,0 +1,379 @@
+package service_waf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// crsRules are rules of the OWASP Core Rule Set 3.3 as they are distributed.
+const crsRules = `
+# ------------------------------------------------------------------------
+# OWASP ModSecurity Core Rule Set ver.3.3.5
+# ------------------------------------------------------------------------
+
+SecAction \
+    "id:900990,\
+    phase:1,\
+    nolog,\
+    pass,\
+    t:none,\
+    setvar:tx.crs_setup_version=335"
+
+SecRule REQUEST_METHOD "@rx ^(?:GET|HEAD)$" \
+    "id:920170,\
+    phase:1,\
+    block,\
+    t:none,\
+    msg:'GET or HEAD Request with Body Content',\
+    logdata:'%{MATCHED_VAR}',\
+    tag:'application-multi',\
+    tag:'language-multi',\
+    tag:'platform-multi',\
+    tag:'attack-protocol',\
+    tag:'paranoia-level/1',\
+    tag:'OWASP_CRS',\
+    tag:'capec/1000/210/272',\
+    ver:'OWASP_CRS/3.3.5',\
+    severity:'CRITICAL',\
+    chain"
+    SecRule REQUEST_HEADERS:Content-Length "!@rx ^0?$" \
+        "t:none,\
+        setvar:'tx.anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+
+SecRule REQUEST_PROTOCOL "!@within HTTP/2 HTTP/2.0" \
+    "id:920180,\
+    phase:1,\
+    pass,\
+    t:none,\
+    msg:'POST without Content-Length or Transfer-Encoding headers',\
+    severity:'WARNING',\
+    chain"
+    SecRule REQUEST_METHOD "@streq POST" \
+        "chain"
+        SecRule &REQUEST_HEADERS:Content-Length "@eq 0" \
+            "chain"
+            SecRule &REQUEST_HEADERS:Transfer-Encoding "@eq 0" \
+                "setvar:'tx.anomaly_score_pl1=+%{tx.warning_anomaly_score}'"
+
+SecRule REQUEST_HEADERS:Range|REQUEST_HEADERS:Request-Range "@rx (\d+)-(\d+)" \
+    "id:920190,\
+    phase:1,\
+    block,\
+    capture,\
+    t:none,\
+    msg:'Range: Invalid Last Byte Value',\
+    severity:'WARNING',\
+    chain"
+    SecRule TX:2 "@lt %{tx.1}" \
+        "setvar:'tx.anomaly_score_pl1=+%{tx.warning_anomaly_score}'"
+
+SecRule REQUEST_HEADERS:User-Agent "@pmFromFile scanners-user-agents.data" \
+    "id:913100,\
+    phase:2,\
+    block,\
+    capture,\
+    t:none,t:lowercase,\
+    msg:'Found User-Agent associated with security scanner',\
+    severity:'CRITICAL'"
+
+SecRule ARGS_NAMES|ARGS|REQUEST_BODY|XML:/* "@rx [\n\r]+(?:get|post|head|options|connect|put|delete|trace|track|patch|propfind|propatch|mkcol|copy|move|lock|unlock)\s+[^\s]+(?:\s+http|[\r\n])" \
+    "id:921110,\
+    phase:2,\
+    block,\
+    capture,\
+    t:none,t:htmlEntityDecode,t:lowercase,\
+    msg:'HTTP Request Smuggling Attack',\
+    logdata:'Matched Data: %{TX.0} found within %{MATCHED_VAR_NAME}: %{MATCHED_VAR}',\
+    tag:'attack-protocol',\
+    severity:'CRITICAL',\
+    setvar:'tx.http_violation_score=+%{tx.critical_anomaly_score}'"
+
+SecRule REQUEST_FILENAME|ARGS_NAMES|ARGS|XML:/* "@rx (?:<\?(?:[^x]|x[^m]|xm[^l]|xml[^\s]|xml$|$)|<\?php|\[(?:/|\\\\)?php\])" \
+    "id:933100,\
+    phase:2,\
+    block,\
+    capture,\
+    t:none,t:lowercase,\
+    msg:'PHP Injection Attack: PHP Open Tag Found',\
+    tag:'attack-injection-php',\
+    severity:'CRITICAL'"
+
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES|!REQUEST_COOKIES:/__utm/|REQUEST_COOKIES_NAMES|REQUEST_BODY|REQUEST_HEADERS|XML:/*|XML://@* \
+    "@rx java\.lang\.(?:runtime|processbuilder)" \
+    "id:944100,\
+    phase:2,\
+    block,\
+    log,\
+    msg:'Remote Command Execution: Suspicious Java class detected',\
+    t:none,t:lowercase,\
+    tag:'attack-rce',\
+    severity:'CRITICAL'"
+
+SecMarker "BEGIN-REQUEST-BLOCKING-EVAL"
+
+SecRule TX:ANOMALY_SCORE "@ge %{tx.inbound_anomaly_score_threshold}" \
+    "id:949110,\
+    phase:2,\
+    deny,\
+    t:none,\
+    msg:'Inbound Anomaly Score Exceeded (Total Score: %{TX.ANOMALY_SCORE})',\
+    tag:'anomaly-evaluation'"
+`
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`SecRule ARGS "@rx foo bar" "id:1,deny"`, []string{"SecRule", "ARGS", "@rx foo bar", "id:1,deny"}},
+		{"SecRule\tARGS  \"@contains x\"\t\"id:1\"", []string{"SecRule", "ARGS", "@contains x", "id:1"}},
+		{`SecRule ARGS "@rx \"quoted\"" "id:1"`, []string{"SecRule", "ARGS", `@rx "quoted"`, "id:1"}},
+		{`SecRule ARGS "@rx \d+\.\\x" "id:1"`, []string{"SecRule", "ARGS", `@rx \d+\.\\x`, "id:1"}},
+		{`SecRule ARGS "" "id:1"`, []string{"SecRule", "ARGS", "", "id:1"}},
+		{`SecRuleRemoveById 920170 930000-930999`, []string{"SecRuleRemoveById", "920170", "930000-930999"}},
+		{`   `, nil},
+	}
+
+	for _, test := range tests {
+		got, err := tokenize(test.line)
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", test.line, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	if _, err := tokenize(`SecRule ARGS "@rx x`); err == nil {
+		t.Error("tokenize of an unterminated quote: error = nil")
+	}
+}
+
+func TestReadDirectives(t *testing.T) {
+	directives, err := readDirectives("test.conf", crsRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range directives {
+		names = append(names, d.args[0])
+	}
+	want := []string{"SecAction", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecRule", "SecMarker", "SecRule"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("directives = %q, want %q", names, want)
+	}
+
+	// the continuation lines are joined, the line is the first one
+	rule := directives[1]
+	if rule.line != 14 || len(rule.args) != 4 {
+		t.Fatalf("920170 at line %d with %d arguments, want line 14 with 4", rule.line, len(rule.args))
+	}
+	if !strings.HasPrefix(rule.args[3], "id:920170, phase:1, block,") || !strings.HasSuffix(rule.args[3], "chain") {
+		t.Errorf("920170 actions = %q", rule.args[3])
+	}
+
+	if _, err := readDirectives("test.conf", "SecRule ARGS \"@rx x\" \\\n    \"id:1"); err == nil {
+		t.Error("readDirectives of an unterminated quote: error = nil")
+	}
+}
+
+func TestParseCRSRules(t *testing.T) {
+	rules := parseSecRules(t, crsRules)
+
+	var ids []string
+	for _, rule := range rules {
+		ids = append(ids, rule.id)
+	}
+	// 920180, 920190 and 913100 use unsupported variables or operators, the
+	// whole chain is skipped, 949110 evaluates the TX collection
+	if want := []string{"920170", "921110", "933100", "944100"}; !slices.Equal(ids, want) {
+		t.Fatalf("rules = %v, want %v", ids, want)
+	}
+
+	chained := rules[0]
+	if chained.phase != 1 || chained.severity != 2 || chained.deny || !chained.chained || len(chained.tags) != 7 {
+		t.Errorf("920170 = phase %d, severity %d, deny %v, chained %v, tags %q", chained.phase, chained.severity, chained.deny, chained.chained, chained.tags)
+	}
+	if chained.msg != "GET or HEAD Request with Body Content" {
+		t.Errorf("920170 msg = %q", chained.msg)
+	}
+	next := chained.next
+	if next == nil || next.next != nil || next.variables[0].collection != "REQUEST_HEADERS" || next.variables[0].key != "content-length" || !next.operator.negate {
+		t.Fatalf("920170 chain = %+v", next)
+	}
+
+	smuggling := rules[1]
+	if smuggling.phase != 2 || !slices.Equal(smuggling.transformNames, []string{"htmlEntityDecode", "lowercase"}) || len(smuggling.variables) != 4 {
+		t.Errorf("921110 = phase %d, transforms %q, %d variables", smuggling.phase, smuggling.transformNames, len(smuggling.variables))
+	}
+
+	java := rules[3]
+	var collections []string
+	for _, variable := range java.variables {
+		name := variable.collection
+		if variable.exclude {
+			name = "!" + name
+		}
+		collections = append(collections, name)
+	}
+	want := []string{"ARGS", "ARGS_NAMES", "REQUEST_COOKIES", "!REQUEST_COOKIES", "REQUEST_COOKIES_NAMES", "REQUEST_BODY", "REQUEST_HEADERS", "XML", "XML"}
+	if !slices.Equal(collections, want) {
+		t.Errorf("944100 variables = %q, want %q", collections, want)
+	}
+	if utm := java.variables[3].keyRegex; utm == nil || !utm.MatchString("__utmz") || utm.MatchString("session") {
+		t.Errorf("944100 cookie exclusion = %v", utm)
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	tests := []struct {
+		value       string
+		count       int
+		unsupported bool
+		invalid     bool
+	}{
+		{value: "ARGS", count: 1},
+		{value: "ARGS:id|ARGS_NAMES|REQUEST_HEADERS:User-Agent", count: 3},
+		{value: "ARGS|!ARGS:password", count: 2},
+		{value: "REQUEST_COOKIES|!REQUEST_COOKIES:/__utm/", count: 2},
+		{value: "ARGS:/^(?:id|name)$/|REQUEST_URI", count: 2},
+		{value: `ARGS:/^a\/b$/|ARGS_NAMES`, count: 2},
+		{value: "ARGS:'/^json\\./'", count: 1},
+		{value: "XML:/*|XML://@*", count: 2},
+		{value: "request_headers:referer", count: 1},
+		{value: "XML://book/title", unsupported: true},
+		{value: "&REQUEST_HEADERS:Host", unsupported: true},
+		{value: "TX:ANOMALY_SCORE", unsupported: true},
+		{value: "ARGS:/[/", unsupported: true},
+		{value: "ARGS|!ARGS", invalid: true},
+		{value: "REQUEST_URI:path", invalid: true},
+		{value: "", invalid: true},
+	}
+
+	for _, test := range tests {
+		variables, err := parseVariables(test.value)
+		_, unsupported := err.(unsupportedError)
+		switch {
+		case test.unsupported && !unsupported:
+			t.Errorf("parseVariables(%q) error = %v, want unsupported", test.value, err)
+		case test.invalid && (err == nil || unsupported):
+			t.Errorf("parseVariables(%q) error = %v, want invalid", test.value, err)
+		case !test.unsupported && !test.invalid && (err != nil || len(variables) != test.count):
+			t.Errorf("parseVariables(%q) = %d variables, %v, want %d", test.value, len(variables), err, test.count)
+		}
+	}
+}
+
+func TestSecRuleRemoveById(t *testing.T) {
+	rules := parseSecRules(t, crsRules+`
+SecRuleRemoveById 920170
+SecRuleRemoveById 933000-933999 944100
+`)
+
+	var ids []string
+	for _, rule := range rules {
+		ids = append(ids, rule.id)
+	}
+	if want := []string{"921110"}; !slices.Equal(ids, want) {
+		t.Errorf("rules = %v, want %v", ids, want)
+	}
+
+	parser := &secRuleParser{sources: newRuleSources()}
+	for _, line := range []string{"SecRuleRemoveById abc", "SecRuleRemoveById 10-x"} {
+		if err := parser.parse("test.conf", line); err == nil {
+			t.Errorf("%s: error = nil", line)
+		}
+	}
+}
+
+func TestEvaluateCRSRules(t *testing.T) {
+	engine := &secRuleEngine{
+		config: &config.Config{WAF_PROTECT_BODY: true, WAF_INBOUND_THRESHOLD: 5},
+		rules:  parseSecRules(t, crsRules),
+	}
+
+	tests := []struct {
+		name    string
+		request *service.Request
+		want    []string
+	}{
+		{
+			name: "clean request",
+			request: &service.Request{
+				Method: "GET", Path: "/search?q=java",
+				Headers: map[string][]string{"User-Agent": {"Mozilla/5.0"}},
+				Args:    []service.Argument{{Source: service.ArgsGet, Name: "q", Value: "java"}},
+			},
+		},
+		{
+			name: "GET with a body",
+			request: &service.Request{
+				Method: "GET", Path: "/",
+				Headers: map[string][]string{"Content-Length": {"12"}},
+			},
+			want: []string{"920170"},
+		},
+		{
+			name: "GET without a body",
+			request: &service.Request{
+				Method: "GET", Path: "/",
+				Headers: map[string][]string{"Content-Length": {"0"}},
+			},
+		},
+		{
+			name: "smuggled request in an argument",
+			request: &service.Request{
+				Method: "POST", Path: "/",
+				Args: []service.Argument{{Source: service.ArgsPost, Name: "x", Value: "a\r\nGET /admin HTTP/1.1\r\n"}},
+			},
+			want: []string{"921110"},
+		},
+		{
+			name: "PHP tag in an XML element",
+			request: &service.Request{
+				Method: "POST", Path: "/api", BodyProcessor: service.BodyXML,
+				Args: []service.Argument{{Source: service.ArgsPost, Name: "xml.user.name", Value: "<?php system('id'); ?>"}},
+				Body: []byte("<user><name>&lt;?php system('id'); ?&gt;</name></user>"),
+			},
+			want: []string{"933100"},
+		},
+		{
+			name: "Java class in an XML attribute",
+			request: &service.Request{
+				Method: "POST", Path: "/api", BodyProcessor: service.BodyXML,
+				Args: []service.Argument{{Source: service.ArgsPost, Name: "xml.bean@class", Value: "java.lang.ProcessBuilder"}},
+			},
+			want: []string{"944100"},
+		},
+		{
+			name: "Java class in an excluded cookie",
+			request: &service.Request{
+				Method: "GET", Path: "/",
+				Cookies: map[string][]string{"__utmz": {"java.lang.Runtime"}},
+			},
+		},
+		{
+			name: "Java class in a cookie",
+			request: &service.Request{
+				Method: "GET", Path: "/",
+				Cookies: map[string][]string{"session": {"java.lang.Runtime"}},
+			},
+			want: []string{"944100"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches := append(engine.detectHeaders(test.request), engine.detectBody(test.request)...)
+			if got := matchedRules(matches); !slices.Equal(got, test.want) {
+				t.Errorf("matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
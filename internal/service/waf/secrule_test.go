@@ -0,0 +1,89 @@
+package service_waf
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetLevel(logger.FATAL)
+	os.Exit(m.Run())
+}
+
+// parseSecRules compiles the rules of a configuration file content.
+func parseSecRules(t *testing.T, data string) []*secRule {
+	t.Helper()
+	parser := &secRuleParser{sources: newRuleSources()}
+	if err := parser.parse("test.conf", data); err != nil {
+		t.Fatal(err)
+	}
+	return parser.result()
+}
+
+// matchedRules returns the ids of the matches.
+func matchedRules(matches []service.Match) []string {
+	var ids []string
+	for _, match := range matches {
+		ids = append(ids, match.Rule)
+	}
+	return ids
+}
+
+func TestSecRulePhases(t *testing.T) {
+	rules := parseSecRules(t, `
+SecRule REQUEST_HEADERS:User-Agent "@contains sqlmap" "id:1,phase:1,deny"
+SecRule ARGS "@detectXSS" "id:2,phase:2,deny"
+SecRule REQUEST_URI "@contains /etc/passwd" "id:3,deny"
+SecRule REQUEST_BODY "@contains <!ENTITY" "id:4,phase:2,deny"
+`)
+
+	request := &service.Request{
+		Method:  "POST",
+		Path:    "/download?file=/etc/passwd&q=<script>alert(1)</script>",
+		Headers: map[string][]string{"User-Agent": {"sqlmap/1.7"}},
+		Args: []service.Argument{
+			{Source: service.ArgsGet, Name: "file", Value: "/etc/passwd"},
+			{Source: service.ArgsGet, Name: "q", Value: "<script>alert(1)</script>"},
+			{Source: service.ArgsPost, Name: "comment", Value: "<img src=x onerror=alert(1)>"},
+		},
+		Body: []byte(`<!DOCTYPE x [<!ENTITY e SYSTEM "file:///etc/passwd">]>`),
+	}
+	bodyOnly := &service.Request{
+		Method: "POST",
+		Path:   "/comments",
+		Args:   []service.Argument{{Source: service.ArgsPost, Name: "comment", Value: "<img src=x onerror=alert(1)>"}},
+	}
+
+	tests := []struct {
+		name        string
+		protectBody bool
+		request     *service.Request
+		headers     []string
+		body        []string
+	}{
+		// phase 2 rules run on the URI, the headers and the query arguments without the body phase
+		{"header phase only", false, request, []string{"1", "2", "3"}, []string{"2", "3", "4"}},
+		{"body argument without the body phase", false, bodyOnly, nil, []string{"2"}},
+		// with the body phase, phase 2 rules run once, on the whole request
+		{"header and body phases", true, request, []string{"1"}, []string{"2", "3", "4"}},
+		{"body argument with the body phase", true, bodyOnly, nil, []string{"2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := &secRuleEngine{config: &config.Config{WAF_PROTECT_BODY: test.protectBody, WAF_INBOUND_THRESHOLD: 5}, rules: rules}
+
+			if got := matchedRules(engine.detectHeaders(test.request)); !slices.Equal(got, test.headers) {
+				t.Errorf("detectHeaders = %v, want %v", got, test.headers)
+			}
+			if got := matchedRules(engine.detectBody(test.request)); !slices.Equal(got, test.body) {
+				t.Errorf("detectBody = %v, want %v", got, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package service_waf
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// SSRF rule ids, every rule blocks on its own.
+const (
+	RuleSSRFScheme       = "2401"
+	RuleSSRFInternalHost = "2402"
+	RuleRFI              = "2403"
+)
+
+// ssrfTag categorizes the SSRF rules for exclusions.
+const ssrfTag = "attack-ssrf"
+
+// urlPattern finds URL-like values: the scheme, the authority and the rest.
+var urlPattern = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]{1,15})://([^\s/?#"'<>\\]*)([^\s"'<>]*)`)
+
+// ssrfSchemes reach local files or non HTTP services from the backend.
+var ssrfSchemes = []string{"file", "gopher", "dict", "ldap", "ldaps", "tftp", "jar", "netdoc", "php", "phar", "expect"}
+
+// internalHosts are names of the local host and of the cloud metadata services,
+// the other names are only resolved with WAF_SSRF_RESOLVE.
+var internalHosts = []string{"localhost", "metadata", "metadata.google.internal", "instance-data", "instance-data.ec2.internal"}
+
+// scriptExtensions are the remote files included by RFI attacks.
+var scriptExtensions = []string{".php", ".phtml", ".php5", ".asp", ".aspx", ".jsp", ".jspx", ".cgi", ".pl", ".py", ".sh", ".txt"}
+
+// hostnamePattern matches the names worth a DNS query.
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,63}(?:\.[a-z0-9_-]{1,63})*$`)
+
+// maxResolvedHosts bounds the cache of the resolver, it is emptied when full.
+const maxResolvedHosts = 10000
+
+// ssrfIgnoredHeaders hold the URL of the page the browser comes from, an
+// internal address there is the normal case for internal users.
+var ssrfIgnoredHeaders = []string{"referer", "origin"}
+
+// detectSSRF looks for URLs to internal resources and remote script includes
+// in the arguments and the headers.
+func (w *WAFService) detectSSRF(request *service.Request) []service.Match {
+	var targets []target
+	if w.config.WAF_PROTECT_HEADER {
+		targets = append(targets, headerTargets(request)...)
+	}
+	if w.config.WAF_PROTECT_BODY {
+		targets = append(targets, bodyTargets(request)...)
+	}
+
+	var matches []service.Match
+	for _, t := range targets {
+		if t.source == sourcePath || (t.source == sourceHeader && slices.Contains(ssrfIgnoredHeaders, strings.ToLower(t.name))) {
+			continue
+		}
+
+		for _, found := range urlPattern.FindAllStringSubmatch(w.ssrfPipeline.apply(t.value), -1) {
+			rule, message := classifyURL(strings.ToLower(found[1]), found[2], found[3], t.source != sourceHeader, w.resolver)
+			if rule == "" {
+				continue
+			}
+
+			matches = append(matches, service.Match{
+				Rule:     rule,
+				Message:  message,
+				Variable: t.variable,
+				Value:    truncate(found[0], maxLogValueLength),
+				Score:    w.config.WAF_INBOUND_THRESHOLD,
+				Tags:     []string{ssrfTag},
+			})
+			break
+		}
+	}
+
+	return matches
+}
+
+// classifyURL returns the rule a URL violates, remote includes are only
+// looked for in arguments. The host names are resolved unless resolver is nil.
+func classifyURL(scheme, authority, rest string, argument bool, resolver *hostResolver) (string, string) {
+	if slices.Contains(ssrfSchemes, scheme) {
+		return RuleSSRFScheme, "SSRF Attack: dangerous URL scheme " + scheme
+	}
+
+	if internalHost(authority, resolver) {
+		return RuleSSRFInternalHost, "SSRF Attack: URL to an internal address"
+	}
+
+	if argument && (scheme == "http" || scheme == "https" || scheme == "ftp" || scheme == "ftps") {
+		// a trailing ? turns the suffix appended by the application into a query string
+		resource, _, _ := strings.Cut(rest, "?")
+		if slices.Contains(scriptExtensions, strings.ToLower(path.Ext(resource))) || strings.HasSuffix(rest, "?") {
+			return RuleRFI, "Remote File Inclusion Attack"
+		}
+	}
+
+	return "", ""
+}
+
+// internalHost reports whether the host of a URL authority is local, private,
+// link-local or a metadata service, whatever the encoding of the address.
+// A host name is internal when the resolver, unless nil, finds an internal address.
+func internalHost(authority string, resolver *hostResolver) bool {
+	host := authority
+	// the user info may hide the real host: http://trusted.com@127.0.0.1/
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		host = host[i+1:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(strings.ToLower(host), "[]"), ".")
+	if host == "" {
+		return false
+	}
+
+	if slices.Contains(internalHosts, host) || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		var ok bool
+		if addr, ok = parseLooseIPv4(host); !ok {
+			return resolver != nil && hostnamePattern.MatchString(host) && resolver.internal(host)
+		}
+	}
+
+	return internalAddr(addr)
+}
+
+// nonGlobalPrefixes are the special ranges not reachable on the internet that
+// netip does not report, like the carrier-grade NAT range of the Alibaba Cloud
+// metadata service 100.100.100.200.
+var nonGlobalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// nat64Prefix translates the IPv4 address in its last 32 bits.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// internalAddr reports whether an address is not a global unicast address:
+// loopback, private, link-local, multicast, unspecified or another special range.
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		bytes := addr.As16()
+		addr = netip.AddrFrom4([4]byte(bytes[12:]))
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+	for _, prefix := range nonGlobalPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostResolver resolves the host names of the URLs, so names like
+// 127.0.0.1.nip.io pointing to internal addresses are caught. The lookups
+// time out and their result is cached, a failed lookup is not internal.
+type hostResolver struct {
+	lookup  func(ctx context.Context, network, host string) ([]netip.Addr, error)
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	internal bool
+	expires  time.Time
+}
+
+func newHostResolver(timeout, ttl time.Duration) *hostResolver {
+	return &hostResolver{
+		lookup:  net.DefaultResolver.LookupNetIP,
+		timeout: timeout,
+		ttl:     ttl,
+		hosts:   make(map[string]resolvedHost),
+	}
+}
+
+// internal reports whether any address of host is internal.
+func (r *hostResolver) internal(host string) bool {
+	now := time.Now()
+	r.mu.Lock()
+	cached, ok := r.hosts[host]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.internal
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, _ := r.lookup(ctx, "ip", host)
+	internal := slices.ContainsFunc(addrs, internalAddr)
+
+	r.mu.Lock()
+	if len(r.hosts) >= maxResolvedHosts {
+		clear(r.hosts)
+	}
+	r.hosts[host] = resolvedHost{internal: internal, expires: now.Add(r.ttl)}
+	r.mu.Unlock()
+
+	return internal
+}
+
+// parseLooseIPv4 parses the IPv4 forms accepted by inet_aton: decimal 2130706433,
+// octal 0177.0.0.1, hexadecimal 0x7f.1 and short forms like 127.1.
+func parseLooseIPv4(host string) (netip.Addr, bool) {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		base := 10
+		switch {
+		case strings.HasPrefix(part, "0x"):
+			part, base = part[2:], 16
+		case len(part) > 1 && part[0] == '0':
+			base = 8
+		}
+
+		value, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		values[i] = value
+	}
+
+	// every part but the last is a byte, the last one fills the remaining bytes
+	var ip uint64
+	for _, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return netip.Addr{}, false
+		}
+		ip = ip<<8 | value
+	}
+	last := values[len(values)-1]
+	remaining := 8 * uint(5-len(values))
+	if last >= 1<<remaining {
+		return netip.Addr{}, false
+	}
+	ip = ip<<remaining | last
+
+	return netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}), true
+}
@@ -0,0 +1,157 @@
+package service_waf
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseLooseIPv4(t *testing.T) {
+	tests := []struct {
+		host string
+		want string // empty when the host is not an address
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"2130706433", "127.0.0.1"},
+		{"0177.0.0.1", "127.0.0.1"},
+		{"0177.0.0.01", "127.0.0.1"},
+		{"0x7f.0.0.1", "127.0.0.1"},
+		{"0x7f000001", "127.0.0.1"},
+		{"0x7f.1", "127.0.0.1"},
+		{"127.1", "127.0.0.1"},
+		{"127.0.1", "127.0.0.1"},
+		{"10.0x10.0300.1", "10.16.192.1"},
+		{"0", "0.0.0.0"},
+		{"4294967295", "255.255.255.255"},
+		{"169.254.43518", "169.254.169.254"},
+
+		{"4294967296", ""},
+		{"256.0.0.1", ""},
+		{"127.0.0.256", ""},
+		{"127.65536", "127.1.0.0"},
+		{"127.16777216", ""},
+		{"1.2.3.4.5", ""},
+		{"08.0.0.1", ""},
+		{"0x", ""},
+		{"127..1", ""},
+		{"example.com", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		addr, ok := parseLooseIPv4(test.host)
+		got := ""
+		if ok {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("parseLooseIPv4(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+// stubResolver resolves the names of hosts, the other names fail, and
+// counts the lookups.
+func stubResolver(hosts map[string]string, lookups *atomic.Int32) *hostResolver {
+	resolver := newHostResolver(time.Second, time.Minute)
+	resolver.lookup = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		lookups.Add(1)
+		if addr, ok := hosts[host]; ok {
+			return []netip.Addr{netip.MustParseAddr(addr)}, nil
+		}
+		if host == "slow.example" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("no such host")
+	}
+	return resolver
+}
+
+func TestInternalHost(t *testing.T) {
+	var lookups atomic.Int32
+	resolver := stubResolver(map[string]string{
+		"127.0.0.1.nip.io":  "127.0.0.1",
+		"metadata.evil.com": "169.254.169.254",
+		"redis":             "172.17.0.3",
+		"example.com":       "93.184.216.34",
+	}, &lookups)
+	resolver.timeout = 20 * time.Millisecond
+
+	tests := []struct {
+		authority string
+		resolver  *hostResolver
+		want      bool
+	}{
+		{"127.0.0.1", nil, true},
+		{"127.0.0.1:8080", nil, true},
+		{"trusted.com@127.0.0.1", nil, true},
+		{"[::1]:80", nil, true},
+		{"[::ffff:127.0.0.1]", nil, true},
+		{"2130706433", nil, true},
+		{"0x7f.1", nil, true},
+		{"169.254.169.254", nil, true},
+		{"LOCALHOST.", nil, true},
+		{"api.localhost", nil, true},
+		{"metadata.google.internal", nil, true},
+		{"100.100.100.200", nil, true},
+		{"100.64.0.1", nil, true},
+		{"100.128.0.1", nil, false},
+		{"0.1.2.3", nil, true},
+		{"198.18.0.1", nil, true},
+		{"255.255.255.255", nil, true},
+		{"224.0.0.1", nil, true},
+		{"[fd00::1]", nil, true},
+		{"[fe80::1]", nil, true},
+		{"[64:ff9b::a9fe:a9fe]", nil, true},
+		{"[64:ff9b::808:808]", nil, false},
+		{"[2606:4700::1111]", nil, false},
+		{"8.8.8.8", nil, false},
+		{"", nil, false},
+
+		// names are only resolved with a resolver
+		{"127.0.0.1.nip.io", nil, false},
+		{"127.0.0.1.nip.io", resolver, true},
+		{"127.0.0.1.NIP.IO:8080", resolver, true},
+		{"user@metadata.evil.com", resolver, true},
+		{"redis:6379", resolver, true},
+		{"example.com", resolver, false},
+		{"unknown.example", resolver, false},
+		{"slow.example", resolver, false},
+	}
+
+	for _, test := range tests {
+		if got := internalHost(test.authority, test.resolver); got != test.want {
+			t.Errorf("internalHost(%q) = %v, want %v", test.authority, got, test.want)
+		}
+	}
+}
+
+func TestHostResolverCache(t *testing.T) {
+	var lookups atomic.Int32
+	resolver := stubResolver(map[string]string{"127.0.0.1.nip.io": "127.0.0.1"}, &lookups)
+
+	for range 3 {
+		if !resolver.internal("127.0.0.1.nip.io") {
+			t.Fatal("127.0.0.1.nip.io is not internal")
+		}
+		// failed lookups are cached too
+		if resolver.internal("unknown.example") {
+			t.Fatal("unknown.example is internal")
+		}
+	}
+	if lookups.Load() != 2 {
+		t.Errorf("lookups = %d, want 2", lookups.Load())
+	}
+
+	// expired entries are resolved again
+	resolver.ttl = 0
+	resolver.internal("other.example")
+	resolver.internal("other.example")
+	if lookups.Load() != 4 {
+		t.Errorf("lookups = %d after expiry, want 4", lookups.Load())
+	}
+}
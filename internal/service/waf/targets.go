@@ -0,0 +1,85 @@
+package service_waf
+
+import (
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// Target sources, the part of the request a value comes from. Keyword rules
+// select the values they inspect with them.
+const (
+	sourcePath   = "path"
+	sourceQuery  = "query"
+	sourceHeader = "header"
+	sourceCookie = "cookie"
+	sourceBody   = "body"
+)
+
+// target is a single value to inspect, named after the SecRule variable it comes from.
+type target struct {
+	variable string
+	value    string
+
+	source string
+	name   string // header, cookie or argument name
+}
+
+// headerTargets returns the values available before the body is read: the
+// request path, every header value, the cookies and the query string arguments.
+func headerTargets(request *service.Request) []target {
+	path, _, _ := strings.Cut(request.Path, "?")
+	targets := []target{{variable: "REQUEST_FILENAME", value: path, source: sourcePath}}
+
+	for name, values := range request.Headers {
+		for _, value := range values {
+			targets = append(targets, target{variable: "REQUEST_HEADERS:" + name, value: value, source: sourceHeader, name: name})
+		}
+	}
+
+	for name, values := range request.Cookies {
+		targets = append(targets, target{variable: "REQUEST_COOKIES_NAMES:" + name, value: name, source: sourceCookie, name: name})
+		for _, value := range values {
+			targets = append(targets, target{variable: "REQUEST_COOKIES:" + name, value: value, source: sourceCookie, name: name})
+		}
+	}
+
+	return append(targets, argumentTargets(request, service.ArgsGet, sourceQuery)...)
+}
+
+// bodyTargets returns the body arguments, or the raw body when it could not be parsed.
+func bodyTargets(request *service.Request) []target {
+	if request.BodyProcessor == "" {
+		if len(request.Body) == 0 {
+			return nil
+		}
+		return []target{{variable: "REQUEST_BODY", value: string(request.Body), source: sourceBody}}
+	}
+
+	return append(argumentTargets(request, service.ArgsPost, sourceBody), argumentTargets(request, service.Files, sourceBody)...)
+}
+
+// argumentTargets returns the name and the value of every argument of a source.
+func argumentTargets(request *service.Request, argSource, source string) []target {
+	var targets []target
+	names := make(map[string]bool)
+
+	for _, arg := range request.Args {
+		if arg.Source != argSource {
+			continue
+		}
+
+		if arg.Source == service.Files {
+			targets = append(targets, target{variable: "FILES:" + arg.Name, value: arg.Value, source: source, name: arg.Name})
+			continue
+		}
+
+		if !names[arg.Name] {
+			names[arg.Name] = true
+			targets = append(targets, target{variable: "ARGS_NAMES:" + arg.Name, value: arg.Name, source: source, name: arg.Name})
+		}
+		targets = append(targets, target{variable: "ARGS:" + arg.Name, value: arg.Value, source: source, name: arg.Name})
+	}
+
+	return targets
+}
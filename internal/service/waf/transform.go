@@ -0,0 +1,210 @@
+package service_waf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// transformation normalizes a value before it is matched.
+type transformation func(string) string
+
+// pipeline is an ordered list of transformations applied to every inspected value.
+type pipeline []transformation
+
+// defaultPipeline is used by rule sets that do not configure their transformations.
+var defaultPipeline = []string{"url_decode", "unicode_decode", "html_entity_decode", "remove_nulls"}
+
+// newPipeline compiles transformation names, url_decode is applied recursively up to maxDepth.
+func newPipeline(names []string, maxDepth int) (pipeline, error) {
+	p := make(pipeline, 0, len(names))
+
+	for _, name := range names {
+		key := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+		if key == "urldecode" {
+			p = append(p, recursiveURLDecode(maxDepth))
+			continue
+		}
+
+		transform, ok := transformations[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformation %q", name)
+		}
+		p = append(p, transform)
+	}
+
+	return p, nil
+}
+
+// apply runs every transformation of the pipeline in order.
+func (p pipeline) apply(value string) string {
+	for _, transform := range p {
+		value = transform(value)
+	}
+	return value
+}
+
+// transformations maps the lowercased transformation names without underscores to their
+// implementation, they are shared by SecRule t: actions and the keyword pipelines.
+var transformations = map[string]transformation{
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"urldecode":          urlDecode,
+	"urldecodeuni":       urlDecodeUni,
+	"htmlentitydecode":   html.UnescapeString,
+	"compresswhitespace": compressWhitespace,
+	"removewhitespace":   removeWhitespace,
+	"removenulls":        removeNulls,
+	"trim":               strings.TrimSpace,
+	"normalizepath":      normalizePath,
+	"unicodedecode":      unicodeDecode,
+	"base64decode":       base64Decode,
+	"base64detect":       base64Detect,
+}
+
+// recursiveURLDecode decodes until the value is stable, so double encoding like %252e is caught.
+func recursiveURLDecode(maxDepth int) transformation {
+	return func(value string) string {
+		for i := 0; i < maxDepth; i++ {
+			decoded := urlDecode(value)
+			if decoded == value {
+				break
+			}
+			value = decoded
+		}
+		return value
+	}
+}
+
+// urlDecode decodes %XX sequences and '+', invalid sequences are kept as is.
+func urlDecode(value string) string {
+	return percentDecode(value, false)
+}
+
+// urlDecodeUni works like urlDecode and also decodes IIS style %uXXXX sequences.
+func urlDecodeUni(value string) string {
+	return percentDecode(value, true)
+}
+
+func percentDecode(value string, unicodeEscape bool) string {
+	if !strings.ContainsAny(value, "%+") {
+		return value
+	}
+
+	var decoded strings.Builder
+	decoded.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '+':
+			decoded.WriteByte(' ')
+		case value[i] == '%' && unicodeEscape && i+5 < len(value) && (value[i+1] == 'u' || value[i+1] == 'U'):
+			if code, err := strconv.ParseUint(value[i+2:i+6], 16, 16); err == nil {
+				decoded.WriteRune(rune(code))
+				i += 5
+			} else {
+				decoded.WriteByte(value[i])
+			}
+		case value[i] == '%' && i+2 < len(value):
+			if code, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				decoded.WriteByte(byte(code))
+				i += 2
+			} else {
+				decoded.WriteByte(value[i])
+			}
+		default:
+			decoded.WriteByte(value[i])
+		}
+	}
+
+	return decoded.String()
+}
+
+// unicodeDecode decodes %uXXXX and \uXXXX escape sequences.
+func unicodeDecode(value string) string {
+	if !strings.Contains(value, "%u") && !strings.Contains(value, "%U") && !strings.Contains(value, `\u`) {
+		return value
+	}
+
+	var decoded strings.Builder
+	decoded.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		if (value[i] == '%' || value[i] == '\\') && i+5 < len(value) && (value[i+1] == 'u' || value[i+1] == 'U') {
+			if code, err := strconv.ParseUint(value[i+2:i+6], 16, 16); err == nil {
+				decoded.WriteRune(rune(code))
+				i += 5
+				continue
+			}
+		}
+		decoded.WriteByte(value[i])
+	}
+
+	return decoded.String()
+}
+
+// base64Decode decodes the value, invalid input is returned unchanged.
+func base64Decode(value string) string {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return value
+	}
+	return string(decoded)
+}
+
+// base64Detect decodes values that look like base64 encoded text and keeps any other value.
+func base64Detect(value string) string {
+	trimmed := strings.TrimSpace(value)
+	if len(trimmed) < 8 || len(trimmed)%4 != 0 {
+		return value
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(trimmed)
+	if err != nil {
+		if decoded, err = base64.URLEncoding.DecodeString(trimmed); err != nil {
+			return value
+		}
+	}
+
+	if !utf8.Valid(decoded) {
+		return value
+	}
+	for _, r := range string(decoded) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return value
+		}
+	}
+
+	return string(decoded)
+}
+
+// compressWhitespace replaces every run of whitespace with a single space.
+func compressWhitespace(value string) string {
+	return strings.Join(strings.FieldsFunc(value, unicode.IsSpace), " ")
+}
+
+// removeWhitespace removes every whitespace character.
+func removeWhitespace(value string) string {
+	return strings.Join(strings.FieldsFunc(value, unicode.IsSpace), "")
+}
+
+// removeNulls removes NUL bytes.
+func removeNulls(value string) string {
+	return strings.ReplaceAll(value, "\x00", "")
+}
+
+// normalizePath resolves "." and ".." segments and duplicate slashes.
+func normalizePath(value string) string {
+	if value == "" {
+		return value
+	}
+
+	normalized := path.Clean(value)
+	if strings.HasSuffix(value, "/") && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized
+}
@@ -0,0 +1,145 @@
+package service_waf
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Upload rule ids, every rule blocks on its own.
+const (
+	RuleUploadExtension = "2101"
+	RuleUploadType      = "2102"
+	RuleUploadMagic     = "2103"
+	RuleUploadFileSize  = "2104"
+	RuleUploadTotalSize = "2105"
+	RuleUploadScript    = "2106"
+	RuleUploadMalware   = "2107"
+)
+
+// uploadTag categorizes the upload rules for exclusions.
+const uploadTag = "attack-upload"
+
+// sniffedTypes are the types whose content is recognized by
+// http.DetectContentType, the others can't be verified.
+var sniffedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp",
+	"application/pdf", "application/zip", "application/x-gzip",
+}
+
+// typeAliases maps the non standard types sent by some clients.
+var typeAliases = map[string]string{
+	"image/jpg":        "image/jpeg",
+	"image/pjpeg":      "image/jpeg",
+	"application/gzip": "application/x-gzip",
+}
+
+// scriptMarkers start server side code executed when the file is served.
+// The short markers occur by chance in binary data, they are only searched
+// in text files.
+var (
+	scriptMarkers      = [][]byte{[]byte("<?php"), []byte("<jsp:")}
+	shortScriptMarkers = [][]byte{[]byte("<?="), []byte("<%")}
+)
+
+// detectUploads checks the files of a multipart body.
+func (w *WAFService) detectUploads(request *service.Request) []service.Match {
+	var matches []service.Match
+	violation := func(rule, message string, file service.File) {
+		matches = append(matches, service.Match{
+			Rule:     rule,
+			Message:  message,
+			Variable: "FILES:" + file.Field,
+			Value:    truncate(file.FileName, maxProtocolValueLength),
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{uploadTag},
+		})
+	}
+
+	var total int64
+	for _, file := range request.Files {
+		size := int64(len(file.Content))
+		total += size
+
+		extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(file.FileName), "."))
+		if len(w.uploadExtensions) > 0 && !slices.Contains(w.uploadExtensions, extension) {
+			violation(RuleUploadExtension, "File extension is not allowed by policy", file)
+		}
+
+		declared := uploadType(file.ContentType)
+		if len(w.uploadTypes) > 0 && !slices.Contains(w.uploadTypes, declared) {
+			violation(RuleUploadType, "File content type is not allowed by policy", file)
+		}
+		if slices.Contains(sniffedTypes, declared) && uploadType(http.DetectContentType(file.Content)) != declared {
+			violation(RuleUploadMagic, "File content does not match its content type", file)
+		}
+
+		if limit := w.config.WAF_UPLOAD_MAX_FILE_SIZE; limit > 0 && size > limit {
+			violation(RuleUploadFileSize, fmt.Sprintf("File larger than %d bytes", limit), file)
+		}
+		if hasScript(file.Content) {
+			violation(RuleUploadScript, "Server side script in uploaded file", file)
+		}
+
+		if w.clamd != nil {
+			result, err := w.clamd.Scan(file.Content)
+			switch {
+			case err != nil:
+				logger.Logger("Fail to scan the uploaded file", file.FileName, err.Error()).Error()
+				if w.config.WAF_CLAMAV_FAIL_CLOSED {
+					violation(RuleUploadMalware, "Malware scan unavailable", file)
+				}
+			case result.Virus != "":
+				violation(RuleUploadMalware, "Malware Detected: "+result.Virus, file)
+			}
+		}
+	}
+
+	if limit := w.config.WAF_UPLOAD_MAX_TOTAL_SIZE; limit > 0 && total > limit {
+		matches = append(matches, service.Match{
+			Rule:     RuleUploadTotalSize,
+			Message:  fmt.Sprintf("Uploaded files larger than %d bytes", limit),
+			Variable: "FILES",
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{uploadTag},
+		})
+	}
+
+	return matches
+}
+
+// uploadType returns the lowercased media type without its parameters.
+func uploadType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if alias, ok := typeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// hasScript reports whether the content holds script tags or starts with a shebang.
+func hasScript(content []byte) bool {
+	if bytes.HasPrefix(content, []byte("#!")) {
+		return true
+	}
+
+	markers := scriptMarkers
+	if strings.HasPrefix(http.DetectContentType(content), "text/") {
+		markers = slices.Concat(scriptMarkers, shortScriptMarkers)
+	}
+
+	lower := bytes.ToLower(content)
+	return slices.ContainsFunc(markers, func(marker []byte) bool {
+		return bytes.Contains(lower, marker)
+	})
+}
@@ -0,0 +1,111 @@
+package service_waf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/clamd"
+)
+
+// pngHeader starts every PNG image.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// stubClamd listens on a Unix socket and answers every scan with reply once
+// the stream ends. It returns the socket.
+func stubClamd(t *testing.T, reply string) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// the stream ends with a zero length chunk
+				var stream []byte
+				buffer := make([]byte, 4096)
+				for !bytes.HasSuffix(stream, []byte("\x00\x00\x00\x00")) {
+					n, err := conn.Read(buffer)
+					if err != nil {
+						return
+					}
+					stream = append(stream, buffer[:n]...)
+				}
+				io.WriteString(conn, reply+"\x00")
+			}()
+		}
+	}()
+
+	return socket
+}
+
+func TestDetectUploads(t *testing.T) {
+	png := slices.Concat(pngHeader, []byte("image data"))
+
+	tests := []struct {
+		name  string
+		waf   *WAFService
+		files []service.File
+		rules []string
+	}{
+		{"clean image", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, nil},
+		{"extension not allowed", &WAFService{config: &config.Config{}, uploadExtensions: []string{"png"}},
+			[]service.File{{Field: "avatar", FileName: "a.PHP", ContentType: "image/png", Content: png}}, []string{RuleUploadExtension}},
+		{"type not allowed", &WAFService{config: &config.Config{}, uploadTypes: []string{"image/png"}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "text/html", Content: []byte("<p>")}}, []string{RuleUploadType}},
+		{"magic bytes mismatch", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: []byte("GIF89a....")}}, []string{RuleUploadMagic}},
+		{"aliased type", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "avatar", FileName: "a.jpg", ContentType: "image/jpg", Content: []byte("\xff\xd8\xff\xe0 jpeg")}}, nil},
+		{"unverifiable type", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "doc", FileName: "a.docx", ContentType: "application/msword", Content: []byte("data")}}, nil},
+		{"php in an image", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: slices.Concat(png, []byte("<?PHP system($_GET[0]); ?>"))}}, []string{RuleUploadScript}},
+		{"short marker in an image", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: slices.Concat(png, []byte("<%"))}}, nil},
+		{"short marker in a text file", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "page", FileName: "a.txt", ContentType: "text/plain", Content: []byte("<% exec %>")}}, []string{RuleUploadScript}},
+		{"shebang", &WAFService{config: &config.Config{}},
+			[]service.File{{Field: "script", FileName: "a.txt", ContentType: "text/plain", Content: []byte("#!/bin/sh\nid")}}, []string{RuleUploadScript}},
+		{"file too large", &WAFService{config: &config.Config{WAF_UPLOAD_MAX_FILE_SIZE: 10}},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, []string{RuleUploadFileSize}},
+		{"total too large", &WAFService{config: &config.Config{WAF_UPLOAD_MAX_FILE_SIZE: 20, WAF_UPLOAD_MAX_TOTAL_SIZE: 30}},
+			[]service.File{
+				{Field: "a", FileName: "a.txt", ContentType: "text/plain", Content: bytes.Repeat([]byte("a"), 20)},
+				{Field: "b", FileName: "b.txt", ContentType: "text/plain", Content: bytes.Repeat([]byte("b"), 20)},
+			}, []string{RuleUploadTotalSize}},
+		{"clean scan", &WAFService{config: &config.Config{}, clamd: clamd.NewClient(stubClamd(t, "stream: OK"), time.Second)},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, nil},
+		{"malware", &WAFService{config: &config.Config{}, clamd: clamd.NewClient(stubClamd(t, "stream: Eicar-Test-Signature FOUND"), time.Second)},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, []string{RuleUploadMalware}},
+		{"clamd unavailable, fail open", &WAFService{config: &config.Config{}, clamd: clamd.NewClient("/nonexistent/clamd.sock", time.Second)},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, nil},
+		{"clamd unavailable, fail closed", &WAFService{config: &config.Config{WAF_CLAMAV_FAIL_CLOSED: true}, clamd: clamd.NewClient("/nonexistent/clamd.sock", time.Second)},
+			[]service.File{{Field: "avatar", FileName: "a.png", ContentType: "image/png", Content: png}}, []string{RuleUploadMalware}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches := test.waf.detectUploads(&service.Request{Files: test.files})
+			if got := matchedRules(matches); !slices.Equal(got, test.rules) {
+				t.Errorf("rules = %v, want %v", got, test.rules)
+			}
+		})
+	}
+}
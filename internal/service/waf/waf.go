@@ -1,61 +1,258 @@
 package service_waf
 
 import (
-	"log"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/corazawaf/libinjection-go"
 	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/auditlog"
+	"github.com/jahrulnr/go-waf/pkg/clamd"
 	"github.com/jahrulnr/go-waf/pkg/logger"
-	"gopkg.in/yaml.v2"
 )
 
-type WAFService struct {
-	config *config.Config
+// Detector names used as keys of the anomaly score breakdown.
+const (
+	DetectorSQLi             = "sqli"
+	DetectorXSS              = "xss"
+	DetectorCommandInjection = "command_injection"
+	DetectorPathTraversal    = "path_traversal"
+)
+
+// Supported rule engines selected with WAF_ENGINE.
+const (
+	EngineKeywords = "keywords"
+	EngineSecRule  = "secrule"
+)
+
+// Supported modes selected with WAF_MODE.
+const (
+	ModeBlock  = "block"
+	ModeDetect = "detect"
+)
+
+// maxLogValueLength limits the matched value written to the log.
+const maxLogValueLength = 256
 
-	commandInjectionKeywords []string
-	pathTraversalKeywords    []string
+// ruleEngine evaluates a rule source against the request and returns every
+// rule or detector that matched.
+type ruleEngine interface {
+	detectHeaders(request *service.Request) []service.Match
+	detectBody(request *service.Request) []service.Match
+	// size returns the number of compiled rules or detectors
+	size() int
 }
 
-func NewWAFService(config *config.Config, keywordsFile string) service.WAFInterface {
-	keywords := loadKeywords(keywordsFile)
+type WAFService struct {
+	config       *config.Config
+	keywordsFile string
 
-	return &WAFService{
-		config: config,
+	// current rule set, swapped atomically on reload
+	current atomic.Pointer[ruleSet]
+	// serializes reloads and guards the fields below
+	mu          sync.Mutex
+	lastError   string
+	fingerprint string
 
-		commandInjectionKeywords: keywords.CommandInjectionKeywords,
-		pathTraversalKeywords:    keywords.PathTraversalKeywords,
-	}
+	// nil when WAF_AUDIT_LOG is empty
+	auditLog *auditlog.AuditLog
+
+	// protocol enforcement policy
+	allowedMethods  []string
+	allowedVersions []string
+
+	// upload policy, clamd is nil when WAF_CLAMAV_SOCKET is empty
+	uploadExtensions []string
+	uploadTypes      []string
+	clamd            *clamd.Client
+
+	// limits of the GraphQL endpoints by path
+	graphqlEndpoints map[string]graphqlLimits
+
+	// decodes the values before looking for URLs
+	ssrfPipeline pipeline
+	// resolves the URL host names, nil unless WAF_SSRF_RESOLVE
+	resolver *hostResolver
+
+	// nil unless WAF_LEARNING is enabled
+	learner *learner
+
+	// replaces the responses blocked by the response phase
+	errorPage     []byte
+	errorPageType string
 }
 
-func loadKeywords(filename string) service.Keywords {
-	data, err := os.ReadFile(filename)
+func NewWAFService(config *config.Config, keywordsFile string) service.WAFInterface {
+	w := &WAFService{
+		config:          config,
+		keywordsFile:    keywordsFile,
+		allowedMethods:  splitList(strings.ToUpper(config.WAF_ALLOWED_METHODS)),
+		allowedVersions: splitList(strings.ToUpper(config.WAF_ALLOWED_HTTP_VERSIONS)),
+	}
+
+	for _, extension := range splitList(strings.ToLower(config.WAF_UPLOAD_ALLOWED_EXTENSIONS)) {
+		w.uploadExtensions = append(w.uploadExtensions, strings.TrimPrefix(extension, "."))
+	}
+	for _, contentType := range splitList(config.WAF_UPLOAD_ALLOWED_TYPES) {
+		w.uploadTypes = append(w.uploadTypes, uploadType(contentType))
+	}
+	ssrfPipeline, err := newPipeline(defaultPipeline, config.WAF_DECODE_MAX_DEPTH)
 	if err != nil {
-		log.Fatalf("error reading keywords file: %v", err)
+		logger.Logger("[fatal] Fail to compile the SSRF pipeline", err.Error()).Fatal()
+	}
+	w.ssrfPipeline = ssrfPipeline
+	if config.WAF_SSRF_RESOLVE {
+		w.resolver = newHostResolver(time.Duration(config.WAF_SSRF_RESOLVE_TIMEOUT)*time.Millisecond, time.Duration(config.WAF_SSRF_RESOLVE_CACHE)*time.Second)
 	}
 
-	var keywords service.Keywords
-	err = yaml.Unmarshal(data, &keywords)
+	graphqlEndpoints, err := parseGraphQLPaths(config)
 	if err != nil {
-		log.Fatalf("error unmarshalling keywords: %v", err)
+		logger.Logger("[fatal] Invalid WAF_GRAPHQL_PATHS", err.Error()).Fatal()
+	}
+	w.graphqlEndpoints = graphqlEndpoints
+
+	if config.WAF_CLAMAV_SOCKET != "" {
+		w.clamd = clamd.NewClient(config.WAF_CLAMAV_SOCKET, time.Duration(config.WAF_CLAMAV_TIMEOUT)*time.Second)
+	}
+
+	if config.WAF_LEARNING {
+		if config.WAF_LEARNING_WINDOW <= 0 {
+			logger.Logger("[fatal] Invalid WAF_LEARNING_WINDOW", config.WAF_LEARNING_WINDOW).Fatal()
+		}
+		w.learner = newLearner(config.WAF_LEARNING_DIR)
+		time.AfterFunc(time.Duration(config.WAF_LEARNING_WINDOW)*time.Second, w.learner.finish)
+	}
+
+	if config.WAF_AUDIT_LOG != "" {
+		auditLog, err := auditlog.New(config.WAF_AUDIT_LOG, config.WAF_AUDIT_LOG_MAX_SIZE, config.WAF_AUDIT_LOG_MAX_BACKUPS)
+		if err != nil {
+			logger.Logger("[fatal] Fail to open the WAF audit log", err.Error()).Fatal()
+		}
+		w.auditLog = auditLog
 	}
 
-	return keywords
+	if config.WAF_PROTECT_RESPONSE {
+		w.errorPage, w.errorPageType = loadErrorPage()
+	}
+
+	// there is no previous rule set to fall back to on startup
+	if err := w.ReloadRules(); err != nil {
+		logger.Logger("[fatal] Fail to load WAF rules", err.Error()).Fatal()
+	}
+
+	w.watch()
+
+	return w
 }
 
 func (w *WAFService) HandleRequest(request *service.Request) (*service.Response, error) {
-	var headerThreatDetected, bodyThreatDetected bool
+	// every phase uses the same rule set even when a reload happens in between
+	set := w.current.Load()
+
+	// Virtual patches are evaluated first, a patched request needs no further inspection
+	matches := exclude(set.exclusions, request, w.detectPatches(set.patches, request))
+	if len(matches) == 0 {
+		matches = w.detect(set, request)
+	}
+
+	response := w.respond(request, matches)
+
+	// The passed requests are assumed legitimate while learning, their matches are false positives
+	if w.learner != nil && (response == nil || !response.Blocked) {
+		w.learner.record(request, matches)
+	}
+
+	return response, nil
+}
+
+// ValidateSchema enforces the OpenAPI spec of the request host and path, the
+// violations are scored and reported like the other matches.
+func (w *WAFService) ValidateSchema(request *service.Request) (*service.Response, error) {
+	set := w.current.Load()
+	matches := exclude(set.exclusions, request, w.detectOpenAPI(set.specs, request))
+	return w.respond(request, matches), nil
+}
+
+// respond scores the matches, logs and audits them and builds the 403
+// response of blocked requests. It returns nil when nothing matched.
+func (w *WAFService) respond(request *service.Request, matches []service.Match) *service.Response {
+	// Return a successful response if no threats are detected
+	if len(matches) == 0 {
+		return nil
+	}
+
+	scores := service.Scores{}
+	for _, match := range matches {
+		scores.Add(match.Rule, match.Score)
+	}
+
+	score := scores.Total()
+	wouldBlock := score >= w.config.WAF_INBOUND_THRESHOLD
+	detectOnly := strings.EqualFold(w.config.WAF_MODE, ModeDetect)
+	// suspicious requests below the threshold prove they come from a browser
+	challenge := !wouldBlock && !detectOnly && w.config.WAF_CHALLENGE_SCORE > 0 && score >= w.config.WAF_CHALLENGE_SCORE
+	response := &service.Response{
+		Headers:       make(map[string]string),
+		TransactionID: newTransactionID(),
+		Blocked:       wouldBlock && !detectOnly,
+		Challenge:     challenge,
+		Score:         score,
+		Scores:        scores,
+		Matches:       matches,
+	}
+
+	if w.config.WAF_DEBUG_HEADER {
+		response.Headers["X-WAF-Score"] = strconv.Itoa(score)
+		response.Headers["X-WAF-Scores"] = scores.String()
+	}
+
+	// In detection mode the request is passed, the header marks what would have been blocked
+	if wouldBlock && detectOnly {
+		response.Headers["X-WAF-Would-Block"] = scores.Rules()
+	}
+
+	w.logMatches(request, response, detectOnly)
+
+	action := AuditPassed
+	if response.Blocked {
+		action = AuditBlocked
+	} else if wouldBlock {
+		action = AuditDetected
+	} else if challenge {
+		action = AuditChallenged
+	}
+	w.audit(request, response, action)
+
+	// If the score reaches the inbound threshold, return a 403 response
+	if response.Blocked {
+		// quoted by users reporting a false positive
+		response.Headers["X-WAF-Transaction-ID"] = response.TransactionID
+		response.StatusCode = 403
+		response.Body = []byte("Threat Detected")
+	}
+
+	return response
+}
+
+// detect runs the protocol checks, the rule engine and the other detectors
+// concurrently and returns the matches left by the exclusions.
+func (w *WAFService) detect(set *ruleSet, request *service.Request) []service.Match {
+	var headerMatches, bodyMatches, uploadMatches, xmlMatches, graphqlMatches, ssrfMatches []service.Match
 	var wg sync.WaitGroup
 
+	protocolMatches := w.detectProtocol(request)
+	reputationMatches := detectReputation(request)
+
 	// Check for header threats
 	if w.config.WAF_PROTECT_HEADER {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			headerThreatDetected = w.DetectHeaderThreats(request)
+			headerMatches = set.engine.detectHeaders(request)
 		}()
 	}
 
@@ -64,88 +261,103 @@ func (w *WAFService) HandleRequest(request *service.Request) (*service.Response,
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			bodyThreatDetected = w.DetectBodyThreats(request)
+			bodyMatches = set.engine.detectBody(request)
 		}()
 	}
 
-	// Wait for all checks to complete
-	wg.Wait()
-
-	// If any threats are detected, return a 403 response
-	if headerThreatDetected || bodyThreatDetected {
-		return &service.Response{StatusCode: 403, Body: []byte("Threat Detected")}, nil
+	// Check for URLs to internal resources
+	if w.config.WAF_PROTECT_SSRF {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ssrfMatches = w.detectSSRF(request)
+		}()
 	}
 
-	// Return a successful response if no threats are detected
-	return nil, nil
-}
-
-func (w *WAFService) DetectHeaderThreats(request *service.Request) bool {
-	// Check for SQL injection patterns in headers
-	for _, value := range request.Headers {
-		if injection, _ := libinjection.IsSQLi(value); injection {
-			return true
-		}
+	// Check the uploaded files
+	if len(request.Files) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadMatches = w.detectUploads(request)
+		}()
 	}
 
-	// Check for XSS patterns in headers
-	for _, value := range request.Headers {
-		if libinjection.IsXSS(value) {
-			return true
-		}
+	// Check the structure of XML bodies
+	if isXML(request) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			xmlMatches = w.detectXML(request)
+		}()
 	}
 
-	// Check for command injection patterns in headers
-	for _, pattern := range w.commandInjectionKeywords {
-		for _, value := range request.Headers {
-			if strings.Contains(value, pattern) {
-				logger.Logger("Threat Detected", pattern).Warn()
-				return true
-			}
-		}
+	// Check the cost of GraphQL queries
+	if len(request.GraphQL) > 0 || len(request.GraphQLErrors) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			graphqlMatches = w.detectGraphQL(request)
+		}()
 	}
 
-	// Check for path traversal patterns in headers (if applicable)
-	for _, pattern := range w.pathTraversalKeywords {
-		for _, value := range request.Headers {
-			if strings.Contains(value, pattern) {
-				logger.Logger("Threat Detected", pattern).Warn()
-				return true
-			}
-		}
-	}
+	// Wait for all checks to complete
+	wg.Wait()
 
-	return false
+	return exclude(set.exclusions, request, slices.Concat(protocolMatches, reputationMatches, headerMatches, bodyMatches, uploadMatches, xmlMatches, graphqlMatches, ssrfMatches))
 }
 
-func (w *WAFService) DetectBodyThreats(request *service.Request) bool {
-	// Check for SQL injection patterns in headers
-	if injection, _ := libinjection.IsSQLi(string(request.Body)); injection {
-		logger.Logger("Threat Detected (SQL Injection)", string(request.Body)).Warn()
-		return true
-	}
-
-	// Check for XSS patterns in headers
-	if libinjection.IsXSS(string(request.Body)) {
-		logger.Logger("Threat Detected (XSS Attact)", string(request.Body)).Warn()
-		return true
+// logMatches writes every logged match and the resulting anomaly score.
+func (w *WAFService) logMatches(request *service.Request, response *service.Response, detectOnly bool) {
+	message := "Threat Detected"
+	if detectOnly {
+		message = "Threat Detected (detection only)"
 	}
 
-	// Check for command injection patterns
-	for _, pattern := range w.commandInjectionKeywords {
-		if strings.Contains(string(request.Body), pattern) {
-			logger.Logger("Threat Detected", pattern).Warn()
-			return true
+	for _, match := range response.Matches {
+		if match.NoLog {
+			continue
 		}
-	}
 
-	// Check for path traversal patterns
-	for _, pattern := range w.pathTraversalKeywords {
-		if strings.Contains(string(request.Body), pattern) {
-			logger.Logger("Threat Detected", pattern).Warn()
-			return true
-		}
+		logger.Logger(map[string]any{
+			"message":  message,
+			"id":       response.TransactionID,
+			"ip":       request.IP,
+			"method":   request.Method,
+			"path":     request.Path,
+			"rule":     match.Rule,
+			"msg":      match.Message,
+			"variable": match.Variable,
+			"value":    truncate(match.Value, maxLogValueLength),
+			"score":    match.Score,
+		}).Warn()
 	}
 
-	return false
+	logger.Logger(map[string]any{
+		"message": "Anomaly score",
+		"id":      response.TransactionID,
+		"ip":      request.IP,
+		"path":    request.Path,
+		"score":   response.Score,
+		"scores":  response.Scores.String(),
+		"blocked": response.Blocked,
+	}).Warn()
+}
+
+func (w *WAFService) DetectHeaderThreats(request *service.Request) []service.Match {
+	set := w.current.Load()
+	return exclude(set.exclusions, request, set.engine.detectHeaders(request))
+}
+
+func (w *WAFService) DetectBodyThreats(request *service.Request) []service.Match {
+	set := w.current.Load()
+	return exclude(set.exclusions, request, set.engine.detectBody(request))
+}
+
+// truncate shortens value to at most length bytes.
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+	return value[:length] + "..."
 }
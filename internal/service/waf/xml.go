@@ -0,0 +1,109 @@
+package service_waf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+)
+
+// XML rule ids, every rule blocks on its own.
+const (
+	RuleXMLExternalEntity = "2201"
+	RuleXMLEntityExpand   = "2202"
+	RuleXMLTooDeep        = "2203"
+)
+
+// xmlTag categorizes the XML rules for exclusions.
+const xmlTag = "attack-xxe"
+
+var (
+	// external DTDs and entities: <!DOCTYPE x SYSTEM "..."> or <!ENTITY % x PUBLIC "..." "...">
+	xmlExternalPattern = regexp.MustCompile(`(?i)\b(?:SYSTEM|PUBLIC)\s*["']`)
+	// entity values referencing other entities, the building block of the billion laughs attack
+	xmlEntityPattern    = regexp.MustCompile(`(?is)<!ENTITY\s+(?:%\s*)?[^\s>]+\s*(?:"[^"]*[&%][^"]*"|'[^']*[&%][^']*')`)
+	xmlEntityRefPattern = regexp.MustCompile(`[&%][\w.:-]+;`)
+)
+
+// detectXML checks the DTD and the depth of XML bodies, element text and
+// attribute values are inspected by the rule engine as arguments.
+func (w *WAFService) detectXML(request *service.Request) []service.Match {
+	if !isXML(request) {
+		return nil
+	}
+
+	var matches []service.Match
+	violation := func(rule, message, value string) {
+		matches = append(matches, service.Match{
+			Rule:     rule,
+			Message:  message,
+			Variable: "REQUEST_BODY",
+			Value:    truncate(value, maxProtocolValueLength),
+			Score:    w.config.WAF_INBOUND_THRESHOLD,
+			Tags:     []string{xmlTag},
+		})
+	}
+
+	// the lenient decoder keeps going on undefined entities
+	decoder := xml.NewDecoder(bytes.NewReader(request.Body))
+	decoder.Strict = false
+
+	depth, tooDeep := 0, false
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return matches
+		}
+
+		switch t := token.(type) {
+		case xml.Directive:
+			directive := string(t)
+			if !strings.HasPrefix(strings.ToUpper(directive), "DOCTYPE") {
+				continue
+			}
+			if xmlExternalPattern.MatchString(directive) {
+				violation(RuleXMLExternalEntity, "XML External Entity (XXE) declaration", directive)
+			}
+			for _, entity := range xmlEntityPattern.FindAllString(directive, -1) {
+				if xmlEntityRefPattern.MatchString(entity) {
+					violation(RuleXMLEntityExpand, "XML Entity Expansion", entity)
+					break
+				}
+			}
+		case xml.StartElement:
+			depth++
+			if limit := w.config.WAF_XML_MAX_DEPTH; limit > 0 && depth > limit && !tooDeep {
+				tooDeep = true
+				violation(RuleXMLTooDeep, fmt.Sprintf("XML document deeper than %d", limit), t.Name.Local)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// isXML reports whether the request declares an XML body.
+func isXML(request *service.Request) bool {
+	if len(request.Body) == 0 {
+		return false
+	}
+	if request.BodyProcessor == service.BodyXML {
+		return true
+	}
+
+	for name, values := range request.Headers {
+		if !strings.EqualFold(name, "Content-Type") || len(values) == 0 {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(values[0])
+		if err != nil {
+			return false
+		}
+		return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package ahocorasick
+
+import "sort"
+
+// Matcher finds every pattern contained in a text with a single scan,
+// whatever the number of patterns.
+type Matcher struct {
+	patterns []string
+	states   []state
+	// root transitions are dense, the scan restarts from the root on most bytes
+	root [256]int32
+}
+
+type state struct {
+	edges  []edge
+	fail   int32
+	output []int32 // ids of the patterns ending here, including suffix patterns
+}
+
+type edge struct {
+	label byte
+	to    int32
+}
+
+// New compiles the patterns, the pattern id is its index. Empty patterns never match.
+func New(patterns []string) *Matcher {
+	m := &Matcher{
+		patterns: patterns,
+		states:   []state{{}},
+	}
+
+	// build the trie
+	children := []map[byte]int32{{}}
+	for id, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		current := int32(0)
+		for i := 0; i < len(pattern); i++ {
+			next, ok := children[current][pattern[i]]
+			if !ok {
+				next = int32(len(m.states))
+				m.states = append(m.states, state{})
+				children = append(children, map[byte]int32{})
+				children[current][pattern[i]] = next
+			}
+			current = next
+		}
+		m.states[current].output = append(m.states[current].output, int32(id))
+	}
+
+	for i, edges := range children {
+		for label, to := range edges {
+			m.states[i].edges = append(m.states[i].edges, edge{label: label, to: to})
+		}
+		sort.Slice(m.states[i].edges, func(a, b int) bool {
+			return m.states[i].edges[a].label < m.states[i].edges[b].label
+		})
+	}
+	for _, e := range m.states[0].edges {
+		m.root[e.label] = e.to
+	}
+
+	// link every state to its longest proper suffix in the trie, breadth first
+	queue := make([]int32, 0, len(m.states))
+	for _, e := range m.states[0].edges {
+		queue = append(queue, e.to)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, e := range m.states[current].edges {
+			fail := m.states[current].fail
+			for fail != 0 && m.next(fail, e.label) < 0 {
+				fail = m.states[fail].fail
+			}
+			if to := m.next(fail, e.label); to >= 0 && to != e.to {
+				m.states[e.to].fail = to
+			}
+
+			target := &m.states[e.to]
+			target.output = append(target.output, m.states[target.fail].output...)
+			queue = append(queue, e.to)
+		}
+	}
+
+	return m
+}
+
+// next returns the transition of a state or -1, the root falls back to itself.
+func (m *Matcher) next(s int32, label byte) int32 {
+	if s == 0 {
+		return m.root[label]
+	}
+
+	edges := m.states[s].edges
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].label >= label })
+	if i < len(edges) && edges[i].label == label {
+		return edges[i].to
+	}
+	return -1
+}
+
+// FindAll returns the id of every pattern found in text, each id once in
+// order of first occurrence.
+func (m *Matcher) FindAll(text string) []int {
+	var found []int
+	current := int32(0)
+
+	for i := 0; i < len(text); i++ {
+		to := m.next(current, text[i])
+		for to < 0 {
+			current = m.states[current].fail
+			to = m.next(current, text[i])
+		}
+		current = to
+
+		for _, id := range m.states[current].output {
+			if !contains(found, int(id)) {
+				found = append(found, int(id))
+			}
+		}
+	}
+
+	return found
+}
+
+// Pattern returns the pattern of an id.
+func (m *Matcher) Pattern(id int) string {
+	return m.patterns[id]
+}
+
+// Len returns the number of patterns.
+func (m *Matcher) Len() int {
+	return len(m.patterns)
+}
+
+func contains(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package ahocorasick
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		text     string
+		want     []int
+	}{
+		{"no pattern", nil, "text", nil},
+		{"no match", []string{"union", "select"}, "harmless value", nil},
+		{"single", []string{"union", "select"}, "1 union 2", []int{0}},
+		{"order of first occurrence", []string{"union", "select"}, "select 1 union select 2", []int{1, 0}},
+		{"reported once", []string{"../"}, "../../../etc/passwd", []int{0}},
+		{"overlapping", []string{"abc", "bcd", "cde"}, "abcde", []int{0, 1, 2}},
+		{"suffix pattern", []string{"passwd", "wd"}, "/etc/passwd", []int{0, 1}},
+		{"suffix found through a failure link", []string{"abcx", "bc"}, "abcy", []int{1}},
+		{"prefix pattern", []string{"cat", "cat /etc"}, "cat /etc/shadow", []int{0, 1}},
+		{"nested patterns", []string{"a", "aa", "aaa"}, "aaaa", []int{0, 1, 2}},
+		{"duplicate patterns", []string{"eval", "eval"}, "eval(", []int{0, 1}},
+		{"empty patterns never match", []string{"", "x", ""}, "xyz", []int{1}},
+		{"empty text", []string{"x"}, "", nil},
+		{"restart after a failure", []string{"aab"}, "aaab", []int{0}},
+		{"binary bytes", []string{"\x00\xff", "\xff"}, "a\x00\xffb", []int{0, 1}},
+		{"case sensitive", []string{"SELECT"}, "select", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := New(test.patterns).FindAll(test.text)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("FindAll(%q) = %v, want %v", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+// TestFindAllContains compares the automaton with strings.Contains on random
+// patterns and texts over a small alphabet, so the patterns overlap a lot.
+func TestFindAllContains(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	word := func(maxLength int) string {
+		b := make([]byte, 1+random.Intn(maxLength))
+		for i := range b {
+			b[i] = "abc"[random.Intn(3)]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 200; i++ {
+		patterns := make([]string, 1+random.Intn(20))
+		for j := range patterns {
+			patterns[j] = word(5)
+		}
+		text := word(40)
+
+		var want []int
+		for id, pattern := range patterns {
+			if strings.Contains(text, pattern) {
+				want = append(want, id)
+			}
+		}
+		got := New(patterns).FindAll(text)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("FindAll(%q) of %q = %v, want %v", text, patterns, got, want)
+		}
+	}
+}
+
+// benchmarkKeywords returns random keywords of 4 to 11 bytes and a 208 byte
+// header value.
+func benchmarkKeywords(n int) ([]string, string) {
+	random := rand.New(rand.NewSource(1))
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	keywords := make([]string, n)
+	for i := range keywords {
+		b := make([]byte, 4+random.Intn(8))
+		for j := range b {
+			b[j] = alphabet[random.Intn(len(alphabet))]
+		}
+		keywords[i] = string(b)
+	}
+
+	value := strings.Repeat("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 ", 5)
+	return keywords, value[:208]
+}
+
+// benchmarkFound keeps the results of the benchmarks alive.
+var benchmarkFound []int
+
+// BenchmarkContainsLoop is the keyword scan the keywords engine did before
+// the automaton, kept as the baseline of BenchmarkFindAll.
+func BenchmarkContainsLoop(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		keywords, value := benchmarkKeywords(n)
+		b.Run(fmt.Sprintf("keywords=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var found []int
+				for id, keyword := range keywords {
+					if strings.Contains(value, keyword) {
+						found = append(found, id)
+					}
+				}
+				benchmarkFound = found
+			}
+		})
+	}
+}
+
+func BenchmarkFindAll(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		keywords, value := benchmarkKeywords(n)
+		matcher := New(keywords)
+		b.Run(fmt.Sprintf("keywords=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				benchmarkFound = matcher.FindAll(value)
+			}
+		})
+	}
+}
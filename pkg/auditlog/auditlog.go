@@ -0,0 +1,108 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// AuditLog writes records as JSON lines to a file, the file is rotated when
+// it reaches its maximum size: file.1 is the newest backup.
+type AuditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// New opens or creates the audit log file, maxSizeMB 0 disables rotation.
+func New(path string, maxSizeMB, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Write appends a record to the log.
+func (a *AuditLog) Write(record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the log file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups, the oldest one is removed. The log is reopened
+// even when the rotation fails, so records are not lost.
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+
+	var err error
+	if a.maxBackups > 0 {
+		os.Remove(a.backup(a.maxBackups))
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(a.backup(i), a.backup(i+1))
+		}
+		err = os.Rename(a.path, a.backup(1))
+	} else {
+		err = os.Remove(a.path)
+	}
+
+	if openErr := a.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (a *AuditLog) backup(index int) string {
+	return fmt.Sprintf("%s.%d", a.path, index)
+}
@@ -0,0 +1,154 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type record struct {
+	N int `json:"n"`
+}
+
+// readRecords returns the numbers of the records of a log file.
+func readRecords(t *testing.T, path string) []int {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		numbers = append(numbers, r.N)
+	}
+	return numbers
+}
+
+// newTestLog opens a log rotated past maxSize bytes, the size in megabytes of
+// New is too large for a test.
+func newTestLog(t *testing.T, path string, maxSize int64, maxBackups int) *AuditLog {
+	t.Helper()
+
+	log, err := New(path, 1, maxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+	log.maxSize = maxSize
+	return log
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		files      map[string][]int
+	}{
+		{
+			name:       "backups",
+			maxBackups: 2,
+			files: map[string][]int{
+				"audit.log":   {9},
+				"audit.log.1": {7, 8},
+				"audit.log.2": {5, 6},
+			},
+		},
+		{
+			name:       "more backups than rotations",
+			maxBackups: 10,
+			files: map[string][]int{
+				"audit.log":   {9},
+				"audit.log.1": {7, 8},
+				"audit.log.2": {5, 6},
+				"audit.log.3": {3, 4},
+				"audit.log.4": {1, 2},
+			},
+		},
+		{
+			name:       "no backup",
+			maxBackups: 0,
+			files:      map[string][]int{"audit.log": {9}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// every record is 8 bytes, two fit in the file
+			log := newTestLog(t, filepath.Join(dir, "audit.log"), 16, test.maxBackups)
+			for n := 1; n <= 9; n++ {
+				if err := log.Write(record{N: n}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.files) {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("files = %v, want %d files", names, len(test.files))
+			}
+			for name, want := range test.files {
+				if got := readRecords(t, filepath.Join(dir, name)); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateReopened(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	// the size of the existing file counts
+	if err := os.WriteFile(path, []byte(`{"n":1}`+"\n"+`{"n":2}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	log := newTestLog(t, path, 16, 1)
+	if err := log.Write(record{N: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRecords(t, path+".1"); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("audit.log.1 = %v, want [1 2]", got)
+	}
+
+	// a record larger than the limit is written to the empty file
+	log.maxSize = 4
+	if err := log.Write(record{N: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Write(record{N: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRecords(t, path); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("audit.log = %v, want [5]", got)
+	}
+	if got := readRecords(t, path+".1"); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("audit.log.1 = %v, want [4]", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,89 @@
+package clamd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of the INSTREAM chunks, below the default StreamMaxLength of clamd.
+const chunkSize = 64 * 1024
+
+// Client scans data with a ClamAV daemon listening on a Unix socket.
+type Client struct {
+	socket  string
+	timeout time.Duration
+}
+
+// Result is the verdict of a scan, Virus is empty when the data is clean.
+type Result struct {
+	Virus string
+}
+
+func NewClient(socket string, timeout time.Duration) *Client {
+	return &Client{
+		socket:  socket,
+		timeout: timeout,
+	}
+}
+
+// Scan streams data to clamd with the INSTREAM command.
+func (c *Client) Scan(data []byte) (Result, error) {
+	conn, err := net.DialTimeout("unix", c.socket, c.timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+
+	// every chunk is prefixed by its length, a zero length ends the stream
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		chunk := data[:min(chunkSize, len(data))]
+		data = data[len(chunk):]
+
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err := conn.Write(size); err != nil {
+			return Result{}, err
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return Result{}, err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return parseReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseReply reads replies like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseReply(reply string) (Result, error) {
+	_, verdict, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Virus: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+
+	return Result{}, fmt.Errorf("clamd error: %s", verdict)
+}
@@ -0,0 +1,164 @@
+package clamd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test file.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// stubServer listens on a Unix socket like clamd, reads the INSTREAM
+// command and answers with reply of the streamed data. It returns the socket.
+func stubServer(t *testing.T, reply func(data []byte) string) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var data []byte
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					length := binary.BigEndian.Uint32(size)
+					if length == 0 {
+						break
+					}
+					if length > chunkSize {
+						io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+						return
+					}
+					chunk := make([]byte, length)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				io.WriteString(conn, reply(data)+"\x00")
+			}()
+		}
+	}()
+
+	return socket
+}
+
+// scanEicar answers like clamd with the test signature.
+func scanEicar(data []byte) string {
+	if bytes.Contains(data, []byte(eicar)) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestScan(t *testing.T) {
+	client := NewClient(stubServer(t, scanEicar), time.Second)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		virus string
+	}{
+		{"clean", []byte("hello"), ""},
+		{"empty", nil, ""},
+		{"virus", []byte(eicar), "Eicar-Test-Signature"},
+		// split in several chunks
+		{"virus after the first chunk", append(bytes.Repeat([]byte("a"), 3*chunkSize), eicar...), "Eicar-Test-Signature"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := client.Scan(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Virus != test.virus {
+				t.Errorf("virus = %q, want %q", result.Virus, test.virus)
+			}
+		})
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	t.Run("clamd error", func(t *testing.T) {
+		client := NewClient(stubServer(t, func([]byte) string { return "stream: Can't allocate memory ERROR" }), time.Second)
+		if _, err := client.Scan([]byte("hello")); err == nil || !strings.Contains(err.Error(), "allocate memory") {
+			t.Errorf("err = %v, want the clamd error", err)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		client := NewClient(filepath.Join(t.TempDir(), "missing.sock"), time.Second)
+		if _, err := client.Scan([]byte("hello")); err == nil {
+			t.Error("no error without clamd")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "clamd.sock")
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		// accepted but never answered
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				io.Copy(io.Discard, conn)
+			}
+		}()
+
+		start := time.Now()
+		if _, err := NewClient(socket, 50*time.Millisecond).Scan([]byte("hello")); err == nil {
+			t.Error("no error without a reply")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("scan took %v", elapsed)
+		}
+	})
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		virus string
+		err   bool
+	}{
+		{"stream: OK", "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1", false},
+		{"stream: INSTREAM size limit exceeded. ERROR", "", true},
+		{"UNKNOWN COMMAND", "", true},
+	}
+
+	for _, test := range tests {
+		result, err := parseReply(test.reply)
+		if result.Virus != test.virus || (err != nil) != test.err {
+			t.Errorf("parseReply(%q) = %q, %v", test.reply, result.Virus, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package filewatch reloads configuration files on SIGHUP and when their size
+// or modification time changes. One SIGHUP handler serves every watcher.
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+var (
+	hangupOnce sync.Once
+	hangupMu   sync.Mutex
+	hangups    []chan struct{}
+)
+
+// Watch calls reload on SIGHUP and, every interval unless it is zero, when
+// changed reports that the files changed. The files are named in the logs.
+// It returns once the SIGHUP handler is registered and watches in a goroutine.
+func Watch(name string, interval time.Duration, changed func() bool, reload func()) {
+	hangup := notifyHangup()
+
+	go func() {
+		var poll <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+
+		for {
+			select {
+			case <-hangup:
+				logger.Logger("[info] SIGHUP received, reloading the " + name).Info()
+			case <-poll:
+				if !changed() {
+					continue
+				}
+				logger.Logger("[info] " + name + " changed, reloading").Info()
+			}
+
+			reload()
+		}
+	}()
+}
+
+// notifyHangup returns a channel receiving the SIGHUPs, a reload still
+// pending when another signal arrives is not repeated.
+func notifyHangup() <-chan struct{} {
+	hangupOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				hangupMu.Lock()
+				for _, hangup := range hangups {
+					select {
+					case hangup <- struct{}{}:
+					default:
+					}
+				}
+				hangupMu.Unlock()
+			}
+		}()
+	})
+
+	hangup := make(chan struct{}, 1)
+	hangupMu.Lock()
+	hangups = append(hangups, hangup)
+	hangupMu.Unlock()
+	return hangup
+}
+
+// Fingerprint summarizes the size and modification time of the files, the
+// empty names are skipped.
+func Fingerprint(files ...string) string {
+	var fingerprint strings.Builder
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&fingerprint, "%s:missing;", file)
+			continue
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return fingerprint.String()
+}
@@ -0,0 +1,84 @@
+package filewatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetLevel(logger.FATAL)
+	os.Exit(m.Run())
+}
+
+func TestFingerprint(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yml")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := Fingerprint(file, "")
+	if before != Fingerprint(file) {
+		t.Errorf("Fingerprint of an empty name differs")
+	}
+
+	if err := os.WriteFile(file, []byte("ab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := Fingerprint(file)
+	if changed == before {
+		t.Errorf("Fingerprint unchanged after a write")
+	}
+
+	os.Remove(file)
+	if missing := Fingerprint(file); missing == changed || missing != file+":missing;" {
+		t.Errorf("Fingerprint of a missing file = %q", missing)
+	}
+}
+
+// waitFor waits for the counter to reach want.
+func waitFor(t *testing.T, counter *atomic.Int32, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for counter.Load() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("reloads = %d, want %d", counter.Load(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchPolls(t *testing.T) {
+	var changed atomic.Bool
+	var reloads atomic.Int32
+	Watch("test files", 5*time.Millisecond, changed.Load, func() {
+		changed.Store(false)
+		reloads.Add(1)
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	if reloads.Load() != 0 {
+		t.Fatalf("reloads = %d without a change", reloads.Load())
+	}
+
+	changed.Store(true)
+	waitFor(t, &reloads, 1)
+}
+
+func TestWatchHangup(t *testing.T) {
+	// every watcher reloads on a single SIGHUP, polling disabled
+	var first, second atomic.Int32
+	Watch("first files", 0, func() bool { return true }, func() { first.Add(1) })
+	Watch("second files", 0, func() bool { return true }, func() { second.Add(1) })
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, &first, 1)
+	waitFor(t, &second, 1)
+}
@@ -0,0 +1,512 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maxNesting stops parsing pathological nested documents.
+const maxNesting = 512
+
+// Document is a parsed GraphQL executable document, the type system
+// definitions are not supported.
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+type Operation struct {
+	Type         string // query, mutation or subscription
+	Name         string
+	SelectionSet []*Selection
+}
+
+type Fragment struct {
+	Name         string
+	SelectionSet []*Selection
+}
+
+// Selection is a field, a fragment spread or an inline fragment.
+type Selection struct {
+	Alias        string
+	Name         string
+	Arguments    []Argument
+	SelectionSet []*Selection
+
+	// name of the spread fragment, empty for fields and inline fragments
+	Spread string
+	Inline bool
+}
+
+// Argument holds every literal of an argument value, lists and input
+// objects are flattened. Variables are not included.
+type Argument struct {
+	Name   string
+	Values []string
+}
+
+// Literal is a literal argument value named by the path of its field.
+type Literal struct {
+	Name  string
+	Value string
+}
+
+// Cost measures the size of a document, fragment spreads are expanded.
+type Cost struct {
+	Depth         int
+	Aliases       int
+	Fields        int
+	Introspection bool // __schema or __type is queried
+}
+
+// Parse parses a GraphQL query document.
+func Parse(query string) (*Document, error) {
+	p := &parser{lexer: lexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	document := &Document{Fragments: make(map[string]*Fragment)}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunct, "{"):
+			selections, err := p.selectionSet(0)
+			if err != nil {
+				return nil, err
+			}
+			document.Operations = append(document.Operations, &Operation{Type: "query", SelectionSet: selections})
+		case p.peek(tokenName, "fragment"):
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			document.Fragments[fragment.Name] = fragment
+		case p.peek(tokenName, "query") || p.peek(tokenName, "mutation") || p.peek(tokenName, "subscription"):
+			operation, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			document.Operations = append(document.Operations, operation)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(document.Operations) == 0 {
+		return nil, fmt.Errorf("no operation")
+	}
+	return document, nil
+}
+
+type parser struct {
+	lexer lexer
+	token token
+}
+
+func (p *parser) advance() (err error) {
+	p.token, err = p.lexer.next()
+	return err
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+// skip consumes the token when it matches.
+func (p *parser) skip(kind tokenKind, value string) (bool, error) {
+	if !p.peek(kind, value) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.token.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.token.value
+	return name, p.advance()
+}
+
+func (p *parser) unexpected() error {
+	if p.token.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at %d", p.token.value, p.token.pos)
+}
+
+func (p *parser) operation() (*Operation, error) {
+	operation := &Operation{Type: p.token.value}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	if p.token.kind == tokenName {
+		operation.Name = p.token.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.variableDefinitions(); err != nil {
+		return nil, err
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+
+	selections, err := p.selectionSet(0)
+	operation.SelectionSet = selections
+	return operation, err
+}
+
+func (p *parser) fragment() (*Fragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenName, "on"); err != nil {
+		return nil, err
+	}
+	if _, err := p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+
+	selections, err := p.selectionSet(0)
+	return &Fragment{Name: name, SelectionSet: selections}, err
+}
+
+// variableDefinitions skips ($name: Type = default @directive ...).
+func (p *parser) variableDefinitions() error {
+	if ok, err := p.skip(tokenPunct, "("); !ok || err != nil {
+		return err
+	}
+
+	for !p.peek(tokenPunct, ")") {
+		if err := p.expect(tokenPunct, "$"); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunct, ":"); err != nil {
+			return err
+		}
+		if err := p.typeReference(0); err != nil {
+			return err
+		}
+		if ok, err := p.skip(tokenPunct, "="); err != nil {
+			return err
+		} else if ok {
+			if err := p.value(nil, 0); err != nil {
+				return err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+	}
+	return p.advance()
+}
+
+func (p *parser) typeReference(depth int) error {
+	if depth > maxNesting {
+		return fmt.Errorf("document too deep")
+	}
+
+	if ok, err := p.skip(tokenPunct, "["); err != nil {
+		return err
+	} else if ok {
+		if err := p.typeReference(depth + 1); err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunct, "]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+
+	_, err := p.skip(tokenPunct, "!")
+	return err
+}
+
+// directives skips @name(arguments) ..., their arguments are not collected.
+func (p *parser) directives() error {
+	for p.peek(tokenPunct, "@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if _, err := p.arguments(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) selectionSet(depth int) ([]*Selection, error) {
+	if depth > maxNesting {
+		return nil, fmt.Errorf("document too deep")
+	}
+	if err := p.expect(tokenPunct, "{"); err != nil {
+		return nil, err
+	}
+
+	var selections []*Selection
+	for !p.peek(tokenPunct, "}") {
+		selection, err := p.selection(depth)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected()
+	}
+	return selections, p.advance()
+}
+
+func (p *parser) selection(depth int) (*Selection, error) {
+	selection := &Selection{}
+
+	if ok, err := p.skip(tokenPunct, "..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.token.kind == tokenName && p.token.value != "on" {
+			selection.Spread = p.token.value
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			return selection, p.directives()
+		}
+
+		selection.Inline = true
+		if ok, err := p.skip(tokenName, "on"); err != nil {
+			return nil, err
+		} else if ok {
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return nil, err
+		}
+		selections, err := p.selectionSet(depth + 1)
+		selection.SelectionSet = selections
+		return selection, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	selection.Name = name
+	if ok, err := p.skip(tokenPunct, ":"); err != nil {
+		return nil, err
+	} else if ok {
+		selection.Alias = name
+		if selection.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	if selection.Arguments, err = p.arguments(depth); err != nil {
+		return nil, err
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokenPunct, "{") {
+		selection.SelectionSet, err = p.selectionSet(depth + 1)
+	}
+	return selection, err
+}
+
+func (p *parser) arguments(depth int) ([]Argument, error) {
+	if ok, err := p.skip(tokenPunct, "("); !ok || err != nil {
+		return nil, err
+	}
+
+	var arguments []Argument
+	for !p.peek(tokenPunct, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenPunct, ":"); err != nil {
+			return nil, err
+		}
+
+		argument := Argument{Name: name}
+		if err := p.value(&argument.Values, depth); err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, argument)
+	}
+	return arguments, p.advance()
+}
+
+// value parses a value and appends its literals to values when not nil.
+func (p *parser) value(values *[]string, depth int) error {
+	if depth > maxNesting {
+		return fmt.Errorf("document too deep")
+	}
+
+	switch {
+	case p.peek(tokenPunct, "$"):
+		if err := p.advance(); err != nil {
+			return err
+		}
+		_, err := p.name()
+		return err
+	case p.peek(tokenPunct, "["):
+		if err := p.advance(); err != nil {
+			return err
+		}
+		for !p.peek(tokenPunct, "]") {
+			if err := p.value(values, depth+1); err != nil {
+				return err
+			}
+		}
+		return p.advance()
+	case p.peek(tokenPunct, "{"):
+		if err := p.advance(); err != nil {
+			return err
+		}
+		for !p.peek(tokenPunct, "}") {
+			if _, err := p.name(); err != nil {
+				return err
+			}
+			if err := p.expect(tokenPunct, ":"); err != nil {
+				return err
+			}
+			if err := p.value(values, depth+1); err != nil {
+				return err
+			}
+		}
+		return p.advance()
+	case p.token.kind == tokenName || p.token.kind == tokenNumber || p.token.kind == tokenString:
+		if values != nil {
+			*values = append(*values, p.token.value)
+		}
+		return p.advance()
+	}
+	return p.unexpected()
+}
+
+// Cost measures the operations of the document, the depth is the deepest
+// operation and the other counts are totals.
+func (d *Document) Cost() Cost {
+	fragments := make(map[string]*Cost)
+
+	var cost Cost
+	for _, operation := range d.Operations {
+		c := d.selectionsCost(operation.SelectionSet, fragments)
+		cost.Depth = max(cost.Depth, c.Depth)
+		cost.add(c)
+	}
+	return cost
+}
+
+// selectionsCost measures a selection set, fragments are measured once and
+// cycles count as empty.
+func (d *Document) selectionsCost(selections []*Selection, fragments map[string]*Cost) Cost {
+	var cost Cost
+	for _, selection := range selections {
+		var c Cost
+		switch {
+		case selection.Spread != "":
+			fragment, ok := d.Fragments[selection.Spread]
+			if !ok {
+				continue
+			}
+			if _, seen := fragments[selection.Spread]; !seen {
+				// in progress, a spread of the fragment from itself adds nothing
+				fragments[selection.Spread] = &Cost{}
+				measured := d.selectionsCost(fragment.SelectionSet, fragments)
+				fragments[selection.Spread] = &measured
+			}
+			c = *fragments[selection.Spread]
+		case selection.Inline:
+			c = d.selectionsCost(selection.SelectionSet, fragments)
+		default:
+			c = d.selectionsCost(selection.SelectionSet, fragments)
+			c.Depth++
+			c.Fields = saturate(c.Fields, 1)
+			if selection.Alias != "" {
+				c.Aliases = saturate(c.Aliases, 1)
+			}
+			if selection.Name == "__schema" || selection.Name == "__type" {
+				c.Introspection = true
+			}
+		}
+
+		cost.Depth = max(cost.Depth, c.Depth)
+		cost.add(c)
+	}
+	return cost
+}
+
+// add sums the counts of c, the depth is left to the caller.
+func (c *Cost) add(other Cost) {
+	c.Aliases = saturate(c.Aliases, other.Aliases)
+	c.Fields = saturate(c.Fields, other.Fields)
+	c.Introspection = c.Introspection || other.Introspection
+}
+
+// saturate adds without overflowing, fragments spread many times grow exponentially.
+func saturate(a, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+// Literals returns the literal argument values of every field, named by the
+// path of the field and the argument, e.g. user.posts.filter. Fragment
+// fields are prefixed by the fragment name.
+func (d *Document) Literals() []Literal {
+	var literals []Literal
+	for _, operation := range d.Operations {
+		literals = appendLiterals(literals, nil, operation.SelectionSet)
+	}
+	for name, fragment := range d.Fragments {
+		literals = appendLiterals(literals, []string{name}, fragment.SelectionSet)
+	}
+	return literals
+}
+
+func appendLiterals(literals []Literal, path []string, selections []*Selection) []Literal {
+	for _, selection := range selections {
+		fieldPath := path
+		if selection.Name != "" {
+			fieldPath = append(path[:len(path):len(path)], selection.Name)
+		}
+
+		for _, argument := range selection.Arguments {
+			name := strings.Join(append(fieldPath[:len(fieldPath):len(fieldPath)], argument.Name), ".")
+			for _, value := range argument.Values {
+				literals = append(literals, Literal{Name: name, Value: value})
+			}
+		}
+		literals = appendLiterals(literals, fieldPath, selection.SelectionSet)
+	}
+	return literals
+}
@@ -0,0 +1,147 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nested returns a query of n nested selection sets.
+func nested(n int) string {
+	return strings.Repeat("{ a ", n) + strings.Repeat("}", n)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"shorthand query", "{ user { name } }", ""},
+		{"named operations", "query A { a } mutation B($id: ID!) { b(id: $id) } subscription { c }", ""},
+		{"fragments", "query { ...F ... on User { name } } fragment F on User { id }", ""},
+		{"arguments and directives", `{ user(id: 1, filter: {name: "x", tags: ["a", "b"]}) @include(if: true) { name @skip(if: $v) } }`, ""},
+		{"variable definitions", `query ($a: [[Int!]]! = [[1]], $b: String = "x" @deprecated) { a }`, ""},
+		{"comments and commas", "# comment\n{ a, b, # another\n c }", ""},
+		{"block string", `{ a(text: """multi "line" text""") }`, ""},
+		{"deepest nesting", nested(maxNesting + 1), ""},
+
+		{"empty document", "", "no operation"},
+		{"only fragments", "fragment F on User { id }", "no operation"},
+		{"empty selection set", "{ }", "unexpected"},
+		{"unterminated selection set", "{ a", "unexpected end of document"},
+		{"missing argument value", "{ a(x: ) }", "unexpected"},
+		{"unterminated string", `{ a(x: "text) }`, "unterminated string"},
+		{"unterminated block string", `{ a(x: """text) }`, "unterminated block string"},
+		{"invalid character", "{ a ~ }", "unexpected character"},
+		{"trailing data", "{ a } b", "unexpected"},
+		{"fragment without type", "{ ...F } fragment F { a }", "unexpected"},
+		{"too many selection sets", nested(maxNesting + 2), "document too deep"},
+		{"too deep value", "{ a(x: " + strings.Repeat("[", maxNesting+2) + strings.Repeat("]", maxNesting+2) + ") }", "document too deep"},
+		{"too deep object value", "{ a(x: " + strings.Repeat("{a: ", maxNesting+2) + "1" + strings.Repeat("}", maxNesting+2) + ") }", "document too deep"},
+		{"too deep type", "query ($v: " + strings.Repeat("[", maxNesting+2) + "Int" + strings.Repeat("]", maxNesting+2) + ") { a }", "document too deep"},
+		{"unbalanced nesting", strings.Repeat("{ a ", 100000), "document too deep"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.query)
+			if test.err == "" && err != nil {
+				t.Errorf("Parse error = %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Parse error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseDocument(t *testing.T) {
+	document, err := Parse(`query Users($id: ID) {
+		first: user(id: 1, where: {name: "al", roles: [ADMIN, $role]}) @include(if: true) { name }
+		...Fields
+		... on Query { count(id: $id) }
+	}
+	fragment Fields on Query { total(days: 7) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(document.Operations) != 1 || document.Operations[0].Type != "query" || document.Operations[0].Name != "Users" {
+		t.Fatalf("operations = %+v, want the Users query", document.Operations)
+	}
+	selections := document.Operations[0].SelectionSet
+	if len(selections) != 3 {
+		t.Fatalf("%d selections, want 3", len(selections))
+	}
+	if user := selections[0]; user.Alias != "first" || user.Name != "user" || len(user.SelectionSet) != 1 {
+		t.Errorf("user = %+v, want the aliased user field", user)
+	}
+	if spread := selections[1]; spread.Spread != "Fields" {
+		t.Errorf("spread = %+v, want the Fields spread", spread)
+	}
+	if inline := selections[2]; !inline.Inline || inline.SelectionSet[0].Name != "count" {
+		t.Errorf("inline = %+v, want the inline fragment", inline)
+	}
+	if _, ok := document.Fragments["Fields"]; !ok {
+		t.Errorf("fragments = %v, want Fields", document.Fragments)
+	}
+
+	// the variables and the directive arguments are not literals
+	want := []Literal{
+		{Name: "user.id", Value: "1"},
+		{Name: "user.where", Value: "al"},
+		{Name: "user.where", Value: "ADMIN"},
+		{Name: "Fields.total.days", Value: "7"},
+	}
+	if literals := document.Literals(); !reflect.DeepEqual(literals, want) {
+		t.Errorf("literals = %v, want %v", literals, want)
+	}
+}
+
+func TestCost(t *testing.T) {
+	// every level spreads the fragment of the level below twice
+	var exponential strings.Builder
+	exponential.WriteString("{ ...F40 } fragment F0 on Q { a }")
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&exponential, " fragment F%d on Q { a { ...F%d } b { ...F%d } }", i, i-1, i-1)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  Cost
+	}{
+		{"single field", "{ a }", Cost{Depth: 1, Fields: 1}},
+		{"nested fields", "{ user { name posts { title } } }", Cost{Depth: 3, Fields: 4}},
+		{"aliases", "{ a: user(id: 1) { name } b: user(id: 2) { name } c: user(id: 3) { name } }", Cost{Depth: 2, Aliases: 3, Fields: 6}},
+		{"nested aliases", "{ user { a: name b: name } }", Cost{Depth: 2, Aliases: 2, Fields: 3}},
+		{"operations", "query A { a { b { c } } } query B { d e }", Cost{Depth: 3, Fields: 5}},
+		{"inline fragment", "{ node { ... on User { name } ... { id } } }", Cost{Depth: 2, Fields: 3}},
+		{"fragment", "{ user { ...F } other: user { ...F } } fragment F on User { name friends { name } }", Cost{Depth: 3, Aliases: 1, Fields: 8}},
+		{"unknown fragment", "{ a ...Missing }", Cost{Depth: 1, Fields: 1}},
+		{"self spread", "{ ...A } fragment A on Q { a ...A }", Cost{Depth: 1, Fields: 1}},
+		{"nested self spread", "{ ...A } fragment A on Q { a { ...A } }", Cost{Depth: 1, Fields: 1}},
+		{"fragment cycle", "{ ...A } fragment A on Q { a ...B } fragment B on Q { b { ...A } }", Cost{Depth: 1, Fields: 2}},
+		{"exponential fragments", exponential.String(), Cost{Depth: 41, Fields: math.MaxInt32}},
+		{"introspection schema", "{ __schema { types { name } } }", Cost{Depth: 3, Fields: 3, Introspection: true}},
+		{"introspection type", `{ user { name } t: __type(name: "User") { fields { name } } }`, Cost{Depth: 3, Aliases: 1, Fields: 5, Introspection: true}},
+		{"introspection in a fragment", "{ ...F } fragment F on Query { __schema { queryType { name } } }", Cost{Depth: 3, Fields: 3, Introspection: true}},
+		{"type name", "{ __typename user { __typename } }", Cost{Depth: 2, Fields: 3}},
+		{"deepest nesting", nested(maxNesting + 1), Cost{Depth: maxNesting + 1, Fields: maxNesting + 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := Parse(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cost := document.Cost(); cost != test.want {
+				t.Errorf("Cost = %+v, want %+v", cost, test.want)
+			}
+		})
+	}
+}
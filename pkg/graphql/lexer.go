@@ -0,0 +1,136 @@
+package graphql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenNumber
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lexer splits a GraphQL document into tokens, whitespace, commas and
+// comments are ignored.
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipIgnored()
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.pos += 3
+		return token{kind: tokenPunct, value: "...", pos: start}, nil
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		l.pos++
+		return token{kind: tokenPunct, value: string(c), pos: start}, nil
+	case isNameStart(c):
+		for l.pos < len(l.src) && isNameContinue(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenName, value: l.src[start:l.pos], pos: start}, nil
+	case c == '-' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && (isNameContinue(l.src[l.pos]) || strings.IndexByte(".+-", l.src[l.pos]) >= 0) {
+			l.pos++
+		}
+		return token{kind: tokenNumber, value: l.src[start:l.pos], pos: start}, nil
+	case c == '"':
+		value, err := l.readString()
+		return token{kind: tokenString, value: value, pos: start}, err
+	}
+
+	return token{}, fmt.Errorf("unexpected character %q at %d", c, start)
+}
+
+func (l *lexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+// readString reads a string or a block string, escape sequences are kept
+// except the escaped quotes.
+func (l *lexer) readString() (string, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		l.pos += 3
+		end := strings.Index(l.src[l.pos:], `"""`)
+		for end > 0 && l.src[l.pos+end-1] == '\\' {
+			next := strings.Index(l.src[l.pos+end+3:], `"""`)
+			if next < 0 {
+				end = -1
+				break
+			}
+			end += 3 + next
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated block string at %d", start)
+		}
+		value := l.src[l.pos : l.pos+end]
+		l.pos += end + 3
+		return strings.ReplaceAll(value, `\"""`, `"""`), nil
+	}
+
+	l.pos++
+	var value strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return value.String(), nil
+		case c == '\n' || c == '\r':
+			return "", fmt.Errorf("unterminated string at %d", start)
+		case c == '\\' && l.pos+1 < len(l.src) && (l.src[l.pos+1] == '"' || l.src[l.pos+1] == '\\'):
+			value.WriteByte(l.src[l.pos+1])
+			l.pos += 2
+		default:
+			value.WriteByte(c)
+			l.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string at %d", start)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameContinue(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
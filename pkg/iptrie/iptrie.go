@@ -0,0 +1,109 @@
+// Package iptrie is a binary prefix trie of IPv4 and IPv6 prefixes. A lookup
+// walks at most one node per address bit, whatever the number of prefixes.
+package iptrie
+
+import "net/netip"
+
+type node struct {
+	children [2]*node
+	// a prefix ends here, the addresses below are all contained
+	terminal bool
+}
+
+// Trie holds a set of IP prefixes. The zero value is an empty trie, it is not
+// safe for concurrent writes but any number of lookups may run once it is built.
+type Trie struct {
+	v4, v6 node
+	size   int
+}
+
+// Insert adds the prefix, a prefix already covered by a shorter one is
+// ignored and the longer prefixes it covers are dropped.
+func (t *Trie) Insert(prefix netip.Prefix) {
+	if !prefix.IsValid() {
+		return
+	}
+	prefix = unmap(prefix.Masked())
+
+	root, bytes := t.root(prefix.Addr())
+	current := root
+	for i := 0; i < prefix.Bits(); i++ {
+		if current.terminal {
+			return
+		}
+		b := bit(bytes, i)
+		if current.children[b] == nil {
+			current.children[b] = &node{}
+		}
+		current = current.children[b]
+	}
+
+	if current.terminal {
+		return
+	}
+	t.size += 1 - current.terminals()
+	current.terminal = true
+	current.children = [2]*node{}
+}
+
+// terminals counts the prefixes ending below the node.
+func (n *node) terminals() int {
+	count := 0
+	for _, child := range n.children {
+		if child == nil {
+			continue
+		}
+		if child.terminal {
+			count++
+		} else {
+			count += child.terminals()
+		}
+	}
+	return count
+}
+
+// Contains reports whether a prefix of the trie holds the address.
+func (t *Trie) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+
+	current, bytes := t.root(addr)
+	for i := 0; i < addr.BitLen(); i++ {
+		if current.terminal {
+			return true
+		}
+		current = current.children[bit(bytes, i)]
+		if current == nil {
+			return false
+		}
+	}
+	return current.terminal
+}
+
+// Len returns the number of prefixes, the covered ones excepted.
+func (t *Trie) Len() int {
+	return t.size
+}
+
+func (t *Trie) root(addr netip.Addr) (*node, []byte) {
+	if addr.Is4() {
+		bytes := addr.As4()
+		return &t.v4, bytes[:]
+	}
+	bytes := addr.As16()
+	return &t.v6, bytes[:]
+}
+
+// unmap turns a prefix of IPv4-mapped IPv6 addresses into an IPv4 prefix.
+func unmap(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+func bit(bytes []byte, i int) byte {
+	return bytes[i/8] >> (7 - i%8) & 1
+}
@@ -0,0 +1,145 @@
+package iptrie
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func newTrie(prefixes ...string) *Trie {
+	trie := &Trie{}
+	for _, prefix := range prefixes {
+		trie.Insert(netip.MustParsePrefix(prefix))
+	}
+	return trie
+}
+
+func TestContains(t *testing.T) {
+	trie := newTrie(
+		"10.0.0.0/8",
+		"192.0.2.1/32",
+		"198.51.100.0/24",
+		"2001:db8::/32",
+		"2001:db8:ffff::1/128",
+		"::ffff:203.0.113.0/120",
+	)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"198.51.100.77", true},
+		{"198.51.101.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff:ffff::", true},
+		{"2001:db9::", false},
+		{"::1", false},
+
+		// the IPv4-mapped addresses and prefixes are IPv4
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:11.1.2.3", false},
+		{"203.0.113.5", true},
+		{"::ffff:203.0.113.5", true},
+		{"203.0.114.5", false},
+
+		// an IPv4 prefix does not hold the IPv6 addresses of the same bits
+		{"a00::", false},
+		{"::a00:1", false},
+	}
+
+	for _, test := range tests {
+		if got := trie.Contains(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+
+	if trie.Contains(netip.Addr{}) {
+		t.Error("Contains(invalid) = true, want false")
+	}
+	if (&Trie{}).Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("the empty trie contains 10.0.0.1")
+	}
+}
+
+func TestInsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		len      int
+		contains []string
+		excludes []string
+	}{
+		{"duplicate", []string{"10.0.0.0/8", "10.0.0.0/8"}, 1, []string{"10.1.1.1"}, nil},
+		{"unmasked", []string{"10.1.2.3/8", "10.0.0.0/8"}, 1, []string{"10.200.0.1"}, []string{"11.0.0.0"}},
+		{"covered prefix", []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32"}, 1, []string{"10.1.2.3", "10.9.9.9"}, nil},
+		{"covering prefix", []string{"10.1.0.0/16", "10.2.3.4/32", "10.3.0.0/24", "11.0.0.0/8", "10.0.0.0/8"}, 2, []string{"10.200.0.1", "11.0.0.1"}, []string{"12.0.0.1"}},
+		{"nested covered prefixes", []string{"10.1.2.3/32", "10.1.0.0/16", "10.0.0.0/8"}, 1, []string{"10.1.2.3", "10.2.0.0"}, nil},
+		{"siblings", []string{"10.0.0.0/9", "10.128.0.0/9"}, 2, []string{"10.0.0.1", "10.255.0.1"}, []string{"11.0.0.1"}},
+		{"IPv4 default route", []string{"10.0.0.0/8", "0.0.0.0/0", "192.0.2.0/24"}, 1, []string{"0.0.0.0", "255.255.255.255", "::ffff:1.2.3.4"}, []string{"::1", "2001:db8::1"}},
+		{"IPv6 default route", []string{"2001:db8::/32", "::/0"}, 1, []string{"::1", "2001:db8::1", "fe80::1"}, []string{"1.2.3.4"}},
+		{"IPv4-mapped prefix", []string{"::ffff:10.0.0.0/104", "10.0.0.0/8"}, 1, []string{"10.1.2.3", "::ffff:10.1.2.3"}, nil},
+		{"IPv4-mapped default route", []string{"::ffff:0.0.0.0/96"}, 1, []string{"1.2.3.4"}, []string{"::1"}},
+		{"IPv4 and IPv6", []string{"0.0.0.0/0", "::/0"}, 2, []string{"1.2.3.4", "::1"}, nil},
+		{"host addresses", []string{"192.0.2.1/32", "192.0.2.2/32", "2001:db8::1/128"}, 3, []string{"192.0.2.2", "2001:db8::1"}, []string{"192.0.2.3", "2001:db8::2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trie := newTrie(test.prefixes...)
+			if trie.Len() != test.len {
+				t.Errorf("Len = %d, want %d", trie.Len(), test.len)
+			}
+			for _, addr := range test.contains {
+				if !trie.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("Contains(%s) = false, want true", addr)
+				}
+			}
+			for _, addr := range test.excludes {
+				if trie.Contains(netip.MustParseAddr(addr)) {
+					t.Errorf("Contains(%s) = true, want false", addr)
+				}
+			}
+		})
+	}
+
+	trie := &Trie{}
+	trie.Insert(netip.Prefix{})
+	if trie.Len() != 0 {
+		t.Errorf("Len after inserting an invalid prefix = %d, want 0", trie.Len())
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	random := rand.New(rand.NewPCG(1, 2))
+	trie := &Trie{}
+	for i := 0; i < 100000; i++ {
+		var v4 [4]byte
+		var v6 [16]byte
+		for j := range v4 {
+			v4[j] = byte(random.UintN(256))
+		}
+		for j := range v6 {
+			v6[j] = byte(random.UintN(256))
+		}
+		trie.Insert(netip.PrefixFrom(netip.AddrFrom4(v4), 16+random.IntN(17)))
+		trie.Insert(netip.PrefixFrom(netip.AddrFrom16(v6), 32+random.IntN(97)))
+	}
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("203.0.113.77"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("::ffff:198.51.100.1"),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Contains(addrs[i%len(addrs)])
+	}
+}
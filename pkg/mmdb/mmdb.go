@@ -0,0 +1,372 @@
+// Package mmdb reads MaxMind DB files, the format of the GeoIP2 and GeoLite2
+// databases: a binary search tree of the address bits whose leaves point to
+// records of a typed data section.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker starts the metadata at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSeparator is the size of the zeros between the search tree and the data section.
+const dataSeparator = 16
+
+// maxDepth limits the nesting of maps and arrays of a corrupt file.
+const maxDepth = 32
+
+// Data section types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Metadata describes the database.
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint // bits of a record, 24, 28 or 32
+	IPVersion    uint // 4 or 6
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader looks up the addresses of a database loaded in memory.
+type Reader struct {
+	Metadata Metadata
+
+	tree []byte
+	data []byte
+	// node of the IPv4 addresses in an IPv6 tree
+	ipv4Start uint
+}
+
+// Open reads the database file.
+func Open(file string) (*Reader, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New reads a database from its content.
+func New(buf []byte) (*Reader, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, errors.New("mmdb: metadata not found, not a MaxMind DB file")
+	}
+	start += len(metadataMarker)
+
+	metadataDecoder := decoder{buf: buf[start:]}
+	value, _, err := metadataDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: invalid metadata: %w", err)
+	}
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+
+	r := &Reader{}
+	r.Metadata.NodeCount = uint(toUint(fields["node_count"]))
+	r.Metadata.RecordSize = uint(toUint(fields["record_size"]))
+	r.Metadata.IPVersion = uint(toUint(fields["ip_version"]))
+	r.Metadata.DatabaseType, _ = fields["database_type"].(string)
+	r.Metadata.BuildEpoch = toUint(fields["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported IP version %d", r.Metadata.IPVersion)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	dataStart := treeSize + dataSeparator
+	dataEnd := uint(start - len(metadataMarker))
+	if dataStart > dataEnd {
+		return nil, errors.New("mmdb: search tree larger than the file")
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[dataStart:dataEnd]
+
+	if r.Metadata.IPVersion == 6 {
+		// the IPv4 addresses are stored as ::a.b.c.d
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record of the address, nil when the database holds
+// none. Maps are decoded as map[string]any, unsigned integers as uint64
+// (*big.Int for uint128), int32 as int64 and floats as float64.
+func (r *Reader) Lookup(addr netip.Addr) (any, error) {
+	if !addr.IsValid() {
+		return nil, errors.New("mmdb: invalid address")
+	}
+	addr = addr.Unmap()
+
+	var bits []byte
+	node := uint(0)
+	if addr.Is4() {
+		ip := addr.As4()
+		bits = ip[:]
+		node = r.ipv4Start
+	} else {
+		if r.Metadata.IPVersion == 4 {
+			return nil, nil
+		}
+		ip := addr.As16()
+		bits = ip[:]
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.Metadata.NodeCount; i++ {
+		node = r.record(node, bits[i/8]>>(7-i%8)&1)
+	}
+
+	if node == r.Metadata.NodeCount {
+		return nil, nil
+	}
+	if node < r.Metadata.NodeCount {
+		return nil, errors.New("mmdb: invalid search tree")
+	}
+
+	offset := node - r.Metadata.NodeCount - dataSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("mmdb: invalid data pointer")
+	}
+	d := decoder{buf: r.data}
+	value, _, err := d.decode(offset, 0)
+	return value, err
+}
+
+// record returns the left (0) or right (1) record of a node.
+func (r *Reader) record(node uint, side byte) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.tree[node*6+uint(side)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if side == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+uint(side)*4:]))
+	}
+}
+
+// decoder reads the values of a data section.
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset and the offset following it.
+func (d *decoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("maximum data depth exceeded")
+	}
+
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == typePointer {
+		pointer, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// the value pointed to is decoded, the data goes on after the pointer
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	switch kind {
+	case typeMap:
+		fields := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			fields[name] = value
+			offset = next
+		}
+		return fields, offset, nil
+	case typeArray:
+		values := make([]any, 0, min(size, 1024))
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, errors.New("invalid boolean")
+		}
+		return size == 1, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("value beyond the data section")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch kind {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return bytes.Clone(b), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid unsigned integer")
+		}
+		value := uint64(0)
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid int32")
+		}
+		value := uint32(0)
+		for _, c := range b {
+			value = value<<8 | uint32(c)
+		}
+		return int64(int32(value)), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.New("invalid uint128")
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// control reads the type and the size of the value at offset.
+func (d *decoder) control(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("value beyond the data section")
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	kind := int(ctrl >> 5)
+	if kind == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("value beyond the data section")
+		}
+		kind = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1F)
+	if kind == typePointer || size < 29 {
+		return kind, size, offset, nil
+	}
+
+	// sizes from 29 on are stored in the following bytes
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("value beyond the data section")
+	}
+	value := uint(0)
+	for _, c := range d.buf[offset : offset+extra] {
+		value = value<<8 | uint(c)
+	}
+	switch extra {
+	case 1:
+		size = 29 + value
+	case 2:
+		size = 285 + value
+	default:
+		size = 65821 + value
+	}
+	return kind, size, offset + extra, nil
+}
+
+// pointer reads a pointer whose control byte held size, it returns the offset
+// pointed to and the offset following the pointer.
+func (d *decoder) pointer(size uint, offset uint) (uint, uint, error) {
+	length := size>>3&0x3 + 1
+	if offset+length > uint(len(d.buf)) {
+		return 0, 0, errors.New("pointer beyond the data section")
+	}
+
+	value := uint(0)
+	if length != 4 {
+		value = size & 0x7
+	}
+	for _, c := range d.buf[offset : offset+length] {
+		value = value<<8 | uint(c)
+	}
+
+	switch length {
+	case 2:
+		value += 2048
+	case 3:
+		value += 526336
+	}
+	return value, offset + length, nil
+}
+
+func toUint(value any) uint64 {
+	number, _ := value.(uint64)
+	return number
+}
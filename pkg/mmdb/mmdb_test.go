@@ -0,0 +1,175 @@
+package mmdb
+
+import (
+	"bytes"
+	"math/big"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for _, ipVersion := range []uint{4, 6} {
+		for _, recordSize := range []uint{24, 28, 32} {
+			w := newWriter(ipVersion, recordSize, "Test")
+			w.insert("10.0.0.0/8", map[string]any{"name": "ten"})
+			w.insert("192.0.2.0/24", map[string]any{"name": "test-net-1"})
+			w.insert("192.0.2.128/32", map[string]any{"name": "host"})
+			if ipVersion == 6 {
+				w.insert("2001:db8::/32", map[string]any{"name": "documentation"})
+			}
+
+			reader, err := New(w.bytes())
+			if err != nil {
+				t.Fatalf("IPv%d/%d: %v", ipVersion, recordSize, err)
+			}
+			if reader.Metadata.IPVersion != ipVersion || reader.Metadata.RecordSize != recordSize || reader.Metadata.DatabaseType != "Test" || reader.Metadata.BuildEpoch != 1700000000 {
+				t.Errorf("IPv%d/%d: metadata = %+v", ipVersion, recordSize, reader.Metadata)
+			}
+
+			tests := []struct {
+				ip   string
+				name string // empty when the database holds no record
+			}{
+				{"10.1.2.3", "ten"},
+				{"192.0.2.1", "test-net-1"},
+				{"192.0.2.128", "host"},
+				{"192.0.3.1", ""},
+				{"8.8.8.8", ""},
+				{"::ffff:10.1.2.3", "ten"},
+				{"2001:db8::1", map[uint]string{4: "", 6: "documentation"}[ipVersion]},
+				{"2001:db9::1", ""},
+			}
+			for _, test := range tests {
+				value, err := reader.Lookup(netip.MustParseAddr(test.ip))
+				if err != nil {
+					t.Errorf("IPv%d/%d: Lookup(%s): %v", ipVersion, recordSize, test.ip, err)
+					continue
+				}
+				if test.name == "" {
+					if value != nil {
+						t.Errorf("IPv%d/%d: Lookup(%s) = %v, want nil", ipVersion, recordSize, test.ip, value)
+					}
+					continue
+				}
+				if record, _ := value.(map[string]any); record["name"] != test.name {
+					t.Errorf("IPv%d/%d: Lookup(%s) = %v, want name %q", ipVersion, recordSize, test.ip, value, test.name)
+				}
+			}
+		}
+	}
+}
+
+func TestLookupTypes(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	record := map[string]any{
+		"string":  "GeoLite2",
+		"long":    long,
+		"double":  float64(-12.5),
+		"float":   float32(0.25),
+		"bytes":   []byte{0, 1, 2},
+		"uint16":  uint16(65535),
+		"uint32":  uint32(14061),
+		"uint64":  uint64(1 << 40),
+		"int32":   int32(-42),
+		"uint128": new(big.Int).Lsh(big.NewInt(1), 100),
+		"true":    true,
+		"false":   false,
+		"array":   []any{"a", uint32(1), map[string]any{"b": "c"}},
+		"nested":  map[string]any{"country": map[string]any{"iso_code": "ID"}},
+	}
+
+	w := newWriter(6, 24, "Test")
+	w.insert("192.0.2.0/24", record)
+	// a second record pointing to the nested map of the first
+	offset := w.data.Len()
+	encode(&w.data, map[string]any{"shared": pointer(0)})
+	w.insertData(netip.MustParsePrefix("198.51.100.0/24"), offset)
+
+	reader, err := New(w.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := reader.Lookup(netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"string":  "GeoLite2",
+		"long":    long,
+		"double":  float64(-12.5),
+		"float":   float64(0.25),
+		"bytes":   []byte{0, 1, 2},
+		"uint16":  uint64(65535),
+		"uint32":  uint64(14061),
+		"uint64":  uint64(1 << 40),
+		"int32":   int64(-42),
+		"uint128": new(big.Int).Lsh(big.NewInt(1), 100),
+		"true":    true,
+		"false":   false,
+		"array":   []any{"a", uint64(1), map[string]any{"b": "c"}},
+		"nested":  map[string]any{"country": map[string]any{"iso_code": "ID"}},
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("Lookup = %#v, want %#v", value, want)
+	}
+
+	value, err = reader.Lookup(netip.MustParseAddr("198.51.100.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(value, map[string]any{"shared": want}) {
+		t.Errorf("Lookup through a pointer = %#v", value)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	w := newWriter(4, 24, "Test")
+	w.insert("10.0.0.0/8", "ten")
+	valid := w.bytes()
+	metadata := bytes.LastIndex(valid, metadataMarker)
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"not a database", []byte("GIF89a")},
+		{"unsupported record size", newWriter(4, 16, "Test").bytes()},
+		{"unsupported IP version", newWriter(5, 24, "Test").bytes()},
+		{"truncated tree", append(valid[:10:10], valid[metadata:]...)},
+	}
+
+	for _, test := range tests {
+		if _, err := New(test.buf); err == nil {
+			t.Errorf("%s: New error = nil", test.name)
+		}
+	}
+}
+
+func TestLookupCorrupt(t *testing.T) {
+	w := newWriter(4, 32, "Test")
+	w.insert("10.0.0.0/8", map[string]any{"name": "ten"})
+	// a record pointing past the data section
+	w.nodes[len(w.nodes)-1][0] = record{node: -1, leaf: 1 << 20}
+	// a map nested deeper than maxDepth
+	offset := w.data.Len()
+	deep := any("leaf")
+	for i := 0; i <= maxDepth; i++ {
+		deep = map[string]any{"a": deep}
+	}
+	encode(&w.data, deep)
+	w.insertData(netip.MustParsePrefix("192.0.2.0/24"), offset)
+
+	reader, err := New(w.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.1.2.3", "192.0.2.1"} {
+		if _, err := reader.Lookup(netip.MustParseAddr(ip)); err == nil {
+			t.Errorf("Lookup(%s) error = nil", ip)
+		}
+	}
+}
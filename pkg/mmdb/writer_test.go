@@ -0,0 +1,274 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the testdata databases")
+
+// writer builds small MaxMind DB files for the tests: a search tree of the
+// prefixes and a data section with a record per prefix. A prefix inserted
+// after a shorter one containing it overrides it.
+type writer struct {
+	ipVersion  uint
+	recordSize uint
+	dbType     string
+
+	// nodes hold the two records of a node: a node index, empty or a leaf
+	nodes [][2]record
+	data  bytes.Buffer
+}
+
+// record is a search tree record, leaf is the data offset when node is -1.
+type record struct {
+	node int
+	leaf int // -1 when empty
+}
+
+var emptyRecord = record{node: -1, leaf: -1}
+
+func newWriter(ipVersion, recordSize uint, dbType string) *writer {
+	return &writer{
+		ipVersion:  ipVersion,
+		recordSize: recordSize,
+		dbType:     dbType,
+		nodes:      [][2]record{{emptyRecord, emptyRecord}},
+	}
+}
+
+// insert adds the value of a prefix, the IPv4 prefixes of an IPv6 tree are
+// stored under ::/96.
+func (w *writer) insert(prefix string, value any) {
+	offset := w.data.Len()
+	encode(&w.data, value)
+	w.insertData(netip.MustParsePrefix(prefix), offset)
+}
+
+// insertData points a prefix to data already written at offset.
+func (w *writer) insertData(prefix netip.Prefix, offset int) {
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	var ip []byte
+	if addr.Is4() && w.ipVersion == 6 {
+		ip16 := netip.AddrFrom4(addr.As4()).As16()
+		ip16[10], ip16[11] = 0, 0 // ::a.b.c.d, not ::ffff:a.b.c.d
+		ip = ip16[:]
+		bits += 96
+	} else {
+		ip = addr.AsSlice()
+	}
+
+	node := 0
+	for i := 0; i < bits-1; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		next := w.nodes[node][bit]
+		if next.node < 0 {
+			// the halves of a leaf or an empty record keep its value
+			w.nodes = append(w.nodes, [2]record{next, next})
+			next = record{node: len(w.nodes) - 1, leaf: -1}
+			w.nodes[node][bit] = next
+		}
+		node = next.node
+	}
+	bit := ip[(bits-1)/8] >> (7 - (bits-1)%8) & 1
+	w.nodes[node][bit] = record{node: -1, leaf: offset}
+}
+
+// bytes returns the database file.
+func (w *writer) bytes() []byte {
+	var buf bytes.Buffer
+	count := uint(len(w.nodes))
+	value := func(r record) uint {
+		switch {
+		case r.node >= 0:
+			return uint(r.node)
+		case r.leaf >= 0:
+			return count + dataSeparator + uint(r.leaf)
+		}
+		return count
+	}
+
+	for _, node := range w.nodes {
+		left, right := value(node[0]), value(node[1])
+		switch w.recordSize {
+		case 24:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20&0xF0 | right>>24&0x0F), byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			buf.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(left)), uint32(right)))
+		}
+	}
+
+	buf.Write(make([]byte, dataSeparator))
+	buf.Write(w.data.Bytes())
+	buf.Write(metadataMarker)
+	encode(&buf, map[string]any{
+		"node_count":    uint32(count),
+		"record_size":   uint16(w.recordSize),
+		"ip_version":    uint16(w.ipVersion),
+		"database_type": w.dbType,
+		"build_epoch":   uint64(1700000000),
+	})
+	return buf.Bytes()
+}
+
+// pointer is encoded as a pointer to a data offset.
+type pointer uint
+
+// encode appends a value to the data section, the map keys in order.
+func encode(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case pointer:
+		// 11 bit pointer
+		buf.Write([]byte{typePointer<<5 | byte(v>>8&0x7), byte(v)})
+	case string:
+		control(buf, typeString, len(v))
+		buf.WriteString(v)
+	case float64:
+		control(buf, typeDouble, 8)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	case float32:
+		control(buf, typeFloat, 4)
+		buf.Write(binary.BigEndian.AppendUint32(nil, math.Float32bits(v)))
+	case []byte:
+		control(buf, typeBytes, len(v))
+		buf.Write(v)
+	case uint16:
+		unsigned(buf, typeUint16, uint64(v))
+	case uint32:
+		unsigned(buf, typeUint32, uint64(v))
+	case uint64:
+		unsigned(buf, typeUint64, v)
+	case int32:
+		control(buf, typeInt32, 4)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	case *big.Int:
+		control(buf, typeUint128, len(v.Bytes()))
+		buf.Write(v.Bytes())
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		control(buf, typeBool, size)
+	case []any:
+		control(buf, typeArray, len(v))
+		for _, item := range v {
+			encode(buf, item)
+		}
+	case map[string]any:
+		control(buf, typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			encode(buf, key)
+			encode(buf, v[key])
+		}
+	default:
+		panic("mmdb: cannot encode the test value")
+	}
+}
+
+// unsigned writes an unsigned integer without its leading zero bytes.
+func unsigned(buf *bytes.Buffer, kind int, value uint64) {
+	b := binary.BigEndian.AppendUint64(nil, value)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	control(buf, kind, len(b))
+	buf.Write(b)
+}
+
+// control writes the control byte of a type and size, the extended types
+// take a second byte and the sizes from 29 on the following bytes.
+func control(buf *bytes.Buffer, kind int, size int) {
+	var extended []byte
+	if kind > 7 {
+		extended = []byte{byte(kind - 7)}
+		kind = typeExtended
+	}
+
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+		size = 30
+	default:
+		n := size - 65821
+		extra = []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+		size = 31
+	}
+
+	buf.WriteByte(byte(kind<<5 | size))
+	buf.Write(extended)
+	buf.Write(extra)
+}
+
+// testDatabases are the GeoLite2 like databases of the testdata directory,
+// used by the GeoIP tests. The documentation ranges are located:
+//
+//	127.0.0.0/8     ID  AS64512 Example Office
+//	192.0.2.0/24    US  AS14061 Example Hosting
+//	198.51.100.0/24 SG  AS64513 Example Transit
+//	2001:db8::/32   no country, registered in NL
+var testDatabases = map[string]func() *writer{
+	"testdata/GeoLite2-Country-Test.mmdb": func() *writer {
+		w := newWriter(6, 24, "GeoLite2-Country")
+		country := func(code string) map[string]any {
+			return map[string]any{"iso_code": code, "names": map[string]any{"en": code}}
+		}
+		w.insert("127.0.0.0/8", map[string]any{"country": country("ID"), "registered_country": country("ID")})
+		w.insert("192.0.2.0/24", map[string]any{"country": country("US"), "registered_country": country("US")})
+		w.insert("198.51.100.0/24", map[string]any{"country": country("SG"), "registered_country": country("SG")})
+		w.insert("2001:db8::/32", map[string]any{"registered_country": country("NL")})
+		return w
+	},
+	"testdata/GeoLite2-ASN-Test.mmdb": func() *writer {
+		w := newWriter(6, 28, "GeoLite2-ASN")
+		asn := func(number uint32, organization string) map[string]any {
+			return map[string]any{"autonomous_system_number": number, "autonomous_system_organization": organization}
+		}
+		w.insert("127.0.0.0/8", asn(64512, "Example Office"))
+		w.insert("192.0.2.0/24", asn(14061, "Example Hosting"))
+		w.insert("198.51.100.0/24", asn(64513, "Example Transit"))
+		return w
+	},
+}
+
+// TestTestdata checks the testdata databases are the ones written by the
+// writer, go test ./pkg/mmdb -run TestTestdata -update rewrites them.
+func TestTestdata(t *testing.T) {
+	for file, build := range testDatabases {
+		want := build().bytes()
+		if *update {
+			if err := os.WriteFile(file, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is outdated, run the test with -update", file)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package openapi
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec is the subset of an OpenAPI 3 document used to validate requests:
+// paths, operations, parameters, request bodies and their schemas. Only
+// local references (#/components/...) are resolved.
+type Spec struct {
+	OpenAPI    string               `yaml:"openapi,omitempty"`
+	Info       *Info                `yaml:"info,omitempty"`
+	Servers    []Server             `yaml:"servers,omitempty"`
+	Paths      map[string]*PathItem `yaml:"paths,omitempty"`
+	Components Components           `yaml:"components,omitempty"`
+
+	basePath string
+	routes   []route
+}
+
+type Info struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description,omitempty"`
+	Version     string `yaml:"version"`
+}
+
+type Server struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+type Components struct {
+	Schemas       map[string]*Schema      `yaml:"schemas,omitempty"`
+	Parameters    map[string]*Parameter   `yaml:"parameters,omitempty"`
+	RequestBodies map[string]*RequestBody `yaml:"requestBodies,omitempty"`
+}
+
+type PathItem struct {
+	Parameters []*Parameter `yaml:"parameters,omitempty"`
+	Get        *Operation   `yaml:"get,omitempty"`
+	Put        *Operation   `yaml:"put,omitempty"`
+	Post       *Operation   `yaml:"post,omitempty"`
+	Delete     *Operation   `yaml:"delete,omitempty"`
+	Options    *Operation   `yaml:"options,omitempty"`
+	Head       *Operation   `yaml:"head,omitempty"`
+	Patch      *Operation   `yaml:"patch,omitempty"`
+	Trace      *Operation   `yaml:"trace,omitempty"`
+}
+
+type Operation struct {
+	Parameters  []*Parameter `yaml:"parameters,omitempty"`
+	RequestBody *RequestBody `yaml:"requestBody,omitempty"`
+}
+
+type Parameter struct {
+	Ref      string  `yaml:"$ref,omitempty"`
+	Name     string  `yaml:"name,omitempty"`
+	In       string  `yaml:"in,omitempty"` // path, query, header or cookie
+	Required bool    `yaml:"required,omitempty"`
+	Schema   *Schema `yaml:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Ref      string                `yaml:"$ref,omitempty"`
+	Required bool                  `yaml:"required,omitempty"`
+	Content  map[string]*MediaType `yaml:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `yaml:"schema,omitempty"`
+}
+
+// Schema is a JSON schema as used by OpenAPI 3.0 and 3.1.
+type Schema struct {
+	Ref      string `yaml:"$ref,omitempty"`
+	Type     any    `yaml:"type,omitempty"` // a type, or a list of types in OpenAPI 3.1
+	Nullable bool   `yaml:"nullable,omitempty"`
+	Enum     []any  `yaml:"enum,omitempty"`
+
+	// strings
+	MinLength *int   `yaml:"minLength,omitempty"`
+	MaxLength *int   `yaml:"maxLength,omitempty"`
+	Pattern   string `yaml:"pattern,omitempty"`
+
+	// numbers
+	Minimum          *float64 `yaml:"minimum,omitempty"`
+	Maximum          *float64 `yaml:"maximum,omitempty"`
+	ExclusiveMinimum any      `yaml:"exclusiveMinimum,omitempty"` // a flag in 3.0, a number in 3.1
+	ExclusiveMaximum any      `yaml:"exclusiveMaximum,omitempty"`
+
+	// arrays
+	Items    *Schema `yaml:"items,omitempty"`
+	MinItems *int    `yaml:"minItems,omitempty"`
+	MaxItems *int    `yaml:"maxItems,omitempty"`
+
+	// objects
+	Required             []string           `yaml:"required,omitempty"`
+	Properties           map[string]*Schema `yaml:"properties,omitempty"`
+	AdditionalProperties *Additional        `yaml:"additionalProperties,omitempty"`
+
+	AllOf []*Schema `yaml:"allOf,omitempty"`
+	AnyOf []*Schema `yaml:"anyOf,omitempty"`
+	OneOf []*Schema `yaml:"oneOf,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Additional is the additionalProperties keyword, either a flag or a schema.
+type Additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *Additional) UnmarshalYAML(unmarshal func(any) error) error {
+	if err := unmarshal(&a.Allowed); err == nil {
+		return nil
+	}
+	a.Allowed = true
+	return unmarshal(&a.Schema)
+}
+
+func (a *Additional) MarshalYAML() (any, error) {
+	if a.Schema != nil {
+		return a.Schema, nil
+	}
+	return a.Allowed, nil
+}
+
+// route is a compiled path template, e.g. /users/{id}.
+type route struct {
+	template string
+	segments []string
+	literals int // literal segments, the most literal route wins
+	item     *PathItem
+}
+
+// Load parses an OpenAPI 3 document in YAML or JSON.
+func Load(data []byte) (*Spec, error) {
+	var spec Spec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("no paths")
+	}
+
+	// the paths are relative to the path of the first server
+	if len(spec.Servers) > 0 {
+		if server, err := url.Parse(spec.Servers[0].URL); err == nil {
+			spec.basePath = strings.TrimSuffix(server.Path, "/")
+		}
+	}
+
+	for template, item := range spec.Paths {
+		r := route{template: template, segments: strings.Split(strings.Trim(template, "/"), "/"), item: item}
+		for _, segment := range r.segments {
+			if !strings.HasPrefix(segment, "{") {
+				r.literals++
+			}
+		}
+		spec.routes = append(spec.routes, r)
+	}
+	// templates matching the same path are tried in a stable order
+	slices.SortFunc(spec.routes, func(a, b route) int { return strings.Compare(a.template, b.template) })
+
+	if err := spec.compile(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// compile resolves the parameter references and compiles the patterns.
+func (s *Spec) compile() error {
+	var schemas []*Schema
+	seen := make(map[*Schema]bool)
+	var collect func(schema *Schema)
+	collect = func(schema *Schema) {
+		if schema == nil || seen[schema] {
+			return
+		}
+		seen[schema] = true
+		schemas = append(schemas, schema)
+
+		collect(schema.Items)
+		if schema.AdditionalProperties != nil {
+			collect(schema.AdditionalProperties.Schema)
+		}
+		for _, property := range schema.Properties {
+			collect(property)
+		}
+		for _, list := range [][]*Schema{schema.AllOf, schema.AnyOf, schema.OneOf} {
+			for _, item := range list {
+				collect(item)
+			}
+		}
+	}
+
+	for _, schema := range s.Components.Schemas {
+		collect(schema)
+	}
+	for _, r := range s.routes {
+		for _, operation := range r.item.operations() {
+			for _, parameter := range slices.Concat(r.item.Parameters, operation.Parameters) {
+				resolved, err := s.parameter(parameter)
+				if err != nil {
+					return fmt.Errorf("%s: %w", r.template, err)
+				}
+				collect(resolved.Schema)
+			}
+
+			body, err := s.requestBody(operation.RequestBody)
+			if err != nil {
+				return fmt.Errorf("%s: %w", r.template, err)
+			}
+			if body != nil {
+				for _, media := range body.Content {
+					if media != nil {
+						collect(media.Schema)
+					}
+				}
+			}
+		}
+	}
+
+	for _, schema := range schemas {
+		if schema.Ref != "" && s.schema(schema) == nil {
+			return fmt.Errorf("unresolved reference %q", schema.Ref)
+		}
+		if schema.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", schema.Pattern, err)
+		}
+		schema.pattern = re
+	}
+	return nil
+}
+
+func (p *PathItem) operations() map[string]*Operation {
+	operations := make(map[string]*Operation)
+	for method, operation := range map[string]*Operation{
+		"GET": p.Get, "PUT": p.Put, "POST": p.Post, "DELETE": p.Delete,
+		"OPTIONS": p.Options, "HEAD": p.Head, "PATCH": p.Patch, "TRACE": p.Trace,
+	} {
+		if operation != nil {
+			operations[method] = operation
+		}
+	}
+	return operations
+}
+
+// SetOperation sets the operation of an HTTP method.
+func (p *PathItem) SetOperation(method string, operation *Operation) {
+	switch strings.ToUpper(method) {
+	case "GET":
+		p.Get = operation
+	case "PUT":
+		p.Put = operation
+	case "POST":
+		p.Post = operation
+	case "DELETE":
+		p.Delete = operation
+	case "OPTIONS":
+		p.Options = operation
+	case "HEAD":
+		p.Head = operation
+	case "PATCH":
+		p.Patch = operation
+	case "TRACE":
+		p.Trace = operation
+	}
+}
+
+func (s *Spec) parameter(parameter *Parameter) (*Parameter, error) {
+	if parameter.Ref == "" {
+		return parameter, nil
+	}
+	resolved, ok := s.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference %q", parameter.Ref)
+	}
+	return resolved, nil
+}
+
+func (s *Spec) requestBody(body *RequestBody) (*RequestBody, error) {
+	if body == nil || body.Ref == "" {
+		return body, nil
+	}
+	resolved, ok := s.Components.RequestBodies[strings.TrimPrefix(body.Ref, "#/components/requestBodies/")]
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference %q", body.Ref)
+	}
+	return resolved, nil
+}
+
+// schema follows the references of a schema.
+func (s *Spec) schema(schema *Schema) *Schema {
+	for i := 0; schema != nil && schema.Ref != "" && i < 32; i++ {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
@@ -0,0 +1,536 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxSchemaDepth stops validating pathological nested values and recursive references.
+const maxSchemaDepth = 64
+
+// Violation kinds.
+const (
+	ViolationPath      = "path"      // no path of the spec matches
+	ViolationMethod    = "method"    // the path does not declare the method
+	ViolationParameter = "parameter" // a parameter is missing, unknown or invalid
+	ViolationBody      = "body"      // the body is missing, unexpected or invalid
+)
+
+// Request is the part of an HTTP request validated against a spec.
+type Request struct {
+	Method      string
+	Path        string // without the query string, not decoded
+	Query       url.Values
+	Headers     map[string][]string
+	Cookies     map[string][]string
+	ContentType string
+	Body        []byte
+}
+
+// Violation describes why a request does not conform to the spec.
+type Violation struct {
+	Kind    string
+	In      string // location of a parameter: path, query, header or cookie
+	Name    string // parameter name or path of the invalid body field
+	Value   string
+	Message string
+}
+
+// Validate checks a request against the spec and returns the first violation
+// of each parameter and of the body.
+func (s *Spec) Validate(request Request) []Violation {
+	path := request.Path
+	if s.basePath != "" {
+		if path != s.basePath && !strings.HasPrefix(path, s.basePath+"/") {
+			return []Violation{{Kind: ViolationPath, Value: request.Path, Message: "Path not declared in the API specification"}}
+		}
+		path = strings.TrimPrefix(path, s.basePath)
+	}
+
+	item, pathParams := s.match(path)
+	if item == nil {
+		return []Violation{{Kind: ViolationPath, Value: request.Path, Message: "Path not declared in the API specification"}}
+	}
+	method := strings.ToUpper(request.Method)
+	operations := item.operations()
+	// CORS preflights and HEAD requests are answered by the server for the declared operations
+	if method == "OPTIONS" && operations[method] == nil && len(headerValues(request.Headers, "Access-Control-Request-Method")) > 0 {
+		return nil
+	}
+	if method == "HEAD" && operations[method] == nil {
+		method = "GET"
+	}
+	operation, ok := operations[method]
+	if !ok {
+		return []Violation{{Kind: ViolationMethod, Value: request.Method, Message: "Method not declared in the API specification"}}
+	}
+
+	var violations []Violation
+
+	// operation parameters override the path item parameters with the same name and location
+	parameters := make(map[string]*Parameter)
+	for _, parameter := range slices.Concat(item.Parameters, operation.Parameters) {
+		resolved, _ := s.parameter(parameter)
+		parameters[resolved.In+":"+resolved.Name] = resolved
+	}
+
+	for _, parameter := range parameters {
+		var values []string
+		switch parameter.In {
+		case "path":
+			if value, ok := pathParams[parameter.Name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = request.Query[parameter.Name]
+		case "header":
+			values = headerValues(request.Headers, parameter.Name)
+		case "cookie":
+			values = request.Cookies[parameter.Name]
+		}
+
+		if message := s.validateParameter(parameter, values); message != "" {
+			value := ""
+			if len(values) > 0 {
+				value = values[0]
+			}
+			violations = append(violations, Violation{Kind: ViolationParameter, In: parameter.In, Name: parameter.Name, Value: value, Message: message})
+		}
+	}
+
+	// the spec is an allowlist, undeclared query parameters are rejected
+	for name, values := range request.Query {
+		if _, ok := parameters["query:"+name]; !ok {
+			violations = append(violations, Violation{Kind: ViolationParameter, In: "query", Name: name, Value: values[0], Message: "Query parameter not declared in the API specification"})
+		}
+	}
+
+	if violation, ok := s.validateBody(operation, request); !ok {
+		violations = append(violations, violation)
+	}
+
+	return violations
+}
+
+// match returns the path item matching the path, the most literal template
+// wins, and the values of the path parameters.
+func (s *Spec) match(path string) (*PathItem, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	var best *route
+	var params map[string]string
+	for i := range s.routes {
+		r := &s.routes[i]
+		if len(r.segments) != len(segments) || (best != nil && r.literals <= best.literals) {
+			continue
+		}
+
+		values, ok := r.bind(segments)
+		if ok {
+			best, params = r, values
+		}
+	}
+
+	if best == nil {
+		return nil, nil
+	}
+	return best.item, params
+}
+
+// bind matches the segments of a path against the template.
+func (r *route) bind(segments []string) (map[string]string, bool) {
+	values := make(map[string]string)
+	for i, segment := range r.segments {
+		decoded, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, false
+		}
+
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if decoded == "" {
+				return nil, false
+			}
+			values[segment[1:len(segment)-1]] = decoded
+		} else if segment != decoded {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	for key, values := range headers {
+		if strings.EqualFold(key, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// validateParameter checks the presence of a parameter and converts its
+// values to the schema type before validating them, it returns the
+// violation message.
+func (s *Spec) validateParameter(parameter *Parameter, values []string) string {
+	if len(values) == 0 {
+		if parameter.Required || parameter.In == "path" {
+			return "Missing required " + parameter.In + " parameter"
+		}
+		return ""
+	}
+
+	schema := s.schema(parameter.Schema)
+	if schema == nil {
+		return ""
+	}
+
+	var value any
+	if schemaTypes(schema)["array"] {
+		// exploded query arrays repeat the parameter, the other ones are comma separated
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]any, len(values))
+		for i, item := range values {
+			items[i] = convert(s.schema(schema.Items), item)
+		}
+		value = items
+	} else {
+		if len(values) > 1 {
+			return "Repeated " + parameter.In + " parameter"
+		}
+		value = convert(schema, values[0])
+	}
+
+	if err := s.validateValue(schema, value, parameter.Name, 0); err != nil {
+		return "Invalid " + parameter.In + " parameter: " + err.Error()
+	}
+	return ""
+}
+
+// convert parses a parameter value as the schema type, values that fail to
+// parse are kept as strings so the type check reports them.
+func convert(schema *Schema, value string) any {
+	if schema == nil {
+		return value
+	}
+
+	types := schemaTypes(schema)
+	switch {
+	case types["integer"] || types["number"]:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case types["boolean"]:
+		if b, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+			return b
+		}
+	case types["null"] && value == "":
+		return nil
+	}
+	return value
+}
+
+// validateBody checks the presence, the content type and the JSON schema of the body.
+func (s *Spec) validateBody(operation *Operation, request Request) (Violation, bool) {
+	body, _ := s.requestBody(operation.RequestBody)
+	if len(request.Body) == 0 {
+		if body != nil && body.Required {
+			return Violation{Kind: ViolationBody, Message: "Missing required request body"}, false
+		}
+		return Violation{}, true
+	}
+	if body == nil {
+		return Violation{Kind: ViolationBody, Message: "Request body not declared in the API specification"}, false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(request.ContentType)
+	if err != nil {
+		return Violation{Kind: ViolationBody, Value: request.ContentType, Message: "Invalid content type"}, false
+	}
+	media, ok := findMedia(body.Content, mediaType)
+	if !ok {
+		return Violation{Kind: ViolationBody, Value: mediaType, Message: "Content type not declared in the API specification"}, false
+	}
+
+	if media == nil || media.Schema == nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return Violation{}, true
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(request.Body))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return Violation{Kind: ViolationBody, Message: "Invalid JSON body"}, false
+	}
+	// the data after the document is not validated, the backend may read it
+	if _, err := decoder.Token(); err != io.EOF {
+		return Violation{Kind: ViolationBody, Message: "Invalid JSON body"}, false
+	}
+
+	if err := s.validateValue(media.Schema, document, "body", 0); err != nil {
+		violation := Violation{Kind: ViolationBody, Message: "Invalid request body: " + err.Error()}
+		if e, ok := err.(*valueError); ok {
+			violation.Name, violation.Value = e.at, e.value
+		}
+		return violation, false
+	}
+	return Violation{}, true
+}
+
+// findMedia looks up the content type, then its type/* and */* wildcards.
+func findMedia(content map[string]*MediaType, mediaType string) (*MediaType, bool) {
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, key := range []string{mediaType, major + "/*", "*/*"} {
+		for declared, media := range content {
+			if strings.EqualFold(declared, key) {
+				return media, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// valueError locates the invalid value of a document.
+type valueError struct {
+	at      string
+	value   string
+	message string
+}
+
+func (e *valueError) Error() string {
+	return e.at + " " + e.message
+}
+
+func invalid(at string, value any, format string, args ...any) error {
+	text := fmt.Sprint(value)
+	if len(text) > 64 {
+		text = text[:64] + "..."
+	}
+	return &valueError{at: at, value: text, message: fmt.Sprintf(format, args...)}
+}
+
+// validateValue checks a decoded JSON value against a schema.
+func (s *Spec) validateValue(schema *Schema, value any, at string, depth int) error {
+	schema = s.schema(schema)
+	if schema == nil {
+		return nil
+	}
+	if depth > maxSchemaDepth {
+		return invalid(at, "", "nested too deep")
+	}
+
+	for _, sub := range schema.AllOf {
+		if err := s.validateValue(sub, value, at, depth+1); err != nil {
+			return err
+		}
+	}
+	if len(schema.AnyOf) > 0 && !slices.ContainsFunc(schema.AnyOf, func(sub *Schema) bool {
+		return s.validateValue(sub, value, at, depth+1) == nil
+	}) {
+		return invalid(at, value, "does not match any allowed schema")
+	}
+	if len(schema.OneOf) > 0 {
+		valid := 0
+		for _, sub := range schema.OneOf {
+			if s.validateValue(sub, value, at, depth+1) == nil {
+				valid++
+			}
+		}
+		if valid != 1 {
+			return invalid(at, value, "does not match exactly one schema")
+		}
+	}
+
+	types := schemaTypes(schema)
+	if value == nil {
+		if len(types) == 0 || types["null"] || schema.Nullable {
+			return nil
+		}
+		return invalid(at, "null", "must not be null")
+	}
+
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(allowed any) bool { return equal(allowed, value) }) {
+		return invalid(at, value, "is not one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case string:
+		if len(types) > 0 && !types["string"] {
+			return invalid(at, v, "must be %s", typeList(types))
+		}
+		return s.validateString(schema, v, at)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return invalid(at, v, "is not a number")
+		}
+		if types["integer"] && !types["number"] && f != math.Trunc(f) {
+			return invalid(at, v, "must be an integer")
+		}
+		if len(types) > 0 && !types["integer"] && !types["number"] {
+			return invalid(at, v, "must be %s", typeList(types))
+		}
+		return validateNumber(schema, f, at)
+	case bool:
+		if len(types) > 0 && !types["boolean"] {
+			return invalid(at, v, "must be %s", typeList(types))
+		}
+	case []any:
+		if len(types) > 0 && !types["array"] {
+			return invalid(at, "array", "must be %s", typeList(types))
+		}
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			return invalid(at, len(v), "must have at least %d items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			return invalid(at, len(v), "must have at most %d items", *schema.MaxItems)
+		}
+		for i, item := range v {
+			if err := s.validateValue(schema.Items, item, at+"."+strconv.Itoa(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if len(types) > 0 && !types["object"] {
+			return invalid(at, "object", "must be %s", typeList(types))
+		}
+		return s.validateObject(schema, v, at, depth)
+	}
+	return nil
+}
+
+func (s *Spec) validateString(schema *Schema, value, at string) error {
+	length := len([]rune(value))
+	if schema.MinLength != nil && length < *schema.MinLength {
+		return invalid(at, value, "must be at least %d characters", *schema.MinLength)
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return invalid(at, value, "must be at most %d characters", *schema.MaxLength)
+	}
+	if schema.pattern != nil && !schema.pattern.MatchString(value) {
+		return invalid(at, value, "does not match the pattern %s", schema.Pattern)
+	}
+	return nil
+}
+
+func validateNumber(schema *Schema, value float64, at string) error {
+	if schema.Minimum != nil {
+		if exclusive, _ := schema.ExclusiveMinimum.(bool); exclusive && value <= *schema.Minimum {
+			return invalid(at, value, "must be greater than %v", *schema.Minimum)
+		} else if value < *schema.Minimum {
+			return invalid(at, value, "must be at least %v", *schema.Minimum)
+		}
+	}
+	if limit, ok := toFloat(schema.ExclusiveMinimum); ok && value <= limit {
+		return invalid(at, value, "must be greater than %v", limit)
+	}
+	if schema.Maximum != nil {
+		if exclusive, _ := schema.ExclusiveMaximum.(bool); exclusive && value >= *schema.Maximum {
+			return invalid(at, value, "must be less than %v", *schema.Maximum)
+		} else if value > *schema.Maximum {
+			return invalid(at, value, "must be at most %v", *schema.Maximum)
+		}
+	}
+	if limit, ok := toFloat(schema.ExclusiveMaximum); ok && value >= limit {
+		return invalid(at, value, "must be less than %v", limit)
+	}
+	return nil
+}
+
+func (s *Spec) validateObject(schema *Schema, object map[string]any, at string, depth int) error {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return invalid(at+"."+name, "", "is required")
+		}
+	}
+
+	// sorted so the reported violation does not change between requests
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if property, ok := schema.Properties[name]; ok {
+			if err := s.validateValue(property, object[name], at+"."+name, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		additional := schema.AdditionalProperties
+		if additional == nil {
+			continue
+		}
+		if !additional.Allowed {
+			return invalid(at+"."+name, "", "is not an allowed property")
+		}
+		if err := s.validateValue(additional.Schema, object[name], at+"."+name, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaTypes returns the types allowed by a schema, empty allows any type.
+func schemaTypes(schema *Schema) map[string]bool {
+	types := make(map[string]bool)
+	switch t := schema.Type.(type) {
+	case string:
+		types[t] = true
+	case []any:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types[name] = true
+			}
+		}
+	}
+	if len(types) > 0 && schema.Nullable {
+		types["null"] = true
+	}
+	return types
+}
+
+func typeList(types map[string]bool) string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, " or ")
+}
+
+// equal compares an enum value of the spec with a decoded value, numbers by value.
+func equal(allowed, value any) bool {
+	if a, ok := toFloat(allowed); ok {
+		b, ok := toFloat(value)
+		return ok && a == b
+	}
+	return fmt.Sprint(allowed) == fmt.Sprint(value) && fmt.Sprintf("%T", allowed) == fmt.Sprintf("%T", value)
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,283 @@
+package openapi
+
+import (
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testSpec = `
+openapi: 3.1.0
+info:
+  title: Test API
+  version: 1.0.0
+servers:
+  - url: https://api.example.com/v1/
+paths:
+  /users:
+    get:
+      parameters:
+        - name: page
+          in: query
+          schema: {type: integer, minimum: 1}
+        - name: tags
+          in: query
+          schema:
+            type: array
+            maxItems: 3
+            items: {type: string, enum: [a, b, c]}
+        - name: X-Tenant
+          in: header
+          required: true
+          schema: {type: string, pattern: '^[a-z]+$'}
+        - name: session
+          in: cookie
+          schema: {type: string, minLength: 8}
+    post:
+      requestBody:
+        $ref: '#/components/requestBodies/User'
+  /users/{id}:
+    parameters:
+      - $ref: '#/components/parameters/UserID'
+    get: {}
+    delete:
+      parameters:
+        - name: id
+          in: path
+          schema: {type: string, enum: [me]}
+  /users/me:
+    get: {}
+  /shapes:
+    put:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              properties:
+                shape:
+                  oneOf:
+                    - {type: object, required: [radius], properties: {radius: {type: number, exclusiveMinimum: 0}}}
+                    - {type: object, required: [side], properties: {side: {type: number, exclusiveMinimum: 0}}}
+                color:
+                  anyOf:
+                    - {type: string, enum: [red, green]}
+                    - {type: integer, minimum: 0, maximum: 255}
+                label:
+                  allOf:
+                    - {type: string, maxLength: 8}
+                    - {type: string, pattern: '^[a-z]'}
+                ratio:
+                  type: number
+                  minimum: 0
+                  maximum: 1
+                  exclusiveMaximum: true
+                note:
+                  type: [string, "null"]
+                meta:
+                  type: object
+                  additionalProperties: {type: integer}
+          text/*: {}
+components:
+  parameters:
+    UserID:
+      name: id
+      in: path
+      required: true
+      schema: {type: integer, minimum: 1}
+  requestBodies:
+    User:
+      required: true
+      content:
+        application/json:
+          schema:
+            $ref: '#/components/schemas/User'
+  schemas:
+    User:
+      type: object
+      required: [name, email]
+      additionalProperties: false
+      properties:
+        name: {type: string, minLength: 1, maxLength: 8}
+        email: {type: string, pattern: '^[^@]+@[^@]+$'}
+        age: {type: integer, minimum: 0}
+        manager:
+          $ref: '#/components/schemas/User'
+        roles:
+          type: array
+          minItems: 1
+          items: {type: string, enum: [admin, user]}
+`
+
+func loadTestSpec(t *testing.T) *Spec {
+	t.Helper()
+	spec, err := Load([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// violations summarizes the violations as kind:in:name, sorted.
+func violations(list []Violation) []string {
+	var summary []string
+	for _, violation := range list {
+		summary = append(summary, violation.Kind+":"+violation.In+":"+violation.Name)
+	}
+	slices.Sort(summary)
+	return summary
+}
+
+func TestValidate(t *testing.T) {
+	spec := loadTestSpec(t)
+	tenant := map[string][]string{"X-Tenant": {"acme"}}
+	json := "application/json"
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		query       string
+		headers     map[string][]string
+		cookies     map[string][]string
+		contentType string
+		body        string
+		want        []string
+	}{
+		// paths and methods
+		{name: "outside the base path", method: "GET", path: "/users", want: []string{"path::"}},
+		{name: "undeclared path", method: "GET", path: "/v1/groups", want: []string{"path::"}},
+		{name: "undeclared method", method: "PATCH", path: "/v1/users", want: []string{"method::"}},
+		{name: "HEAD of a GET", method: "HEAD", path: "/v1/users", headers: tenant},
+		{name: "CORS preflight", method: "OPTIONS", path: "/v1/users", headers: map[string][]string{"Access-Control-Request-Method": {"POST"}}},
+		{name: "OPTIONS without preflight", method: "OPTIONS", path: "/v1/users", want: []string{"method::"}},
+
+		// parameters
+		{name: "valid parameters", method: "GET", path: "/v1/users", query: "page=2&tags=a,b", headers: tenant, cookies: map[string][]string{"session": {"12345678"}}},
+		{name: "exploded array", method: "GET", path: "/v1/users", query: "tags=a&tags=c", headers: tenant},
+		{name: "missing required header", method: "GET", path: "/v1/users", want: []string{"parameter:header:X-Tenant"}},
+		{name: "header name case", method: "GET", path: "/v1/users", headers: map[string][]string{"x-tenant": {"acme"}}},
+		{name: "header pattern", method: "GET", path: "/v1/users", headers: map[string][]string{"X-Tenant": {"ACME"}}, want: []string{"parameter:header:X-Tenant"}},
+		{name: "integer type", method: "GET", path: "/v1/users", query: "page=two", headers: tenant, want: []string{"parameter:query:page"}},
+		{name: "minimum", method: "GET", path: "/v1/users", query: "page=0", headers: tenant, want: []string{"parameter:query:page"}},
+		{name: "repeated parameter", method: "GET", path: "/v1/users", query: "page=1&page=2", headers: tenant, want: []string{"parameter:query:page"}},
+		{name: "array enum", method: "GET", path: "/v1/users", query: "tags=a,z", headers: tenant, want: []string{"parameter:query:tags"}},
+		{name: "array length", method: "GET", path: "/v1/users", query: "tags=a,b,c,a", headers: tenant, want: []string{"parameter:query:tags"}},
+		{name: "cookie length", method: "GET", path: "/v1/users", headers: tenant, cookies: map[string][]string{"session": {"short"}}, want: []string{"parameter:cookie:session"}},
+		{name: "undeclared query parameter", method: "GET", path: "/v1/users", query: "debug=1", headers: tenant, want: []string{"parameter:query:debug"}},
+
+		// path parameters, references and overrides
+		{name: "path parameter", method: "GET", path: "/v1/users/42"},
+		{name: "encoded path parameter", method: "GET", path: "/v1/users/%34%32"},
+		{name: "invalid path parameter", method: "GET", path: "/v1/users/abc", want: []string{"parameter:path:id"}},
+		{name: "literal path wins", method: "GET", path: "/v1/users/me"},
+		{name: "literal path without the method", method: "DELETE", path: "/v1/users/me", want: []string{"method::"}},
+		{name: "overridden parameter", method: "DELETE", path: "/v1/users/42", want: []string{"parameter:path:id"}},
+
+		// bodies
+		{name: "valid body", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","age":30,"roles":["admin"]}`},
+		{name: "missing required body", method: "POST", path: "/v1/users", want: []string{"body::"}},
+		{name: "undeclared body", method: "GET", path: "/v1/users/42", contentType: json, body: `{}`, want: []string{"body::"}},
+		{name: "undeclared content type", method: "POST", path: "/v1/users", contentType: "application/xml", body: `<a/>`, want: []string{"body::"}},
+		{name: "content type parameters", method: "POST", path: "/v1/users", contentType: "application/json; charset=utf-8", body: `{"name":"Al","email":"a@b"}`},
+		{name: "wildcard content type", method: "PUT", path: "/v1/shapes", contentType: "text/plain", body: "anything"},
+		{name: "invalid JSON", method: "POST", path: "/v1/users", contentType: json, body: `{"name":`, want: []string{"body::"}},
+		{name: "data after the document", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b"} trailing <script>`, want: []string{"body::"}},
+		{name: "second document", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b"}{"name":"<script>"}`, want: []string{"body::"}},
+		{name: "missing required field", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al"}`, want: []string{"body::body.email"}},
+		{name: "additional property", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","admin":true}`, want: []string{"body::body.admin"}},
+		{name: "wrong type", method: "POST", path: "/v1/users", contentType: json, body: `{"name":1,"email":"a@b"}`, want: []string{"body::body.name"}},
+		{name: "max length", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Alexander the Great","email":"a@b"}`, want: []string{"body::body.name"}},
+		{name: "pattern", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"nobody"}`, want: []string{"body::body.email"}},
+		{name: "integer", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","age":1.5}`, want: []string{"body::body.age"}},
+		{name: "array item enum", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","roles":["root"]}`, want: []string{"body::body.roles.0"}},
+		{name: "min items", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","roles":[]}`, want: []string{"body::body.roles"}},
+		{name: "recursive reference", method: "POST", path: "/v1/users", contentType: json, body: `{"name":"Al","email":"a@b","manager":{"name":"Bo","email":"b@c","manager":{"name":"Cy"}}}`, want: []string{"body::body.manager.manager.email"}},
+
+		// composed schemas and number limits
+		{name: "one of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"shape":{"radius":1}}`},
+		{name: "none of one of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"shape":{"width":1}}`, want: []string{"body::body.shape"}},
+		{name: "several of one of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"shape":{"radius":1,"side":1}}`, want: []string{"body::body.shape"}},
+		{name: "exclusive minimum number", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"shape":{"radius":0}}`, want: []string{"body::body.shape"}},
+		{name: "any of string", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"color":"red"}`},
+		{name: "any of integer", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"color":255}`},
+		{name: "none of any of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"color":256}`, want: []string{"body::body.color"}},
+		{name: "all of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"label":"box"}`},
+		{name: "second of all of", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"label":"Box"}`, want: []string{"body::body.label"}},
+		{name: "exclusive maximum flag", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"ratio":1}`, want: []string{"body::body.ratio"}},
+		{name: "below the exclusive maximum", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"ratio":0.99}`},
+		{name: "minimum", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"ratio":-0.1}`, want: []string{"body::body.ratio"}},
+		{name: "null type", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"note":null}`},
+		{name: "not nullable", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"ratio":null}`, want: []string{"body::body.ratio"}},
+		{name: "additional properties schema", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"meta":{"a":1,"b":2}}`},
+		{name: "invalid additional property", method: "PUT", path: "/v1/shapes", contentType: json, body: `{"meta":{"a":"x"}}`, want: []string{"body::body.meta.a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := violations(spec.Validate(Request{
+				Method:      test.method,
+				Path:        test.path,
+				Query:       query,
+				Headers:     test.headers,
+				Cookies:     test.cookies,
+				ContentType: test.contentType,
+				Body:        []byte(test.body),
+			}))
+			if !slices.Equal(got, test.want) {
+				t.Errorf("violations = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{"no paths", "openapi: 3.0.3\n", "no paths"},
+		{"unresolved schema", "paths:\n  /a:\n    post:\n      requestBody:\n        content:\n          application/json:\n            schema: {$ref: '#/components/schemas/Missing'}\n", "unresolved reference"},
+		{"unresolved parameter", "paths:\n  /a:\n    get:\n      parameters: [{$ref: '#/components/parameters/Missing'}]\n", "unresolved reference"},
+		{"invalid pattern", "paths:\n  /a:\n    get:\n      parameters: [{name: q, in: query, schema: {pattern: '('}}]\n", "invalid pattern"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Load([]byte(test.spec)); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Load error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// TestValidateExample checks the example spec shipped in config.
+func TestValidateExample(t *testing.T) {
+	data, err := os.ReadFile("../../config/openapi.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for body, want := range map[string]int{
+		`{"name":"Al","email":"a@b"}`:                   0,
+		`{"name":"Al","email":"a@b"} trailing <script>`: 1,
+		`{"name":"<script>","email":"a@b"}`:             1,
+	} {
+		violations := spec.Validate(Request{Method: "POST", Path: "/api/users", ContentType: "application/json", Body: []byte(body)})
+		if len(violations) != want {
+			t.Errorf("Validate(%s) = %v, want %d violations", body, violations, want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// Package urlpath normalizes request paths the way the backends route them.
+package urlpath
+
+import (
+	"path"
+	"strings"
+)
+
+// Clean returns the shortest equivalent of a decoded path: repeated slashes
+// and the "." and ".." segments are removed, the trailing slash is kept.
+func Clean(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
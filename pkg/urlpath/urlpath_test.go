@@ -0,0 +1,28 @@
+package urlpath
+
+import "testing"
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/reports/export", "/reports/export"},
+		{"/reports/export/", "/reports/export/"},
+		{"reports", "/reports"},
+		{"//reports///export", "/reports/export"},
+		{"/reports/./export", "/reports/export"},
+		{"/admin/posts/../../api/comments", "/api/comments"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/admin/posts/..", "/admin"},
+		{"/admin/posts/../", "/admin/"},
+	}
+
+	for _, test := range tests {
+		if got := Clean(test.path); got != test.want {
+			t.Errorf("Clean(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}